@@ -8,20 +8,99 @@ var (
 	call_rax      = []byte{0xff, 0xd0}                   // callq *%rax
 	mov_rax_xmm0  = []byte{0x66, 0x48, 0x0f, 0x6e, 0xc0} // mov %rax,%xmm0
 	mov_rax_xmm1  = []byte{0x66, 0x48, 0x0f, 0x6e, 0xc8} // mov %rax,%xmm1
+	mov_rdi_rbx   = []byte{0x48, 0x89, 0xfb}             // mov %rdi,%rbx
 	mov_rsp_rbp   = []byte{0x48, 0x89, 0xe5}             // mov %rsp,%rbp
+	mov_rsp_rbx   = []byte{0x48, 0x89, 0xe3}             // mov %rsp,%rbx
 	mov_xmm0_rax  = []byte{0x66, 0x48, 0x0f, 0x7e, 0xc0} // mov %xmm0,%rax
 	mov_xmm1_rax  = []byte{0x66, 0x48, 0x0f, 0x7e, 0xc8} // mov %xmm1,%rax
 	pop_rax       = []byte{0x58}                         // pop %rax
 	pop_rbp       = []byte{0x5d}                         // pop %rbp
+	pop_rbx       = []byte{0x5b}                         // pop %rbx
 	push_rax      = []byte{0x50}                         // push %rax
 	push_rbp      = []byte{0x55}                         // push %rbp
+	push_rbx      = []byte{0x53}                         // push %rbx
 	ret           = []byte{0xc3}                         // ret
 	add_xmm1_xmm0 = []byte{0xf2, 0x0f, 0x58, 0xc1}       // addsd  %xmm1,%xmm0
 	sub_xmm1_xmm0 = []byte{0xf2, 0x0f, 0x5c, 0xc1}       // subsd  %xmm1,%xmm0
 	mul_xmm1_xmm0 = []byte{0xf2, 0x0f, 0x59, 0xc1}       // mulsd  %xmm1,%xmm0
+	mul_xmm0_xmm1 = []byte{0xf2, 0x0f, 0x59, 0xc8}       // mulsd  %xmm0,%xmm1
+	mul_xmm0_xmm0 = []byte{0xf2, 0x0f, 0x59, 0xc0}       // mulsd  %xmm0,%xmm0
 	div_xmm1_xmm0 = []byte{0xf2, 0x0f, 0x5e, 0xc1}       // divsd  %xmm1,%xmm0
+	and_xmm1_xmm0 = []byte{0x66, 0x0f, 0x54, 0xc1}       // andpd  %xmm1,%xmm0
+	or_xmm1_xmm0  = []byte{0x66, 0x0f, 0x56, 0xc1}       // orpd   %xmm1,%xmm0
+	xor_xmm1_xmm0 = []byte{0x66, 0x0f, 0x57, 0xc1}       // xorpd  %xmm1,%xmm0
+	xor_xmm0_xmm1 = []byte{0x66, 0x0f, 0x57, 0xc8}       // xorpd  %xmm0,%xmm1
+	xor_xmm1_xmm1 = []byte{0x66, 0x0f, 0x57, 0xc9}       // xorpd  %xmm1,%xmm1
+	mov_xmm0_rcx  = []byte{0x66, 0x48, 0x0f, 0x7e, 0xc1} // mov %xmm0,%rcx
+	mov_xmm1_rcx  = []byte{0x66, 0x48, 0x0f, 0x7e, 0xc9} // mov %xmm1,%rcx
+	and_rcx_rax   = []byte{0x48, 0x21, 0xc8}             // and %rcx,%rax
+	or_rcx_rax    = []byte{0x48, 0x09, 0xc8}             // or  %rcx,%rax
+	xor_rcx_rax   = []byte{0x48, 0x31, 0xc8}             // xor %rcx,%rax
+	sqrt_xmm0     = []byte{0xf2, 0x0f, 0x51, 0xc0}       // sqrtsd %xmm0,%xmm0
+	min_xmm0_xmm1 = []byte{0xf2, 0x0f, 0x5d, 0xc8}       // minsd  %xmm0,%xmm1
+	max_xmm0_xmm1 = []byte{0xf2, 0x0f, 0x5f, 0xc8}       // maxsd  %xmm0,%xmm1
+	mov_rcx_xmm1  = []byte{0x66, 0x48, 0x0f, 0x6e, 0xc9} // mov %rcx,%xmm1
 )
 
+// comparison predicates for cmpsd
+const (
+	cmp_eq    = 0 // equal
+	cmp_lt    = 1 // less than
+	cmp_le    = 2 // less than or equal
+	cmp_unord = 3 // unordered: either operand is NaN
+	cmp_neq   = 4 // not equal, or unordered (NaN)
+)
+
+// rounding modes for roundsd, with the precision exception suppressed
+const (
+	round_floor = 0x9 // toward -Inf
+	round_ceil  = 0xa // toward +Inf
+	round_trunc = 0xb // toward zero
+)
+
+// opcodes for scalar double arithmetic
+const (
+	op_add = 0x58 // addsd
+	op_mul = 0x59 // mulsd
+	op_sub = 0x5c // subsd
+	op_div = 0x5e // divsd
+)
+
+// returns code for <op>sd %xmmR1,%xmmR2,
+// which sets xmmR2 to (xmmR2 op xmmR1).
+func arith_xmm(op byte, r1, r2 int) []byte {
+	if r1 > 7 || r2 > 7 {
+		panic("arith: unsupported register")
+	}
+	regs := byte(0xc0) | byte(r2)<<3 | byte(r1)
+	return []byte{0xf2, 0x0f, op, regs}
+}
+
+// returns code for roundsd $mode,%xmm0,%xmm0 (SSE4.1)
+func round_xmm0(mode byte) []byte {
+	return []byte{0x66, 0x0f, 0x3a, 0x0b, 0xc0, mode}
+}
+
+// returns code for movq $x,%rcx
+func mov_uint_rcx(x uint64) []byte {
+	return append([]byte{0x48, 0xb9}, uint64Bytes(x)...)
+}
+
+// returns code for movq $x,%rdi
+func mov_uint_rdi(x uint64) []byte {
+	return append([]byte{0x48, 0xbf}, uint64Bytes(x)...)
+}
+
+// returns code for cmpsd $pred,%xmmR1,%xmmR2,
+// which sets xmmR2 to all ones if (xmmR2 pred xmmR1), all zeros otherwise.
+func cmpsd(pred byte, r1, r2 int) []byte {
+	if r1 > 7 || r2 > 7 {
+		panic("cmpsd: unsupported register")
+	}
+	regs := byte(0xc0) | byte(r2)<<3 | byte(r1)
+	return []byte{0xf2, 0x0f, 0xc2, regs, pred}
+}
+
 // returns code for movq %xmmR1,off(%rbp)
 func mov_xmm_x_rbp(r1 byte, off int32) []byte {
 	if r1 > 7 {
@@ -40,6 +119,56 @@ func mov_x_rbp_xmm(off int32, r1 byte) []byte {
 	return append([]byte{0xf3, 0x0f, 0x7e, reg}, int32Bytes(off)...)
 }
 
+// returns code for movq off(%rdi), xmmR1
+func mov_x_rdi_xmm(off int32, r1 byte) []byte {
+	if r1 > 7 {
+		panic("movq: unsupported register")
+	}
+	reg := byte(0x87) | (r1 << 3)
+	return append([]byte{0xf3, 0x0f, 0x7e, reg}, int32Bytes(off)...)
+}
+
+// returns code for mov %rsi,off(%rbp)
+func mov_rsi_x_rbp(off int32) []byte {
+	return append([]byte{0x48, 0x89, 0xb5}, int32Bytes(off)...)
+}
+
+// returns code for mov off(%rbp),%rbx
+func mov_x_rbp_rbx(off int32) []byte {
+	return append([]byte{0x48, 0x8b, 0x9d}, int32Bytes(off)...)
+}
+
+// returns code for callq rel, relative to the next instruction
+func call_rel32(rel int32) []byte {
+	return append([]byte{0xe8}, int32Bytes(rel)...)
+}
+
+// returns code for movq xmmR1, off(%rbx)
+func mov_xmm_x_rbx(r1 byte, off int32) []byte {
+	if r1 > 7 {
+		panic("movq: unsupported register")
+	}
+	reg := byte(0x83) | (r1 << 3)
+	return append([]byte{0x66, 0x0f, 0xd6, reg}, int32Bytes(off)...)
+}
+
+// returns code for movq off(%rbx), xmmR1
+func mov_x_rbx_xmm(off int32, r1 byte) []byte {
+	if r1 > 7 {
+		panic("movq: unsupported register")
+	}
+	reg := byte(0x83) | (r1 << 3)
+	return append([]byte{0xf3, 0x0f, 0x7e, reg}, int32Bytes(off)...)
+}
+
+// returns code for movq %rax,%xmmR
+func mov_rax_xmm(r int) []byte {
+	if r > 7 {
+		panic("movq: unsupported register")
+	}
+	return []byte{0x66, 0x48, 0x0f, 0x6e, 0xc0 | byte(r)<<3}
+}
+
 // returns code for movq $x,%rax
 func mov_float_rax(x float64) []byte {
 	return mov_imm_rax(float64Bytes(x))
@@ -82,6 +211,10 @@ func int32Bytes(x int32) []byte {
 	return (*((*[4]byte)(unsafe.Pointer(&x))))[:]
 }
 
+func uint64Bytes(x uint64) []byte {
+	return (*((*[8]byte)(unsafe.Pointer(&x))))[:]
+}
+
 func uintptrBytes(x uintptr) []byte {
 	return (*((*[8]byte)(unsafe.Pointer(&x))))[:]
 }
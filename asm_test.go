@@ -47,6 +47,26 @@ func TestMovXRbpXmm(t *testing.T) {
 	}
 }
 
+func TestMovXRbxXmm(t *testing.T) {
+	tests := []struct {
+		x    byte
+		off  int32
+		want []byte
+	}{
+		// reference values obtained with gcc and objdump.
+		{0, 0x10, []byte{0xf3, 0x0f, 0x7e, 0x83, 0x10, 0x00, 0x00, 0x00}},
+		{3, 0x10, []byte{0xf3, 0x0f, 0x7e, 0x9b, 0x10, 0x00, 0x00, 0x00}},
+		{7, 0x100, []byte{0xf3, 0x0f, 0x7e, 0xbb, 0x00, 0x01, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		have := fmt.Sprintf("%x", mov_x_rbx_xmm(test.off, test.x))
+		want := fmt.Sprintf("%x", test.want)
+		if have != want {
+			t.Errorf("movq %d(%%rbx),%%xmm%v: have %v, want %v", test.off, test.x, have, want)
+		}
+	}
+}
+
 func TestMovXmm(t *testing.T) {
 	tests := []struct {
 		r1, r2 int
@@ -126,3 +146,35 @@ func TestMovXmm(t *testing.T) {
 		}
 	}
 }
+
+func TestArithXmm(t *testing.T) {
+	tests := []struct {
+		op     byte
+		r1, r2 int
+		want   []byte
+	}{
+		// reference values obtained with gcc and objdump.
+		{op_add, 1, 0, []byte{0xf2, 0x0f, 0x58, 0xc1}},
+		{op_sub, 0, 2, []byte{0xf2, 0x0f, 0x5c, 0xd0}},
+		{op_mul, 2, 1, []byte{0xf2, 0x0f, 0x59, 0xca}},
+		{op_div, 0, 3, []byte{0xf2, 0x0f, 0x5e, 0xd8}},
+		{op_mul, 7, 5, []byte{0xf2, 0x0f, 0x59, 0xef}},
+	}
+	for _, test := range tests {
+		have := fmt.Sprintf("%x", arith_xmm(test.op, test.r1, test.r2))
+		want := fmt.Sprintf("%x", test.want)
+		if have != want {
+			t.Errorf("%x %%xmm%v,%%xmm%v: have %v, want %v", test.op, test.r1, test.r2, have, want)
+		}
+	}
+}
+
+func TestMovRsiRbx(t *testing.T) {
+	// reference values obtained with gcc and objdump.
+	if have, want := fmt.Sprintf("%x", mov_rsi_x_rbp(-0x100)), "4889b500ffffff"; have != want {
+		t.Errorf("mov %%rsi,-0x100(%%rbp): have %v, want %v", have, want)
+	}
+	if have, want := fmt.Sprintf("%x", mov_x_rbp_rbx(-0x100)), "488b9d00ffffff"; have != want {
+		t.Errorf("mov -0x100(%%rbp),%%rbx: have %v, want %v", have, want)
+	}
+}
@@ -5,73 +5,242 @@ package jit
 
 import (
 	"fmt"
+	"strings"
 )
 
-// any expression node in the AST
-type expr interface {
-	children() []expr
+// Expr is any expression node in the AST: one of
+// 	Variable, Constant, BinExpr, *CallExpr, PowExpr, IfExpr, LetExpr, Ref
+// Nodes are immutable: use the New... functions, or Rewrite, to build new trees.
+type Expr interface {
+	children() []Expr
 }
 
-// variable, "x" or "y".
-type variable struct {
+// Variable is a variable, like "x" or "y".
+type Variable struct {
 	name string
 }
 
-func (variable) children() []expr { return nil }
-func (e variable) String() string { return e.name }
+// NewVariable returns a variable node.
+func NewVariable(name string) Variable { return Variable{name: name} }
 
-// numerical constant, like 3.14
-type constant struct {
+// Name returns the variable's name.
+func (e Variable) Name() string { return e.name }
+
+func (Variable) children() []Expr { return nil }
+func (e Variable) String() string { return e.name }
+
+// Constant is a numerical constant, like 3.14
+type Constant struct {
 	value float64
 }
 
-func (constant) children() []expr { return nil }
-func (e constant) String() string { return fmt.Sprint(e.value) }
+// NewConstant returns a constant node.
+func NewConstant(value float64) Constant { return Constant{value: value} }
+
+// Value returns the constant's value.
+func (e Constant) Value() float64 { return e.value }
+
+func (Constant) children() []Expr { return nil }
+func (e Constant) String() string { return fmt.Sprint(e.value) }
 
-// binary expression, like x + y
-type binexpr struct {
+// BinExpr is a binary expression, like x + y.
+// The operator is one of
+// 	+ - * / ^ == != < <= > >= && ||
+// Negation is represented as 0-x, logical not as x==0.
+type BinExpr struct {
 	op   string
-	x, y expr
+	x, y Expr
+}
+
+// NewBinExpr returns the binary expression x op y.
+func NewBinExpr(op string, x, y Expr) BinExpr { return BinExpr{op: op, x: x, y: y} }
+
+// Op returns the operator.
+func (e BinExpr) Op() string { return e.op }
+
+// X returns the left operand.
+func (e BinExpr) X() Expr { return e.x }
+
+// Y returns the right operand.
+func (e BinExpr) Y() Expr { return e.y }
+
+func (e BinExpr) children() []Expr { return []Expr{e.x, e.y} }
+func (e BinExpr) String() string   { return fmt.Sprintf("(%v%v%v)", e.x, e.op, e.y) }
+
+// CallExpr is a function call, like sin(x) or atan2(y, x).
+// Used as a pointer, so that it can be a map key despite the args slice.
+type CallExpr struct {
+	fun  string
+	args []Expr
+}
+
+// NewCallExpr returns a call of function fun.
+func NewCallExpr(fun string, args ...Expr) *CallExpr {
+	return &CallExpr{fun: fun, args: append([]Expr(nil), args...)}
+}
+
+// Fun returns the name of the called function.
+func (e *CallExpr) Fun() string { return e.fun }
+
+// Args returns (a copy of) the arguments.
+func (e *CallExpr) Args() []Expr { return append([]Expr(nil), e.args...) }
+
+func (e *CallExpr) children() []Expr { return e.args }
+func (e *CallExpr) String() string {
+	args := make([]string, len(e.args))
+	for i, a := range e.args {
+		args[i] = fmt.Sprint(a)
+	}
+	return fmt.Sprintf("%v(%v)", e.fun, strings.Join(args, ","))
+}
+
+// PowExpr is an integer power with constant exponent, like x^3.
+// It is not produced by the parser, which represents powers as BinExprs,
+// but by the compiler, which evaluates it by repeated squaring (see expandPow).
+type PowExpr struct {
+	x Expr
+	n int
+}
+
+// X returns the base.
+func (e PowExpr) X() Expr { return e.x }
+
+// N returns the exponent.
+func (e PowExpr) N() int { return e.n }
+
+func (e PowExpr) children() []Expr { return []Expr{e.x} }
+func (e PowExpr) String() string   { return fmt.Sprintf("(%v^%v)", e.x, e.n) }
+
+// IfExpr is a conditional expression, like select(x<0, -x, x).
+// Evaluates to x if cond is non-zero (or NaN), y otherwise.
+type IfExpr struct {
+	cond, x, y Expr
+}
+
+// NewIfExpr returns the conditional expression select(cond, x, y).
+func NewIfExpr(cond, x, y Expr) IfExpr { return IfExpr{cond: cond, x: x, y: y} }
+
+// Cond returns the condition.
+func (e IfExpr) Cond() Expr { return e.cond }
+
+// X returns the value if the condition is true.
+func (e IfExpr) X() Expr { return e.x }
+
+// Y returns the value if the condition is false.
+func (e IfExpr) Y() Expr { return e.y }
+
+func (e IfExpr) children() []Expr { return []Expr{e.cond, e.x, e.y} }
+func (e IfExpr) String() string   { return fmt.Sprintf("select(%v,%v,%v)", e.cond, e.x, e.y) }
+
+// LetExpr is a local binding, like r := x*x+y*y; sqrt(r)+r.
+// The value is evaluated once, and can be referred to by name in the body.
+type LetExpr struct {
+	name        string
+	value, body Expr
+}
+
+// NewLetExpr returns a local binding of name to value, visible in body (as a Ref).
+func NewLetExpr(name string, value, body Expr) LetExpr {
+	return LetExpr{name: name, value: value, body: body}
+}
+
+// Name returns the bound name.
+func (e LetExpr) Name() string { return e.name }
+
+// Value returns the bound value.
+func (e LetExpr) Value() Expr { return e.value }
+
+// Body returns the expression in which the binding is visible.
+func (e LetExpr) Body() Expr { return e.body }
+
+func (e LetExpr) children() []Expr { return []Expr{e.value, e.body} }
+func (e LetExpr) String() string   { return fmt.Sprintf("%v := %v; %v", e.name, e.value, e.body) }
+
+// Ref is a reference to a local binding.
+type Ref struct {
+	name string
 }
 
-func (e binexpr) children() []expr { return []expr{e.x, e.y} }
-func (e binexpr) String() string   { return fmt.Sprintf("(%v%v%v)", e.x, e.op, e.y) }
+// NewRef returns a reference to the local binding with given name.
+func NewRef(name string) Ref { return Ref{name: name} }
+
+// Name returns the name of the binding.
+func (e Ref) Name() string { return e.name }
+
+func (Ref) children() []Expr { return nil }
+func (e Ref) String() string { return e.name }
 
-// function call, like sin(x)
-type callexpr struct {
-	fun string
-	arg expr
+// rebuild returns a copy of e where each child c has been replaced by f(c).
+func rebuild(e Expr, f func(Expr) Expr) Expr {
+	switch e := e.(type) {
+	default:
+		panic(fmt.Sprintf("rebuild %T", e))
+	case Variable, Constant, Ref:
+		return e
+	case BinExpr:
+		return BinExpr{op: e.op, x: f(e.x), y: f(e.y)}
+	case *CallExpr:
+		args := make([]Expr, len(e.args))
+		for i, a := range e.args {
+			args[i] = f(a)
+		}
+		return &CallExpr{fun: e.fun, args: args}
+	case IfExpr:
+		return IfExpr{cond: f(e.cond), x: f(e.x), y: f(e.y)}
+	case PowExpr:
+		return PowExpr{x: f(e.x), n: e.n}
+	case LetExpr:
+		return LetExpr{name: e.name, value: f(e.value), body: f(e.body)}
+	}
 }
 
-func (e callexpr) children() []expr { return []expr{e.arg} }
-func (e callexpr) String() string   { return fmt.Sprintf("%v(%v)", e.fun, e.arg) }
+// substitute returns a copy of e where all references to name have been replaced by v.
+func substitute(e Expr, name string, v Expr) Expr {
+	if r, ok := e.(Ref); ok && r.name == name {
+		return v
+	}
+	return rebuild(e, func(c Expr) Expr { return substitute(c, name, v) })
+}
 
 // recordCalls iterates over the AST with given root
 // and records, in m, for each encountered expression whether it contains a function call.
 // Used to determine whether evaluating an expression causes the register contents to be destroyed.
-func recordCalls(root expr, m map[expr]bool) {
+// Structurally identical subexpressions share an entry, which is harmless as they contain the same calls.
+func recordCalls(root Expr, m map[Expr]bool) {
 	for _, c := range root.children() {
 		recordCalls(c, m)
 		if m[c] {
 			m[root] = true
 		}
 	}
-	if _, ok := root.(callexpr); ok {
-		m[root] = true
+	switch root := root.(type) {
+	case *CallExpr:
+		if !inlined(root.fun) {
+			m[root] = true
+		}
+	case BinExpr:
+		if root.op == "^" { // non-constant powers call pow()
+			m[root] = true
+		}
 	}
 }
 
 // recordDepth iteratates over the AST with given root
 // and records, in m, the number of binary expressions under each expression encountered.
 // Used to decide which side of a binary expression requires least registers.
-func recordDepth(root expr, m map[expr]int) {
+func recordDepth(root Expr, m map[Expr]int) {
 	for _, c := range root.children() {
 		recordDepth(c, m)
 		if m[c] > m[root] {
 			m[root] = m[c]
 		}
 	}
-	if _, ok := root.(binexpr); ok {
+	switch root := root.(type) {
+	case BinExpr, IfExpr, LetExpr:
 		m[root]++
+	case *CallExpr:
+		if len(root.args) > 1 { // arguments are stashed like BinExpr operands
+			m[root]++
+		}
 	}
 }
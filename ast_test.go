@@ -11,6 +11,8 @@ func TestParser(t *testing.T) {
 		"sin(x)",
 		"-x",
 		"+x",
+		"r := x*x; r+1",
+		"a := x; b := a+y; a*b",
 	}
 
 	for _, test := range tests {
@@ -39,6 +41,9 @@ func TestRecordCalls(t *testing.T) {
 		{"1+1+1+1+1+1+1+1+1+1+1+1+1+1+1+1+1+1", false},
 		{"+x", false},
 		{"-x", false},
+		{"sqrt(x*x+y*y)-1", false},
+		{"max(fabs(x), min(y, 1))", false},
+		{"pow(x, y)", true},
 		{"1+2+(3+2*4+((((5+6*2)+7)+sqrt(8))+9)+10*sin(2-x+y/3))+11", true},
 	}
 
@@ -48,10 +53,59 @@ func TestRecordCalls(t *testing.T) {
 			t.Error(err)
 			continue
 		}
-		m := make(map[expr]bool)
+		m := make(map[Expr]bool)
 		recordCalls(root, m)
 		if m[root] != test.want {
 			t.Errorf("has calls %q: have %v, want %v", test.expr, m[root], test.want)
 		}
 	}
 }
+
+func TestAccessors(t *testing.T) {
+	root, err := Parse("r := x*2; ifelse(r < y, sin(r), atan2(y, -x))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := root.(LetExpr)
+	if l.Name() != "r" {
+		t.Errorf("LetExpr.Name: have %q", l.Name())
+	}
+	mul := l.Value().(BinExpr)
+	if mul.Op() != "*" || mul.X().(Variable).Name() != "x" || mul.Y().(Constant).Value() != 2 {
+		t.Errorf("BinExpr: have %v", mul)
+	}
+	cond := l.Body().(IfExpr)
+	if cond.Cond().(BinExpr).Op() != "<" || cond.Cond().(BinExpr).X().(Ref).Name() != "r" {
+		t.Errorf("IfExpr.Cond: have %v", cond.Cond())
+	}
+	sin := cond.X().(*CallExpr)
+	if sin.Fun() != "sin" || len(sin.Args()) != 1 {
+		t.Errorf("CallExpr: have %v", sin)
+	}
+	atan2 := cond.Y().(*CallExpr)
+	args := atan2.Args()
+	args[0] = nil // must not modify the node
+	if atan2.Args()[0] == nil {
+		t.Errorf("CallExpr.Args does not return a copy")
+	}
+}
+
+func TestConstructors(t *testing.T) {
+	x, y := NewVariable("x"), NewVariable("y")
+	e := NewLetExpr("a", NewBinExpr("+", x, NewConstant(1)),
+		NewIfExpr(NewBinExpr("<", NewRef("a"), y), NewCallExpr("sqrt", NewRef("a")), y))
+	want, err := Parse("a := x+1; ifelse(a < y, sqrt(a), y)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameExpr(e, want) {
+		t.Errorf("have %v, want %v", e, want)
+	}
+
+	args := []Expr{x}
+	c := NewCallExpr("sin", args...)
+	args[0] = y // must not modify the node
+	if c.Args()[0] != x {
+		t.Errorf("NewCallExpr does not copy args")
+	}
+}
@@ -112,3 +112,28 @@ func eval2dGo(f func(float64, float64) float64, dst [][]float64, xmin, xmax floa
 		}
 	}
 }
+
+func BenchmarkBigEval(b *testing.B) {
+	code, err := Compile("1+x+(3+y*4+((((x+y*2)+x)+sqrt(8))+y)+10*sin(2-x+y/3))+11")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer code.Free()
+	for i := 0; i < b.N; i++ {
+		code.Eval(0.5, 0.25)
+	}
+}
+
+func BenchmarkBigEvalDual(b *testing.B) {
+	code, err := Compile("1+x+(3+y*4+((((x+y*2)+x)+sqrt(8))+y)+10*sin(2-x+y/3))+11")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer code.Free()
+	if err := code.Dual(); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		code.EvalDual(0.5, 0.25, 1, 0)
+	}
+}
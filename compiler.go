@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"unicode"
+	"unsafe"
 )
 
 // optimization settings
@@ -11,42 +13,318 @@ var (
 	useRegisters    = true
 	useCallDepth    = true
 	useConstFolding = true
+	optLevel        = OptSafe // used if useConstFolding
+	useInlining     = true
+	useCSE          = true
 )
 
 // Compile compiles an arithmetic expression, which may contain the variables x and y. E.g.:
 // 	(x+1) * (y-2)
 // If no longer needed, the returned code must be explicitly freed with Free().
 func Compile(ex string) (c *Code, e error) {
-	root, err := Parse(ex)
+	return CompileVars(ex, "x", "y")
+}
+
+// CompileVars compiles an arithmetic expression of the given variables. E.g.:
+// 	CompileVars("rho*v0*v0/2", "rho", "v0")
+// The order of vars determines the order of the arguments passed to EvalN.
+// If no longer needed, the returned code must be explicitly freed with Free().
+//
+// Errors in the expression are returned as a *ParseError, other errors as a *CompileError.
+func CompileVars(ex string, vars ...string) (c *Code, e error) {
+	return compile(nil, ex, vars)
+}
+
+// CompileExpr compiles a pre-built AST of the given variables,
+// as returned by ParseVars or built with NewBinExpr, NewCallExpr, etc. E.g.:
+// 	x, y := NewVariable("x"), NewVariable("y")
+// 	r2 := NewBinExpr("+", NewBinExpr("*", x, x), NewBinExpr("*", y, y))
+// 	CompileExpr(NewCallExpr("sqrt", r2), "x", "y")
+// The tree is validated like a parsed expression: it may only refer to the given variables
+// and to enclosing LetExprs, call builtin functions with the right number of arguments, etc.
+// Errors are returned as a *CompileError, whose Expr holds the tree's String form.
+// If no longer needed, the returned code must be explicitly freed with Free().
+func CompileExpr(root Expr, vars ...string) (c *Code, e error) {
+	ex := fmt.Sprint(root)
+	defer func() {
+		if err := recover(); err != nil {
+			c, e = nil, compileError(ex, err)
+		}
+	}()
+
+	if err := checkVarsDefs(ex, vars, nil); err != nil {
+		return nil, err
+	}
+	newChecker(vars).check(root)
+	return compileRoot(nil, ex, root, vars), nil
+}
+
+// compile compiles expression ex of the given variables,
+// which may call the user functions in defs.
+func compile(defs map[string]*funcDef, ex string, vars []string) (c *Code, e error) {
+	defer func() {
+		if err := recover(); err != nil {
+			c, e = nil, compileError(ex, err)
+		}
+	}()
+
+	if err := checkVarsDefs(ex, vars, defs); err != nil {
+		return nil, err
+	}
+	root, defs, err := parse(ex, vars, defs, true)
 	if err != nil {
 		return nil, err
 	}
+	return compileRoot(defs, ex, root, vars), nil
+}
 
-	if useConstFolding {
-		root = FoldConst(root)
+// checkVarsDefs checks the variable names passed to compile expression ex,
+// which may not clash with the user functions in defs.
+func checkVarsDefs(ex string, vars []string, defs map[string]*funcDef) error {
+	if err := checkVars(vars); err != nil {
+		return &CompileError{Expr: ex, Kind: KindInvalidVar, Msg: err.Error(), Err: err}
+	}
+	for _, v := range vars {
+		if defs[v] != nil {
+			return &CompileError{Expr: ex, Kind: KindInvalidVar, Msg: fmt.Sprintf("variable %v clashes with function %v()", v, v)}
+		}
 	}
+	return nil
+}
 
-	b := buf{hasCall: make(map[expr]bool), callDepth: make(map[expr]int)}
-	recordCalls(root, b.hasCall)
-	if useCallDepth {
-		recordDepth(root, b.callDepth)
+// compileRoot compiles the AST of expression ex.
+func compileRoot(defs map[string]*funcDef, ex string, root Expr, vars []string) *Code {
+	cc := newCompilation(defs, vars)
+	cc.assemble(root, vars, false)
+	instr := cc.link()
+	return &Code{instr: instr, nvars: len(vars), src: &source{ex: ex, root: root, vars: vars, defs: defs}}
+}
+
+// checker validates a pre-built AST, see CompileExpr.
+// It panics with a *CompileError for the first problem found.
+type checker struct {
+	vars   map[string]bool
+	locals map[string]bool // names bound by the enclosing LetExprs
+}
+
+func newChecker(vars []string) *checker {
+	c := &checker{vars: make(map[string]bool), locals: make(map[string]bool)}
+	for _, v := range vars {
+		c.vars[v] = true
 	}
+	return c
+}
+
+func (c *checker) check(e Expr) {
+	switch e := e.(type) {
+	default:
+		c.fail(KindSyntax, "invalid node: %T", e)
+	case Variable:
+		if !c.vars[e.name] {
+			c.fail(KindUnknownIdent, "undefined variable: %v", e.name)
+		}
+	case Constant:
+	case Ref:
+		if !c.locals[e.name] {
+			c.fail(KindUnknownIdent, "undefined binding: %v", e.name)
+		}
+	case BinExpr:
+		if _, ok := precedence[e.op]; !ok && e.op != "^" {
+			c.fail(KindUnsupportedOp, "unsupported operator: %q", e.op)
+		}
+	case *CallExpr:
+		if e == nil {
+			c.fail(KindSyntax, "invalid node: nil *CallExpr")
+		}
+		f, ok := lookupFunc(e.fun)
+		if !ok {
+			c.fail(KindUnknownIdent, "undefined: %q", e.fun)
+		}
+		if len(e.args) != f.arity {
+			c.fail(KindArity, "%v needs %v arguments, have %v", e.fun, f.arity, len(e.args))
+		}
+	case IfExpr:
+	case PowExpr:
+		if e.n < 1 {
+			c.fail(KindSyntax, "invalid exponent: %v", e.n)
+		}
+	case LetExpr:
+		_, isConst := lookupConst(e.name)
+		if !isIdent(e.name) {
+			c.fail(KindSyntax, "invalid binding name: %q", e.name)
+		}
+		if c.vars[e.name] || c.locals[e.name] || isConst || isFunc(e.name) {
+			c.fail(KindRedeclared, "%v redeclared", e.name)
+		}
+		c.check(e.value)
+		c.locals[e.name] = true
+		c.check(e.body)
+		delete(c.locals, e.name)
+		return
+	}
+	for _, ch := range e.children() {
+		c.check(ch)
+	}
+}
+
+func (c *checker) fail(kind ErrorKind, format string, args ...interface{}) {
+	panic(&CompileError{Kind: kind, Msg: fmt.Sprintf(format, args...)})
+}
+
+// compileExprs compiles several expressions of the given variables into one piece of executable memory,
+// and returns it together with the offset of the code for each expression.
+func compileExprs(roots []Expr, vars []string) (mem []byte, entries []int) {
+	cc := newCompilation(nil, vars)
+	for _, root := range roots {
+		entries = append(entries, cc.Len())
+		cc.assemble(root, vars, false)
+	}
+	return cc.link(), entries
+}
+
+// compileError turns a panic during compilation into a *CompileError for expression ex.
+func compileError(ex string, err interface{}) *CompileError {
+	cerr, ok := err.(*CompileError)
+	if !ok {
+		cerr = &CompileError{Kind: KindInternal, Msg: fmt.Sprint(err)}
+	}
+	cerr.Expr = ex
+	return cerr
+}
+
+// compilation holds the state for compiling expressions and the user functions they call,
+// which are laid out in one piece of executable memory.
+type compilation struct {
+	bytes.Buffer                     // machine code of all functions
+	defs         map[string]*funcDef // user functions that may be called
+	inliner      *inliner
+	offset       map[string]int // offset of compiled user functions
+	fixups       []fixup        // calls to user functions
+}
+
+// fixup is a relative call to user function fun,
+// whose 32-bit displacement at offset at in the code must be filled in by link.
+type fixup struct {
+	at  int
+	fun string
+}
+
+func newCompilation(defs map[string]*funcDef, vars []string) *compilation {
+	return &compilation{defs: defs, inliner: newInliner(defs, vars, false), offset: make(map[string]int)}
+}
+
+// optimizeAST applies the enabled optimizations to root, before code generation.
+func optimizeAST(root Expr) Expr {
+	if useConstFolding {
+		root = Optimize(root, optLevel)
+	}
+	root = expandPow(root)
+	if useCSE {
+		root = cse(root)
+	}
+	return root
+}
+
+// assemble appends the machine code for expression root of the given variables.
+// If isFunc, the code is for a user function, taking the variables as arguments:
+// 	double f(double a, double b, ...);
+// Otherwise, the variables are passed as an array:
+// 	double f(double *vars);
+func (cc *compilation) assemble(root Expr, vars []string, isFunc bool) {
+	root = optimizeAST(cc.inliner.expand(root))
+
+	b := newBuf(root, vars, cc.defs)
 
 	b.emit(push_rbp, mov_rsp_rbp) // function preamble
-	b.emit(sub_rsp(16))           // stack space for x, y
-	b.emit(mov_xmm_x_rbp(0, -8))  // x on stack
-	b.emit(mov_xmm_x_rbp(1, -16)) // y on stack
-	b.compileExpr(root)           // function body (jit code)
-	b.emit(add_rsp(16))           // free stack space for x,y
-	b.emit(pop_rbp, ret)          // return from function
+	if !isFunc {
+		b.frame = 16
+		b.emit(push_rbx, sub_rsp(8)) // save rbx, keep stack 16-byte aligned
+		b.emit(mov_rdi_rbx)          // pointer to variables in rbx, survives calls
+	} else {
+		// store the arguments on the stack, and point rbx to them,
+		// so that they can be used like variables.
+		n := len(vars) + len(vars)%2 // keep stack 16-byte aligned
+		b.frame = 16 + 8*int32(n)
+		b.emit(push_rbx, sub_rsp(uint32(8+8*n)))
+		b.emit(mov_rsp_rbx)
+		for i := range vars {
+			b.emit(mov_xmm_x_rbx(byte(i), int32(8*i)))
+		}
+	}
+	b.compileExpr(root)                         // function body (jit code)
+	b.emit(add_rsp(uint32(b.frame-8)), pop_rbx) // restore rbx
+	b.emit(pop_rbp, ret)                        // return from function
 
 	//fmt.Println(ex, ":", b.nRegistersHit, "reg hits,", b.maxReg, "highest register used, ", b.nStackSpill, "stack spills")
 
-	instr, err := MakeExecutable(b.Bytes())
+	for _, f := range b.fixups {
+		cc.fixups = append(cc.fixups, fixup{at: cc.Len() + f.at, fun: f.fun})
+	}
+	cc.Write(b.Bytes())
+}
+
+// assembleFunc appends the code for user function name,
+// taking its arguments in registers (see assemble).
+func (cc *compilation) assembleFunc(name string) {
+	d := cc.defs[name]
+	cc.offset[name] = cc.Len()
+	cc.assemble(d.body, d.params, true)
+}
+
+// link appends the code for all user functions that are called but not yet assembled,
+// fills in the relative calls to them, and returns the code in executable memory.
+func (cc *compilation) link() []byte {
+	for i := 0; i < len(cc.fixups); i++ { // assembling adds fixups
+		if _, ok := cc.offset[cc.fixups[i].fun]; !ok {
+			cc.assembleFunc(cc.fixups[i].fun)
+		}
+	}
+	code := cc.Bytes()
+	for _, f := range cc.fixups {
+		rel := cc.offset[f.fun] - (f.at + 4) // relative to the next instruction
+		copy(code[f.at:], int32Bytes(int32(rel)))
+	}
+	instr, err := MakeExecutable(code)
 	if err != nil {
-		return nil, err
+		panic(&CompileError{Kind: KindSystem, Msg: err.Error(), Err: err})
+	}
+	return instr
+}
+
+// checkVars returns an error if vars cannot be used as variable names:
+// when they are duplicated, not an identifier, or clash with a function or constant name.
+func checkVars(vars []string) error {
+	seen := make(map[string]bool)
+	for _, v := range vars {
+		if !isIdent(v) {
+			return fmt.Errorf("invalid variable name: %q", v)
+		}
+		if seen[v] {
+			return fmt.Errorf("duplicate variable: %v", v)
+		}
+		if isFunc(v) {
+			return fmt.Errorf("variable %v clashes with function %v()", v, v)
+		}
+		if _, ok := lookupConst(v); ok {
+			return fmt.Errorf("variable %v clashes with constant %v", v, v)
+		}
+		seen[v] = true
+	}
+	return nil
+}
+
+// isIdent returns whether s is a valid identifier:
+// a letter or underscore, followed by letters, digits or underscores.
+func isIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || r == '_' || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
 	}
-	return &Code{instr}, nil
+	return true
 }
 
 // buf accumulates machine code.
@@ -54,8 +332,36 @@ type buf struct {
 	bytes.Buffer
 	usedReg                            [8]bool
 	nRegistersHit, nStackSpill, maxReg int
-	hasCall                            map[expr]bool
-	callDepth                          map[expr]int
+	nPushed                            int // number of values currently pushed on the stack
+	hasCall                            map[Expr]bool
+	callDepth                          map[Expr]int
+	vars                               map[string]int      // variable name -> index in argument array
+	locals                             map[string]local    // bound names currently in scope
+	defs                               map[string]*funcDef // user functions that may be called
+	fixups                             []fixup             // calls to user functions
+	frame                              int32               // bytes used below rbp, before stashing
+	trace                              *trace              // if not nil, records the decisions made, see FormatDot
+}
+
+// local is where the value of a local binding is kept:
+// in register xmm<reg>, or, if reg == -1, on the stack at off(%rbp).
+type local struct {
+	reg int
+	off int32
+}
+
+// newBuf returns a buf for compiling root, with the given variables,
+// which may call the user functions in defs.
+func newBuf(root Expr, vars []string, defs map[string]*funcDef) *buf {
+	b := &buf{hasCall: make(map[Expr]bool), callDepth: make(map[Expr]int), vars: make(map[string]int), locals: make(map[string]local), defs: defs}
+	for i, v := range vars {
+		b.vars[v] = i
+	}
+	recordCalls(root, b.hasCall)
+	if useCallDepth {
+		recordDepth(root, b.callDepth)
+	}
+	return b
 }
 
 // emit writes machine code to the buffer.
@@ -78,27 +384,36 @@ func (b *buf) stash(destroyRegs bool) int {
 	}
 	if reg == -1 {
 		b.emit(mov_xmm0_rax, push_rax)
+		b.nPushed++
 	} else {
 		b.emit(mov_xmm(0, reg))
 	}
+	if b.trace != nil {
+		b.trace.stashed(reg, -(b.frame + 8*int32(b.nPushed)))
+	}
 	return reg
 }
 
 // unstash emits code for the opposite operation of stash,
-// moving the stashed aside value into xmm0 or xmm1 (specified by dest).
+// moving the stashed aside value into register xmm<dest>.
 // E.g., this is a no-op:
 // 	reg := buf.stash(false)
 // 	buf.unstash(reg, 0)
 func (b *buf) unstash(reg, dest int) {
-	switch {
-	case reg == -1 && dest == 1:
-		b.emit(pop_rax, mov_rax_xmm1)
-	case reg == -1 && dest == 0:
-		b.emit(pop_rax, mov_rax_xmm0)
-	case reg != -1:
+	if reg == -1 {
+		b.emit(pop_rax, mov_rax_xmm(dest))
+		b.nPushed--
+	} else {
 		b.emit(mov_xmm(reg, dest))
-	default:
-		panic("bug")
+	}
+	b.freeReg(reg)
+}
+
+// drop discards a value stashed aside, without moving it anywhere.
+func (b *buf) drop(reg int) {
+	if reg == -1 {
+		b.emit(add_rsp(8))
+		b.nPushed--
 	}
 	b.freeReg(reg)
 }
@@ -131,57 +446,112 @@ func (b *buf) freeReg(reg int) {
 		return
 	}
 	if !b.usedReg[reg] {
-		panic(fmt.Sprint("register double free", reg))
+		panic(fmt.Sprintf("register double free: %v", reg))
 	}
 	b.usedReg[reg] = false
 }
 
 
-func (b *buf) compileExpr(e expr) {
+func (b *buf) compileExpr(e Expr) {
+	if b.trace != nil {
+		b.trace.enter(b, e)
+		defer b.trace.leave(b, e)
+	}
 	switch e := e.(type) {
 	default:
 		panic(fmt.Sprintf("compileExpr %T", e))
-	case binexpr:
+	case BinExpr:
 		b.compileBinexpr(e)
-	case callexpr:
+	case *CallExpr:
 		b.compileCallexpr(e)
-	case constant:
+	case Constant:
 		b.compileConstant(e)
-	case variable:
+	case IfExpr:
+		b.compileIfexpr(e)
+	case PowExpr:
+		b.compilePowexpr(e)
+	case LetExpr:
+		b.compileLetexpr(e)
+	case Ref:
+		b.compileRef(e)
+	case Variable:
 		b.compileVariable(e)
 	}
 }
 
-func (b *buf) compileVariable(e variable) {
-	switch e.name {
-	default:
+// compileVariable loads a variable from the argument array, pointed to by rbx.
+func (b *buf) compileVariable(e Variable) {
+	i, ok := b.vars[e.name]
+	if !ok {
 		panic("undefined variable:" + e.name)
-	case "x":
-		b.emit(mov_x_rbp_xmm(-8, 0))
-	case "y":
-		b.emit(mov_x_rbp_xmm(-16, 0))
 	}
+	b.emit(mov_x_rbx_xmm(int32(8*i), 0))
 }
 
-func (b *buf) compileConstant(e constant) {
-	b.emit(mov_float_rax(e.value), mov_rax_xmm0)
+// compileLetexpr evaluates the bound value once, and keeps it
+// in a register or on the stack while the body is evaluated.
+func (b *buf) compileLetexpr(e LetExpr) {
+	b.compileExpr(e.value)
+	reg := b.stash(b.hasCall[e.body])
+	// stack offset (relative to rbp) where stash pushed the value:
+	// below the frame and the values pushed so far.
+	off := -(b.frame + 8*int32(b.nPushed))
+	b.locals[e.name] = local{reg: reg, off: off}
+
+	b.compileExpr(e.body)
+
+	delete(b.locals, e.name)
+	b.drop(reg)
 }
 
-func (b *buf) compileBinexpr(e binexpr) {
-	// Determine which side of the binary expression to evaluate first:
-	//  * prefer deeper branch first, so we use least registers
-	//  * however, avoid function calls in the second branch,
-	// 	  as those destroy the registers.
-	var first, second expr
-	if b.callDepth[e.x] > b.callDepth[e.y] && !b.hasCall[e.y] {
-		first, second = e.x, e.y
+// compileRef loads the value of a local binding.
+func (b *buf) compileRef(e Ref) {
+	l, ok := b.locals[e.name]
+	if !ok {
+		panic("undefined local: " + e.name)
+	}
+	if l.reg == -1 {
+		b.emit(mov_x_rbp_xmm(l.off, 0))
 	} else {
-		first, second = e.y, e.x
+		b.emit(mov_xmm(l.reg, 0))
 	}
+}
+
+func (b *buf) compileConstant(e Constant) {
+	b.emit(mov_float_rax(e.value), mov_rax_xmm0)
+}
+
+// order determines which side of a binary expression to evaluate first:
+//  * prefer deeper branch first, so we use least registers
+//  * however, avoid function calls in the second branch,
+// 	  as those destroy the registers.
+func (b *buf) order(e BinExpr) (first, second Expr) {
+	if b.leftFirst(e) {
+		return e.x, e.y
+	}
+	return e.y, e.x
+}
+
+// leftFirst returns whether order evaluates the left operand of e first.
+func (b *buf) leftFirst(e BinExpr) bool {
+	return b.callDepth[e.x] > b.callDepth[e.y] && !b.hasCall[e.y]
+}
+
+func (b *buf) compileBinexpr(e BinExpr) {
+	first, second := b.order(e)
+
+	// logical operators work on masks of their operands
+	logical := e.op == "&&" || e.op == "||"
 
 	b.compileExpr(first)
+	if logical {
+		b.toMask()
+	}
 	stash := b.stash(b.hasCall[second])
 	b.compileExpr(second)
+	if logical {
+		b.toMask()
+	}
 
 	// Move the results back:
 	// y -> xmm0
@@ -202,19 +572,149 @@ func (b *buf) compileBinexpr(e binexpr) {
 		b.emit(mul_xmm1_xmm0)
 	case "/":
 		b.emit(div_xmm1_xmm0)
+	case "==":
+		b.emit(cmpsd(cmp_eq, 1, 0))
+		b.maskToOne()
+	case "!=":
+		b.emit(cmpsd(cmp_neq, 1, 0))
+		b.maskToOne()
+	case "<":
+		b.emit(cmpsd(cmp_lt, 1, 0))
+		b.maskToOne()
+	case "<=":
+		b.emit(cmpsd(cmp_le, 1, 0))
+		b.maskToOne()
+	case ">": // x > y is evaluated as y < x, to get the NaN behavior right.
+		b.emit(cmpsd(cmp_lt, 0, 1), mov_xmm(1, 0))
+		b.maskToOne()
+	case ">=":
+		b.emit(cmpsd(cmp_le, 0, 1), mov_xmm(1, 0))
+		b.maskToOne()
+	case "&&":
+		b.emit(and_xmm1_xmm0)
+		b.maskToOne()
+	case "||":
+		b.emit(or_xmm1_xmm0)
+		b.maskToOne()
+	case "^":
+		pow, _ := lookupFunc("pow")
+		b.call(pow.ptr)
 	default:
-		panic(e.op)
+		panic(fmt.Sprintf("compileBinexpr %v", e.op))
 	}
 }
 
-func (b *buf) compileCallexpr(e callexpr) {
-	fptr := funcs[e.fun]
-	if fptr == 0 {
-		panic(fmt.Sprintf("undefined:", e.fun))
+// maskToOne emits code that turns a mask in xmm0, as produced by cmpsd,
+// into 1.0 (all ones) or 0.0 (all zeros).
+func (b *buf) maskToOne() {
+	b.emit(mov_float_rax(1), mov_rax_xmm1, and_xmm1_xmm0)
+}
+
+// toMask emits code that turns xmm0 into all ones if it is non-zero (or NaN),
+// all zeros otherwise.
+func (b *buf) toMask() {
+	b.emit(xor_xmm1_xmm1, cmpsd(cmp_neq, 1, 0))
+}
+
+// compileIfexpr emits branch-free code for select(cond, x, y).
+// All three operands are evaluated, cond is turned into a mask,
+// and the result is computed as y ^ (mask & (x ^ y)).
+func (b *buf) compileIfexpr(e IfExpr) {
+	b.compileExpr(e.cond)
+	b.toMask()
+	mask := b.stash(b.hasCall[e.x] || b.hasCall[e.y])
+	b.compileExpr(e.x)
+	x := b.stash(b.hasCall[e.y])
+	b.compileExpr(e.y)
+
+	b.unstash(x, 1)       // x -> xmm1, y in xmm0
+	b.emit(xor_xmm0_xmm1) // x^y -> xmm1
+	b.emit(mov_xmm0_rcx)  // y aside in rcx
+	b.unstash(mask, 0)    // mask -> xmm0
+	b.emit(and_xmm1_xmm0) // mask & (x^y) -> xmm0
+	b.emit(mov_rcx_xmm1)  // y -> xmm1
+	b.emit(xor_xmm1_xmm0) // y ^ (mask & (x^y)) -> xmm0
+}
+
+// compileCallexpr emits code for a function call.
+// Following the System V ABI, the arguments are passed in xmm0, xmm1, ...
+func (b *buf) compileCallexpr(e *CallExpr) {
+	f, ok := lookupFunc(e.fun)
+	_, isUser := b.defs[e.fun]
+	if isUser {
+		f, ok = builtin{arity: len(e.args)}, true
+	}
+	if !ok {
+		panic(fmt.Sprintf("undefined: %v", e.fun))
+	}
+	n := len(e.args)
+	if n != f.arity || n > maxArity {
+		panic(fmt.Sprintf("%v needs %v arguments, have %v", e.fun, f.arity, n))
+	}
+
+	// Evaluate the arguments in order, stashing all but the last.
+	// With more than 2 arguments, the stash registers would overlap
+	// the argument registers, so we use the stack instead.
+	stash := make([]int, n)
+	for i, a := range e.args {
+		b.compileExpr(a)
+		if i < n-1 {
+			destroyRegs := n > 2
+			for _, later := range e.args[i+1:] {
+				destroyRegs = destroyRegs || b.hasCall[later]
+			}
+			stash[i] = b.stash(destroyRegs)
+		}
 	}
 
-	b.compileExpr(e.arg)
-	b.emit(mov_uint_rax(fptr), call_rax)
+	// Move the arguments in place, last one first.
+	if n > 1 {
+		b.emit(mov_xmm(0, n-1))
+	}
+	for i := n - 2; i >= 0; i-- {
+		b.unstash(stash[i], i)
+	}
+	switch {
+	case inlined(e.fun):
+		b.compileInline(e.fun)
+	case isUser:
+		b.callUser(e.fun)
+	case f.gofn != nil:
+		b.emit(mov_uint_rdi(uint64(f.gofn.idx))) // go_call(idx, x, y)
+		b.call(f.ptr)
+	default:
+		b.call(f.ptr)
+	}
+}
+
+// call emits code for calling the C function f.
+func (b *buf) call(f unsafe.Pointer) {
+	b.aligned(func() {
+		b.emit(mov_uint_rax(uintptr(f)), call_rax)
+	})
+}
+
+// callUser emits code for calling the user function with given name.
+// The relative address is filled in later, when linking.
+func (b *buf) callUser(name string) {
+	b.aligned(func() {
+		b.emit(call_rel32(0))
+		b.fixups = append(b.fixups, fixup{at: b.Len() - 4, fun: name})
+	})
+}
+
+// aligned emits the code for a call, emitted by f.
+// The System V ABI requires the stack to be 16-byte aligned at the call,
+// which is not the case if an odd number of values has been stashed on the stack.
+func (b *buf) aligned(f func()) {
+	align := b.nPushed%2 == 1
+	if align {
+		b.emit(sub_rsp(8))
+	}
+	f()
+	if align {
+		b.emit(add_rsp(8))
+	}
 }
 
 
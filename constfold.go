@@ -5,29 +5,35 @@ import "fmt"
 // FoldConst returns a new expression where all constant subexpressions have been replaced by numbers.
 // E.g.:
 // 	1+1 -> 2
-func FoldConst(e expr) expr {
+func FoldConst(e Expr) Expr {
 	switch e := e.(type) {
 	default:
 		return e
-	case binexpr:
+	case BinExpr:
 		return foldBinexpr(e)
-	case callexpr:
+	case *CallExpr:
 		return foldCallexpr(e)
+	case IfExpr:
+		return foldIfexpr(e)
+	case PowExpr:
+		return foldPowexpr(e)
+	case LetExpr:
+		return foldLetexpr(e)
 	}
 }
 
-func isConst(e expr) bool {
-	_, ok := e.(*constant)
+func isConst(e Expr) bool {
+	_, ok := e.(Constant)
 	return ok
 }
 
-func foldBinexpr(e binexpr) expr {
+func foldBinexpr(e BinExpr) Expr {
 	x := FoldConst(e.x)
 	y := FoldConst(e.y)
 
 	if isConst(x) && isConst(y) {
-		x := x.(*constant).value
-		y := y.(*constant).value
+		x := x.(Constant).value
+		y := y.(Constant).value
 		var v float64
 		switch e.op {
 		default:
@@ -40,19 +46,83 @@ func foldBinexpr(e binexpr) expr {
 			v = x * y
 		case "/":
 			v = x / y
+		case "==":
+			v = boolToFloat(x == y)
+		case "!=":
+			v = boolToFloat(x != y)
+		case "<":
+			v = boolToFloat(x < y)
+		case "<=":
+			v = boolToFloat(x <= y)
+		case ">":
+			v = boolToFloat(x > y)
+		case ">=":
+			v = boolToFloat(x >= y)
+		case "^":
+			v = foldPow(x, y)
+		case "&&":
+			v = boolToFloat(x != 0 && y != 0)
+		case "||":
+			v = boolToFloat(x != 0 || y != 0)
 		}
-		return constant{v}
+		return Constant{v}
 	}
-	return binexpr{op: e.op, x: x, y: y}
+	return BinExpr{op: e.op, x: x, y: y}
 }
 
-func foldCallexpr(e callexpr) expr {
-	arg := FoldConst(e.arg)
-	if isConst(arg) {
-		a := arg.(*constant).value
-		f := funcs[e.fun]
-		v := callCFunc(f, a)
-		return constant{v}
+func foldCallexpr(e *CallExpr) Expr {
+	args := make([]Expr, len(e.args))
+	vals := make([]float64, len(e.args))
+	allConst := true
+	for i, a := range e.args {
+		args[i] = FoldConst(a)
+		if isConst(args[i]) {
+			vals[i] = args[i].(Constant).value
+		} else {
+			allConst = false
+		}
+	}
+	if f, _ := lookupFunc(e.fun); allConst && f.pure {
+		return Constant{f.call(vals...)}
+	}
+	return &CallExpr{fun: e.fun, args: args}
+}
+
+// foldIfexpr selects the x or y branch if the condition is constant.
+func foldIfexpr(e IfExpr) Expr {
+	cond := FoldConst(e.cond)
+	x := FoldConst(e.x)
+	y := FoldConst(e.y)
+	if isConst(cond) {
+		if cond.(Constant).value != 0 { // NaN is true, like in the generated code
+			return x
+		}
+		return y
+	}
+	return IfExpr{cond: cond, x: x, y: y}
+}
+
+func foldPowexpr(e PowExpr) Expr {
+	x := FoldConst(e.x)
+	if isConst(x) {
+		return Constant{powi(x.(Constant).value, e.n)}
+	}
+	return PowExpr{x: x, n: e.n}
+}
+
+// foldLetexpr substitutes constant bindings into the body.
+func foldLetexpr(e LetExpr) Expr {
+	value := FoldConst(e.value)
+	if isConst(value) {
+		return FoldConst(substitute(e.body, e.name, value))
+	}
+	return LetExpr{name: e.name, value: value, body: FoldConst(e.body)}
+}
+
+// boolToFloat returns 1 for true, 0 for false.
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
 	}
-	return callexpr{fun: e.fun, arg: arg}
+	return 0
 }
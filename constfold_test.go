@@ -0,0 +1,58 @@
+package jit
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestFoldConst(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"1+1", "2"},
+		{"x+1*2", "(x+2)"},
+		{"sqrt(4)*x", "(2*x)"},
+		{"1<2", "1"},
+		{"2<=1", "0"},
+		{"x*(1==1)", "(x*1)"},
+		{"select(1>2, x, y)", "y"},
+		{"ifelse(1<2, x, y)", "x"},
+		{"ifelse(x, 1+1, y)", "select(x,2,y)"},
+		{"atan2(0, -1)", "3.141592653589793"},
+		{"hypot(3, 4)+x", "(5+x)"},
+		{"atan2(x, 1+1)", "atan2(x,2)"},
+	}
+	for _, test := range tests {
+		root, err := Parse(test.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := fmt.Sprint(FoldConst(root)); have != test.want {
+			t.Errorf("FoldConst %q: have %v, want %v", test.expr, have, test.want)
+		}
+	}
+}
+
+// folded powers must be bit-for-bit the same as those computed by the generated code.
+func TestFoldConstPow(t *testing.T) {
+	for _, base := range []float64{1.1, 0.9, -3.7, 1e-5, 7.849721436906823e-09} {
+		for _, exp := range []string{"13", "37", "38", "64", "100", "-5", "2.5", "(1/3)"} {
+			folded, err := Compile(fmt.Sprintf("(%v)^%v", base, exp))
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, err := CompileVars("a^"+exp, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have, want := folded.Eval(0, 0), code.EvalN([]float64{base}); math.Float64bits(have) != math.Float64bits(want) {
+				t.Errorf("%v^%v: folded %v, evaluated %v", base, exp, have, want)
+			}
+			folded.Free()
+			code.Free()
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package jit
+
+// this file provides named constants, like pi.
+
+import (
+	"fmt"
+	"math"
+)
+
+// consts is guarded by namesMu.
+var consts = map[string]float64{
+	"pi":     math.Pi,
+	"e":      math.E,
+	"tau":    2 * math.Pi,
+	"phi":    math.Phi,
+	"inf":    math.Inf(1),
+	"nan":    math.NaN(),
+	"ln2":    math.Ln2,
+	"ln10":   math.Ln10,
+	"log2e":  math.Log2E,
+	"log10e": math.Log10E,
+	"sqrt2":  math.Sqrt2,
+}
+
+// DefineConst defines a named constant, which can subsequently be used in expressions. E.g.:
+// 	DefineConst("g", 9.81)
+// 	code, err := CompileVars("g*t*t/2", "t")
+// It is an error to redefine a constant, to use the name of a function,
+// or to use x or y, the variables of Compile.
+// Variables passed to CompileVars may not have the name of a constant either.
+func DefineConst(name string, value float64) error {
+	if !isIdent(name) {
+		return fmt.Errorf("define %q: invalid name", name)
+	}
+	if isFixedVar(name) {
+		return fmt.Errorf("define %v: clashes with variable %v", name, name)
+	}
+	namesMu.Lock()
+	defer namesMu.Unlock()
+	if isFuncLocked(name) {
+		return fmt.Errorf("define %v: clashes with function %v()", name, name)
+	}
+	if _, ok := consts[name]; ok {
+		return fmt.Errorf("define %v: already defined", name)
+	}
+	consts[name] = value
+	return nil
+}
+
+// isFixedVar returns whether name is one of the variables of Compile,
+// which cannot be used as the name of a constant or function.
+func isFixedVar(name string) bool {
+	return name == "x" || name == "y"
+}
+
+// lookupConst returns the value of the named constant, if defined.
+func lookupConst(name string) (float64, bool) {
+	namesMu.RLock()
+	defer namesMu.RUnlock()
+	v, ok := consts[name]
+	return v, ok
+}
@@ -0,0 +1,46 @@
+package jit
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDefineConst(t *testing.T) {
+	g := uniqueName("g_test")
+	if err := DefineConst(g, 9.81); err != nil {
+		t.Fatal(err)
+	}
+	code, err := CompileVars(g+"*t*t/2", "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	if have, want := code.EvalN([]float64{2}), 9.81*2; have != want {
+		t.Errorf("%v*t*t/2: have %v, want %v", g, have, want)
+	}
+
+	if _, err := CompileVars(g, g); err == nil {
+		t.Errorf("variable clashing with constant: expected error")
+	}
+	if _, err := CompileVars("pi*x", "pi", "x"); err == nil {
+		t.Errorf("variable clashing with constant: expected error")
+	}
+}
+
+func TestDefineConstErrors(t *testing.T) {
+	for _, name := range []string{"pi", "x", "y", "sin", "atan2", "select", "ifelse", "", "1x", "a.b"} {
+		if err := DefineConst(name, 1); err == nil {
+			t.Errorf("DefineConst %q: expected error", name)
+		}
+	}
+}
+
+// uniqueNames counts the names returned by uniqueName.
+var uniqueNames int64
+
+// uniqueName returns a new name for a test constant or function, like prefix_1.
+// The names are global, so tests cannot reuse them when run more than once (go test -count=2).
+func uniqueName(prefix string) string {
+	return fmt.Sprintf("%v_%v", prefix, atomic.AddInt64(&uniqueNames, 1))
+}
@@ -0,0 +1,257 @@
+package jit
+
+// This file implements common subexpression elimination.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// cse returns root with common subexpressions bound to local names,
+// so that code generation evaluates them once. E.g.:
+// 	(x*x+y*y) * sin(x*x+y*y)  ->  $0 := (x*x+y*y); ($0*sin($0))
+//
+// First, the tree is turned into a DAG by hash-consing: structurally identical subexpressions
+// become the same DAG node. Subexpressions that call impure functions are never merged.
+// Then, each node that is used more than once is bound just above all its uses,
+// at their lowest common ancestor in the tree. Code generation keeps it in a register
+// or stack slot (see compileLetexpr) until that ancestor has been evaluated.
+func cse(root Expr) Expr {
+	c := &cser{ids: make(map[nodeKey]int), scope: make(map[string]int)}
+	tree := c.intern(root, nil)
+
+	c.uses = make([]int, len(c.nodes))
+	c.occurrences = make([][]*occurrence, len(c.nodes))
+	c.count(tree, nil)
+	c.lca = make([]*occurrence, len(c.nodes))
+	c.place()
+	if len(c.shared) == 0 {
+		return root
+	}
+
+	// bind the shared nodes in order of increasing size at each place, as larger ones may use smaller ones.
+	c.names = make(map[int]string)
+	c.binds = make(map[*occurrence][]int)
+	for i := len(c.shared) - 1; i >= 0; i-- {
+		id := c.shared[i]
+		c.names[id] = fmt.Sprint("$", len(c.names))
+		c.binds[c.lca[id]] = append(c.binds[c.lca[id]], id)
+	}
+	return c.rewrite(tree)
+}
+
+// nodeKey identifies a DAG node by its structure:
+// its type and contents, and the DAG nodes of its children.
+type nodeKey struct {
+	kind string // node type, with operator, function or variable name
+	bits uint64 // constant value, exponent, or binding
+	kids string // DAG node ids of the children
+}
+
+// dagNode is a node of the expression DAG.
+type dagNode struct {
+	pure      bool // calls only pure functions
+	shareable bool // may be evaluated once for all uses: pure, and not a leaf
+	size      int  // number of tree nodes
+}
+
+// occurrence is a node of the expression tree, annotated with its DAG node.
+type occurrence struct {
+	e      Expr
+	id     int // DAG node
+	kids   []*occurrence
+	parent *occurrence
+	depth  int
+	outer  *occurrence // innermost enclosing first use of a shareable node
+}
+
+// cser holds the state for common subexpression elimination.
+type cser struct {
+	nodes    []dagNode
+	ids      map[nodeKey]int
+	scope    map[string]int // local binding names in scope -> binding number
+	nbinding int            // counter for numbering local bindings
+
+	uses        []int                 // number of uses of each DAG node
+	occurrences [][]*occurrence       // uses of each shareable DAG node
+	shared      []int                 // shared nodes, largest first
+	lca         []*occurrence         // lowest common ancestor of the uses of each shared node
+	names       map[int]string        // names of the bindings for shared nodes
+	binds       map[*occurrence][]int // shared nodes bound at each tree node, smallest first
+}
+
+// intern returns the occurrence tree for e, adding its subexpressions to the DAG.
+func (c *cser) intern(e Expr, parent *occurrence) *occurrence {
+	o := &occurrence{e: e, parent: parent}
+	if parent != nil {
+		o.depth = parent.depth + 1
+	}
+
+	var key nodeKey
+	switch e := e.(type) {
+	default:
+		panic(fmt.Sprintf("cse %T", e))
+	case Variable:
+		key = nodeKey{kind: "var " + e.name}
+	case Constant:
+		key = nodeKey{kind: "const", bits: math.Float64bits(e.value)}
+	case Ref:
+		key = nodeKey{kind: "ref", bits: uint64(c.scope[e.name])} // refs are identical if bound by the same LetExpr
+	case BinExpr:
+		key = nodeKey{kind: "binexpr " + e.op}
+	case *CallExpr:
+		key = nodeKey{kind: "call " + e.fun}
+	case PowExpr:
+		key = nodeKey{kind: "pow", bits: uint64(e.n)}
+	case IfExpr:
+		key = nodeKey{kind: "if"}
+	case LetExpr:
+		c.nbinding++
+		key = nodeKey{kind: "let", bits: uint64(c.nbinding)}
+	}
+
+	size := 1
+	pure := true
+	var kids []int
+	for i, ch := range e.children() {
+		if l, ok := e.(LetExpr); ok && i == 1 { // body, in the scope of the binding
+			outer, shadows := c.scope[l.name]
+			c.scope[l.name] = int(key.bits)
+			defer func() {
+				if shadows {
+					c.scope[l.name] = outer
+				} else {
+					delete(c.scope, l.name)
+				}
+			}()
+		}
+		k := c.intern(ch, o)
+		o.kids = append(o.kids, k)
+		kids = append(kids, k.id)
+		size += c.nodes[k.id].size
+		pure = pure && c.nodes[k.id].pure
+	}
+	if call, ok := e.(*CallExpr); ok {
+		f, ok := lookupFunc(call.fun)
+		pure = pure && ok && f.pure
+	}
+	key.kids = fmt.Sprint(kids)
+
+	id, ok := c.ids[key]
+	if !ok {
+		id = len(c.nodes)
+		c.ids[key] = id
+		c.nodes = append(c.nodes, dagNode{pure: pure, shareable: pure && !isLeaf(e), size: size})
+	}
+	o.id = id
+	return o
+}
+
+// isLeaf returns whether e is a variable, constant or reference,
+// which are not worth sharing.
+func isLeaf(e Expr) bool {
+	switch e.(type) {
+	case Variable, Constant, Ref:
+		return true
+	}
+	return false
+}
+
+// count counts the uses of each DAG node in the tree, in evaluation order,
+// and records the uses of shared nodes.
+// The subexpressions of a shared node are only counted for its first use,
+// the others will refer to its value.
+// outer is the innermost enclosing first use of a shareable node, if any.
+func (c *cser) count(o *occurrence, outer *occurrence) {
+	c.uses[o.id]++
+	o.outer = outer
+	if !c.nodes[o.id].shareable {
+		for _, k := range o.kids {
+			c.count(k, outer)
+		}
+		return
+	}
+	c.occurrences[o.id] = append(c.occurrences[o.id], o)
+	if c.uses[o.id] > 1 {
+		return
+	}
+	for _, k := range o.kids {
+		c.count(k, o)
+	}
+}
+
+// isShared returns whether DAG node id is used more than once, and may be evaluated once.
+func (c *cser) isShared(id int) bool {
+	return c.nodes[id].shareable && c.uses[id] > 1
+}
+
+// place determines where to bind each shared node: at the lowest common ancestor of its uses.
+// A use inside the value of another shared node counts as a use where that value is bound.
+// So the largest nodes, which may contain smaller ones, are placed first.
+func (c *cser) place() {
+	for id := range c.nodes {
+		if c.isShared(id) {
+			c.shared = append(c.shared, id)
+		}
+	}
+	sort.Slice(c.shared, func(i, j int) bool { return c.nodes[c.shared[i]].size > c.nodes[c.shared[j]].size })
+
+	for _, id := range c.shared {
+		var lca *occurrence
+		for _, o := range c.occurrences[id] {
+			pos := o
+			for p := o.outer; p != nil; p = p.outer {
+				if c.isShared(p.id) {
+					pos = c.lca[p.id]
+					break
+				}
+			}
+			lca = lowestCommonAncestor(lca, pos)
+		}
+		c.lca[id] = lca
+	}
+}
+
+// lowestCommonAncestor returns the lowest common ancestor of a and b in the tree,
+// or b if a is nil.
+func lowestCommonAncestor(a, b *occurrence) *occurrence {
+	if a == nil {
+		return b
+	}
+	for a.depth > b.depth {
+		a = a.parent
+	}
+	for b.depth > a.depth {
+		b = b.parent
+	}
+	for a != b {
+		a, b = a.parent, b.parent
+	}
+	return a
+}
+
+// rewrite returns the expression for the tree o, with references to the shared nodes
+// and their bindings.
+func (c *cser) rewrite(o *occurrence) Expr {
+	if name, ok := c.names[o.id]; ok {
+		return Ref{name: name}
+	}
+	e := c.rewriteKids(o)
+	binds := c.binds[o]
+	for i := len(binds) - 1; i >= 0; i-- { // smallest outermost
+		id := binds[i]
+		e = LetExpr{name: c.names[id], value: c.rewriteKids(c.occurrences[id][0]), body: e}
+	}
+	return e
+}
+
+// rewriteKids returns the expression for o, with its children rewritten.
+func (c *cser) rewriteKids(o *occurrence) Expr {
+	i := 0
+	return rebuild(o.e, func(Expr) Expr {
+		k := c.rewrite(o.kids[i])
+		i++
+		return k
+	})
+}
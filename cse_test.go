@@ -0,0 +1,85 @@
+package jit
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCSE(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"x*y", "(x*y)"},
+		{"x+x", "(x+x)"},
+		{"(x*x+y*y)*sin(x*x+y*y)", "$0 := ((x*x)+(y*y)); ($0*sin($0))"},
+		{"sin(x)+sin(x)*cos(y)+cos(y)", "$0 := cos(y); ($1 := sin(x); ($1+($1*$0))+$0)"},
+		{"sin(x*x)+cos(x*x)", "$0 := (x*x); (sin($0)+cos($0))"},
+		{"sin(x*y+1) + x*y", "$0 := (x*y); (sin(($0+1))+$0)"},
+		{"a := y*y; x + (a*a + a*a)", "a := (y*y); (x+$0 := (a*a); ($0+$0))"},
+		{"impure_cse_test(x) + impure_cse_test(x)", "(impure_cse_test(x)+impure_cse_test(x))"},
+		{"sin(impure_cse_test(x)) + sin(impure_cse_test(x))", "(sin(impure_cse_test(x))+sin(impure_cse_test(x)))"},
+		{"impure_cse_test(x*x) + impure_cse_test(x*x)", "$0 := (x*x); (impure_cse_test($0)+impure_cse_test($0))"},
+	}
+	cos, _ := lookupFunc("cos")
+	impure := uniqueName("impure_cse_test")
+	if err := RegisterFunc(impure, cos.ptr, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	names := strings.NewReplacer("impure_cse_test", impure)
+	for _, test := range tests {
+		expr, want := names.Replace(test.expr), names.Replace(test.want)
+		root, err := Parse(expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := fmt.Sprint(cse(root)); have != want {
+			t.Errorf("cse %q: have %v, want %v", expr, have, want)
+		}
+	}
+}
+
+// identical subexpressions referring to different bindings must not be merged.
+func TestCSEScope(t *testing.T) {
+	aa := BinExpr{op: "*", x: Ref{"a"}, y: Ref{"a"}}
+	root := BinExpr{op: "+", x: LetExpr{"a", Variable{"x"}, aa}, y: LetExpr{"a", Variable{"y"}, aa}}
+	want := "(a := x; (a*a)+a := y; (a*a))"
+	if have := fmt.Sprint(cse(root)); have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+// shared nodes nested in other shared nodes are bound before them,
+// outside the scope of their uses.
+func TestCSENested(t *testing.T) {
+	tests := []string{
+		"(x*x + y) * (x*x + y) + x*x",
+		"ifelse(x > y, sin(x*y) + x*y, cos(x*y)) * sin(x*y)",
+		"a := x*y; sin(a+1) * sin(a+1) + x*y",
+		"fma(x*y, x*y + 1, sqrt(x*y + 1))",
+	}
+	defer func() { useCSE = true }()
+	for _, ex := range tests {
+		useCSE = false
+		want, err := Compile(ex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		useCSE = true
+		have, err := Compile(ex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, x := range []float64{-1.5, 0, 0.5, 2} {
+			for _, y := range []float64{-1, 0, 0.25, 3} {
+				if h, w := have.Eval(x, y), want.Eval(x, y); !equal(h, w) {
+					t.Errorf("%q at (%v, %v): have %v, want %v", ex, x, y, h, w)
+				}
+			}
+		}
+		have.Free()
+		want.Free()
+	}
+}
@@ -0,0 +1,394 @@
+package jit
+
+// this file implements symbolic differentiation.
+
+import (
+	"fmt"
+	"math"
+
+	"golang.org/x/sys/unix"
+)
+
+// Derivative returns the derivative of e with respect to the named variable. E.g.:
+// 	sin(x*y) -> (cos((x*y))*y)
+// The result is simplified, dropping terms that are symbolically zero.
+// It returns a *CompileError of kind KindNoDerivative if e calls a function
+// without a known derivative, like one registered with RegisterFunc.
+func Derivative(e Expr, variable string) (Expr, error) {
+	d := &deriver{v: variable, refs: make(map[string]string), used: make(map[string]bool)}
+	d.reserve(e)
+	de, err := d.deriv(e)
+	if err != nil {
+		return nil, compileError(fmt.Sprint(e), err)
+	}
+	return simplify(FoldConst(de)), nil
+}
+
+// deriver holds the state for differentiating an expression.
+type deriver struct {
+	v    string            // variable to differentiate to
+	refs map[string]string // name of a local binding -> name of the binding of its derivative
+	used map[string]bool   // names that may not be used for new bindings
+}
+
+// reserve marks the names of all variables and bindings in e as used.
+func (d *deriver) reserve(e Expr) {
+	switch e := e.(type) {
+	case Variable:
+		d.used[e.name] = true
+	case LetExpr:
+		d.used[e.name] = true
+	}
+	for _, c := range e.children() {
+		d.reserve(c)
+	}
+}
+
+// newName returns a new name for the derivative of local binding name.
+func (d *deriver) newName(name string) string {
+	for i := 0; ; i++ {
+		n := "d" + name
+		if i > 0 {
+			n = fmt.Sprint(n, "_", i)
+		}
+		if _, isConst := lookupConst(n); !d.used[n] && !isConst && !isFunc(n) {
+			d.used[n] = true
+			return n
+		}
+	}
+}
+
+// deriv returns the derivative of e, simplified.
+func (d *deriver) deriv(e Expr) (Expr, error) {
+	de, err := d.derivRule(e)
+	if err != nil {
+		return nil, err
+	}
+	return simplify(de), nil
+}
+
+// derivs returns the derivatives of each of es, in order.
+func (d *deriver) derivs(es ...Expr) ([]Expr, error) {
+	des := make([]Expr, len(es))
+	for i, e := range es {
+		de, err := d.deriv(e)
+		if err != nil {
+			return nil, err
+		}
+		des[i] = de
+	}
+	return des, nil
+}
+
+func (d *deriver) derivRule(e Expr) (Expr, error) {
+	switch e := e.(type) {
+	default:
+		panic(fmt.Sprintf("derivative %T", e))
+	case Variable:
+		if e.name == d.v {
+			return num(1), nil
+		}
+		return num(0), nil
+	case Constant:
+		return num(0), nil
+	case Ref:
+		return Ref{name: d.refs[e.name]}, nil
+	case BinExpr:
+		da, err := d.derivs(e.x, e.y)
+		if err != nil {
+			return nil, err
+		}
+		return binexprDerivative(e.op, e.x, e.y, da[0], da[1]), nil
+	case *CallExpr:
+		da, err := d.derivs(e.args...)
+		if err != nil {
+			return nil, err
+		}
+		return callDerivative(e.fun, e.args, da)
+	case PowExpr: // x^n -> n*x^(n-1)*dx
+		dx, err := d.deriv(e.x)
+		if err != nil {
+			return nil, err
+		}
+		return mul(mul(num(float64(e.n)), powConst(e.x, float64(e.n-1))), dx), nil
+	case IfExpr:
+		da, err := d.derivs(e.x, e.y)
+		if err != nil {
+			return nil, err
+		}
+		return IfExpr{cond: e.cond, x: da[0], y: da[1]}, nil
+	case LetExpr:
+		// bind the derivative of the value as well, for use in the derivative of the body.
+		dname := d.newName(e.name)
+		d.refs[e.name] = dname
+		da, err := d.derivs(e.value, e.body)
+		if err != nil {
+			return nil, err
+		}
+		return LetExpr{name: e.name, value: e.value, body: LetExpr{name: dname, value: da[0], body: da[1]}}, nil
+	}
+}
+
+// binexprDerivative returns the derivative of x op y,
+// given the derivatives dx and dy of its operands.
+func binexprDerivative(op string, x, y, dx, dy Expr) Expr {
+	switch op {
+	default: // comparisons and logical operators are piecewise constant
+		return num(0)
+	case "+":
+		return add(dx, dy)
+	case "-":
+		return sub(dx, dy)
+	case "*":
+		return add(mul(dx, y), mul(x, dy))
+	case "/":
+		return sub(div(dx, y), div(mul(x, dy), mul(y, y)))
+	case "^":
+		switch {
+		case isZero(dy): // x^c -> c*x^(c-1)*dx
+			return mul(mul(y, pow(x, sub(y, num(1)))), dx)
+		case isZero(dx): // c^y -> c^y*log(c)*dy
+			return mul(mul(pow(x, y), call("log", x)), dy)
+		default: // x^y -> x^y*(dy*log(x) + y*dx/x)
+			return mul(pow(x, y), add(mul(dy, call("log", x)), div(mul(y, dx), x)))
+		}
+	}
+}
+
+// derivatives of the builtin functions of one argument, as a function of the argument.
+var derivatives = map[string]func(x Expr) Expr{
+	"sin":   func(x Expr) Expr { return call("cos", x) },
+	"cos":   func(x Expr) Expr { return neg(call("sin", x)) },
+	"tan":   func(x Expr) Expr { return add(num(1), pow(call("tan", x), num(2))) },
+	"asin":  func(x Expr) Expr { return div(num(1), call("sqrt", sub(num(1), pow(x, num(2))))) },
+	"acos":  func(x Expr) Expr { return div(num(-1), call("sqrt", sub(num(1), pow(x, num(2))))) },
+	"atan":  func(x Expr) Expr { return div(num(1), add(num(1), pow(x, num(2)))) },
+	"sinh":  func(x Expr) Expr { return call("cosh", x) },
+	"cosh":  func(x Expr) Expr { return call("sinh", x) },
+	"tanh":  func(x Expr) Expr { return sub(num(1), pow(call("tanh", x), num(2))) },
+	"exp":   func(x Expr) Expr { return call("exp", x) },
+	"log":   func(x Expr) Expr { return div(num(1), x) },
+	"log10": func(x Expr) Expr { return div(num(1), mul(x, num(math.Ln10))) },
+	"sqrt":  func(x Expr) Expr { return div(num(0.5), call("sqrt", x)) },
+	"fabs":  func(x Expr) Expr { return call("copysign", num(1), x) },
+	"floor": func(x Expr) Expr { return num(0) },
+	"ceil":  func(x Expr) Expr { return num(0) },
+	"round": func(x Expr) Expr { return num(0) },
+	"trunc": func(x Expr) Expr { return num(0) },
+}
+
+// callDerivative returns the derivative of fun(a...),
+// given the derivatives da of its arguments.
+// It returns a *CompileError of kind KindNoDerivative if the derivative of fun is not known.
+func callDerivative(fun string, a, da []Expr) (Expr, error) {
+	if g, ok := derivatives[fun]; ok {
+		return mul(g(a[0]), da[0]), nil
+	}
+	switch fun {
+	default:
+		return nil, &CompileError{Kind: KindNoDerivative, Msg: fmt.Sprintf("derivative of %v() is not known", fun)}
+	case "atan2": // atan2(y, x) -> (x*dy - y*dx) / (x^2 + y^2)
+		return div(sub(mul(a[1], da[0]), mul(a[0], da[1])), add(pow(a[1], num(2)), pow(a[0], num(2)))), nil
+	case "hypot":
+		return div(add(mul(a[0], da[0]), mul(a[1], da[1])), call("hypot", a...)), nil
+	case "fmod": // fmod(a, b) = a - trunc(a/b)*b
+		return sub(da[0], mul(call("trunc", div(a[0], a[1])), da[1])), nil
+	case "pow":
+		return binexprDerivative("^", a[0], a[1], da[0], da[1]), nil
+	case "min":
+		return IfExpr{cond: BinExpr{op: "<=", x: a[0], y: a[1]}, x: da[0], y: da[1]}, nil
+	case "max":
+		return IfExpr{cond: BinExpr{op: ">=", x: a[0], y: a[1]}, x: da[0], y: da[1]}, nil
+	case "copysign": // |a|*sign(b)
+		return mul(mul(call("copysign", num(1), a[0]), call("copysign", num(1), a[1])), da[0]), nil
+	case "fma":
+		return add(add(mul(da[0], a[1]), mul(a[0], da[1])), da[2]), nil
+	}
+}
+
+// checkDerivatives returns a *CompileError of kind KindNoDerivative
+// if e calls a function without a known derivative.
+// The code generators for derivatives check their input with it, and then use mustCallDerivative.
+func checkDerivatives(e Expr) error {
+	if c, ok := e.(*CallExpr); ok {
+		a := make([]Expr, len(c.args))
+		for i := range a {
+			a[i] = Ref{name: "a"}
+		}
+		if _, err := callDerivative(c.fun, a, a); err != nil {
+			return err
+		}
+	}
+	for _, c := range e.children() {
+		if err := checkDerivatives(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mustCallDerivative is like callDerivative, for expressions checked by checkDerivatives.
+func mustCallDerivative(fun string, a, da []Expr) Expr {
+	dv, err := callDerivative(fun, a, da)
+	if err != nil {
+		panic(fmt.Sprintf("unchecked derivative: %v", err))
+	}
+	return dv
+}
+
+// helpers for building expressions.
+
+func num(v float64) Expr               { return Constant{value: v} }
+func add(x, y Expr) Expr               { return BinExpr{op: "+", x: x, y: y} }
+func sub(x, y Expr) Expr               { return BinExpr{op: "-", x: x, y: y} }
+func mul(x, y Expr) Expr               { return BinExpr{op: "*", x: x, y: y} }
+func div(x, y Expr) Expr               { return BinExpr{op: "/", x: x, y: y} }
+func pow(x, y Expr) Expr               { return BinExpr{op: "^", x: x, y: y} }
+func neg(x Expr) Expr                  { return BinExpr{op: "-", x: num(0), y: x} }
+func call(f string, args ...Expr) Expr { return &CallExpr{fun: f, args: args} }
+
+// isZero returns whether e is the constant 0.
+func isZero(e Expr) bool {
+	c, ok := e.(Constant)
+	return ok && c.value == 0
+}
+
+// isOne returns whether e is the constant 1.
+func isOne(e Expr) bool {
+	c, ok := e.(Constant)
+	return ok && c.value == 1
+}
+
+// simplify removes terms that are symbolically zero, and factors one, from e. E.g.:
+// 	0*x + 1*y -> y
+// Unlike FoldConst, this does not preserve IEEE semantics: 0*x is 0 even if x is infinite or NaN,
+// which is intended for derivatives, where such terms are exactly zero.
+func simplify(e Expr) Expr {
+	e = rebuild(e, simplify)
+	switch e := e.(type) {
+	case BinExpr:
+		if isConst(e.x) && isConst(e.y) {
+			return FoldConst(e)
+		}
+		x, y := e.x, e.y
+		switch e.op {
+		case "+":
+			switch {
+			case isZero(x):
+				return y
+			case isZero(y):
+				return x
+			case isNeg(y): // x + (0-y) -> x-y
+				return sub(x, y.(BinExpr).y)
+			}
+		case "-":
+			switch {
+			case isZero(y):
+				return x
+			case isZero(x) && isNeg(y): // 0-(0-y) -> y
+				return y.(BinExpr).y
+			case isNeg(y): // x - (0-y) -> x+y
+				return add(x, y.(BinExpr).y)
+			}
+		case "*":
+			switch {
+			case isZero(x) || isZero(y):
+				return num(0)
+			case isOne(x):
+				return y
+			case isOne(y):
+				return x
+			case isNeg(x): // (0-x)*y -> 0-(x*y)
+				return simplify(neg(mul(x.(BinExpr).y, y)))
+			case isNeg(y):
+				return simplify(neg(mul(x, y.(BinExpr).y)))
+			}
+		case "/":
+			switch {
+			case isZero(x):
+				return num(0)
+			case isOne(y):
+				return x
+			}
+		}
+	case IfExpr:
+		if isConst(e.x) && isConst(e.y) && e.x.(Constant).value == e.y.(Constant).value {
+			return e.x
+		}
+	case LetExpr:
+		if !refers(e.body, e.name) {
+			return e.body
+		}
+	}
+	return e
+}
+
+// isNeg returns whether e is a negation, like 0-x.
+func isNeg(e Expr) bool {
+	b, ok := e.(BinExpr)
+	return ok && b.op == "-" && isZero(b.x)
+}
+
+// refers returns whether e refers to the local binding with given name.
+func refers(e Expr, name string) bool {
+	if r, ok := e.(Ref); ok && r.name == name {
+		return true
+	}
+	for _, c := range e.children() {
+		if refers(c, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Gradient holds the compiled code for a function f of x and y,
+// and its partial derivatives ∂f/∂x and ∂f/∂y.
+type Gradient struct {
+	F, Dx, Dy *Code
+	mem       []byte
+}
+
+// CompileGradient compiles an expression of x and y, together with its partial derivatives.
+// E.g., for an implicit curve f(x, y) = 0, the gradient is normal to the curve.
+// If no longer needed, the returned code must be explicitly freed with Free().
+func CompileGradient(ex string) (g *Gradient, e error) {
+	defer func() {
+		if err := recover(); err != nil {
+			g, e = nil, compileError(ex, err)
+		}
+	}()
+	f, err := Parse(ex)
+	if err != nil {
+		return nil, err
+	}
+	vars := []string{"x", "y"}
+	roots := []Expr{f}
+	for _, v := range vars {
+		d, err := Derivative(f, v)
+		if err != nil {
+			return nil, compileError(ex, err)
+		}
+		roots = append(roots, d)
+	}
+	mem, entries := compileExprs(roots, vars)
+	code := func(i int) *Code {
+		return &Code{instr: mem[entries[i]:], nvars: 2, shared: true, src: &source{ex: ex, root: roots[i], vars: vars}}
+	}
+	return &Gradient{F: code(0), Dx: code(1), Dy: code(2), mem: mem}, nil
+}
+
+// Eval returns f(x, y), ∂f/∂x (x, y) and ∂f/∂y (x, y).
+func (g *Gradient) Eval(x, y float64) (f, dfdx, dfdy float64) {
+	return g.F.Eval(x, y), g.Dx.Eval(x, y), g.Dy.Eval(x, y)
+}
+
+// Free unmaps the code, after which Eval cannot be called anymore.
+func (g *Gradient) Free() {
+	unix.Munmap(g.mem)
+	for _, c := range []*Code{g.F, g.Dx, g.Dy} {
+		c.freeDual()
+	}
+	g.F.instr, g.Dx.instr, g.Dy.instr = nil, nil, nil
+	g.mem = nil
+}
@@ -0,0 +1,108 @@
+package jit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestDerivative(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"x", "1"},
+		{"y", "0"},
+		{"3", "0"},
+		{"x+y", "1"},
+		{"x*y", "y"},
+		{"2*x+1", "2"},
+		{"x*x", "(x+x)"},
+		{"x^3", "(3*(x^2))"},
+		{"sin(x)", "cos(x)"},
+		{"cos(x)", "(0-sin(x))"},
+		{"exp(2*x)", "(exp((2*x))*2)"},
+		{"sin(y)", "0"},
+		{"x<y", "0"},
+		{"x>0? x: -x", "select((x>0),1,-1)"},
+		{"a := x*x; a+y", "da := (x+x); da"},
+		{"a := y*y; a*x", "a := (y*y); a"},
+	}
+	for _, test := range tests {
+		root, err := Parse(test.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		d, err := Derivative(root, "x")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := fmt.Sprint(d); have != test.want {
+			t.Errorf("Derivative %q: have %v, want %v", test.expr, have, test.want)
+		}
+	}
+}
+
+// expressions using all builtins, to test derivatives.
+var gradientTests = []string{
+	"x*y", "x/y", "x-y", "x^y", "x^2.5", "2^y", "pow(x, y)", "x^3*y^-2",
+	"sin(x*y)", "cos(x+y)", "tan(x/y)",
+	"asin(x/4)", "acos(y/4)", "atan(x*y)",
+	"sinh(x)*cosh(y)", "tanh(x-y)",
+	"exp(x*y)", "log(x+y)", "log10(x*y)", "sqrt(x*x+y)",
+	"fabs(x-y)", "floor(x)+ceil(y)+round(x)+trunc(y)+x",
+	"atan2(y, x)", "hypot(x, y)", "fmod(x*y, 1+x)",
+	"min(x, y)", "max(x, y*y)", "copysign(x, y)", "fma(x, y, x*y)",
+	"a := x*y; b := a+x; a*b", "x>y? x*x: y*y*y", "(x>1) + x",
+}
+
+// points where gradientTests are smooth.
+var gradientPoints = [][2]float64{{1.1, 1.3}, {1.7, 0.6}, {0.3, 2.2}}
+
+// test derivatives of all builtins against central differences.
+func TestCompileGradient(t *testing.T) {
+	for _, ex := range gradientTests {
+		g, err := CompileGradient(ex)
+		if err != nil {
+			t.Errorf("%q: %v", ex, err)
+			continue
+		}
+		for _, p := range gradientPoints {
+			x, y := p[0], p[1]
+			f, dx, dy := g.Eval(x, y)
+			const h = 1e-6
+			wantDx := (g.F.Eval(x+h, y) - g.F.Eval(x-h, y)) / (2 * h)
+			wantDy := (g.F.Eval(x, y+h) - g.F.Eval(x, y-h)) / (2 * h)
+			if f != g.F.Eval(x, y) {
+				t.Errorf("%q: f(%v, %v): have %v, want %v", ex, x, y, f, g.F.Eval(x, y))
+			}
+			if !approx(dx, wantDx) || !approx(dy, wantDy) {
+				t.Errorf("%q: gradient at (%v, %v): have (%v, %v), want (%v, %v)", ex, x, y, dx, dy, wantDx, wantDy)
+			}
+		}
+		g.Free()
+	}
+}
+
+func approx(have, want float64) bool {
+	return math.Abs(have-want) <= 1e-5*math.Max(1, math.Abs(want))
+}
+
+func TestDerivativeUnknown(t *testing.T) {
+	name := uniqueName("noderiv_test")
+	if err := RegisterGoFunc(name, func(x float64) float64 { return x }, true); err != nil {
+		t.Fatal(err)
+	}
+	var cerr *CompileError
+	_, err := CompileGradient(name + "(x)")
+	if !errors.As(err, &cerr) || cerr.Kind != KindNoDerivative || cerr.Expr != name+"(x)" {
+		t.Errorf("CompileGradient: have %v, want KindNoDerivative", err)
+	}
+
+	if _, err := Derivative(mustParse(t, "x + "+name+"(y)"), "y"); !errors.As(err, &cerr) || cerr.Kind != KindNoDerivative {
+		t.Errorf("Derivative: have %v, want KindNoDerivative", err)
+	}
+}
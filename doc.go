@@ -4,6 +4,13 @@ Package jit provides a toy just-in-time compiler for arithmetic expressions of v
 	x, y := 1.0, 2.0
 	z := code.Eval(x, y)
 
+Expressions of other variables can be compiled with CompileVars. E.g.:
+	code, err := CompileVars("rho*v*v/2", "rho", "v")
+	z := code.EvalN([]float64{rho, v})
+
+Functions can be defined in the expression, or in a Module. E.g.:
+	code, err := Compile("f(t) = t*t - 1; f(x) * f(y)")
+
 Works on 64-bit linux only.
 */
 package jit
@@ -0,0 +1,152 @@
+package jit
+
+// this file implements drawing the AST, as seen by the code generator, with Graphviz.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FormatDot returns a Graphviz graph (https://graphviz.org) of an expression of the given variables,
+// annotating each node with the decisions the code generator makes for it:
+//  * the order in which the values are computed: #1, #2, ...
+//  * its call depth, which decides the order of evaluation (see registerization in the README)
+//  * whether it contains a function call, which destroys the registers (drawn in gray)
+//  * where its value is stashed while evaluating its siblings: xmm2-xmm7, or a stack slot
+// E.g.:
+// 	dot, err := FormatDot(root, true, "x", "y")
+// 	...
+// 	ioutil.WriteFile("ast.dot", []byte(dot), 0666) // dot -Tsvg ast.dot > ast.svg
+// If optimize is true, the AST is first optimized like Compile does, drawing e.g. the
+// common subexpressions bound to names like $0. The tree is validated like by CompileExpr.
+func FormatDot(root Expr, optimize bool, vars ...string) (dot string, e error) {
+	ex := fmt.Sprint(root)
+	defer func() {
+		if err := recover(); err != nil {
+			dot, e = "", compileError(ex, err)
+		}
+	}()
+
+	if err := checkVarsDefs(ex, vars, nil); err != nil {
+		return "", err
+	}
+	newChecker(vars).check(root)
+	if optimize {
+		root = optimizeAST(root)
+	}
+	b := newBuf(root, vars, nil)
+	b.frame = 16 // like the main function, see assemble
+	b.trace = new(trace)
+	b.compileExpr(root)
+	return b.trace.dot(), nil
+}
+
+// trace records the decisions made by a buf while compiling, see FormatDot.
+type trace struct {
+	root  *traceNode
+	stack []*traceNode // nodes being compiled, innermost last
+	last  *traceNode   // node whose value was computed most recently
+	n     int          // number of values computed so far
+}
+
+// traceNode records how an AST node was compiled.
+type traceNode struct {
+	e         Expr
+	kids      []*traceNode // nodes of the children, in AST order
+	order     int          // when the value was computed: 1, 2, ...
+	callDepth int
+	hasCall   bool
+	stash     []string // where the value was stashed, if any
+}
+
+// enter is called when b starts compiling e.
+func (t *trace) enter(b *buf, e Expr) {
+	n := &traceNode{e: e, callDepth: b.callDepth[e], hasCall: b.hasCall[e]}
+	if len(t.stack) == 0 {
+		t.root = n
+	} else {
+		parent := t.stack[len(t.stack)-1]
+		parent.kids = append(parent.kids, n)
+	}
+	t.stack = append(t.stack, n)
+}
+
+// leave is called when b has compiled e, leaving its value in xmm0.
+func (t *trace) leave(b *buf, e Expr) {
+	n := t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+	if e, ok := e.(BinExpr); ok && !b.leftFirst(e) { // kids were added in evaluation order
+		n.kids[0], n.kids[1] = n.kids[1], n.kids[0]
+	}
+	t.n++
+	n.order = t.n
+	t.last = n
+}
+
+// stashed is called when b moves the last computed value from xmm0
+// to register xmm<reg>, or to the stack at off(%rbp) if reg == -1.
+func (t *trace) stashed(reg int, off int32) {
+	where := fmt.Sprintf("xmm%v", reg)
+	if reg == -1 {
+		where = fmt.Sprintf("stack %v(%%rbp)", off)
+	}
+	t.last.stash = append(t.last.stash, where)
+}
+
+// dot returns the recorded tree in Graphviz format.
+func (t *trace) dot() string {
+	var w strings.Builder
+	w.WriteString("digraph AST {\n")
+	w.WriteString("\tnode [shape=box fontname=monospace];\n")
+	id := 0
+	var visit func(n *traceNode) int
+	visit = func(n *traceNode) int {
+		me := id
+		id++
+		var label []string
+		label = append(label, nodeText(n.e))
+		label = append(label, fmt.Sprintf("#%v depth %v", n.order, n.callDepth))
+		for _, s := range n.stash {
+			label = append(label, "xmm0 -> "+s)
+		}
+		attr := ""
+		if n.hasCall {
+			attr = " style=filled fillcolor=lightgray"
+		}
+		fmt.Fprintf(&w, "\tn%v [label=\"%v\"%v];\n", me, dotEscape(label), attr)
+		for _, k := range n.kids {
+			fmt.Fprintf(&w, "\tn%v -> n%v;\n", me, visit(k))
+		}
+		return me
+	}
+	visit(t.root)
+	w.WriteString("}\n")
+	return w.String()
+}
+
+// nodeText returns the text of an AST node itself, without its children.
+func nodeText(e Expr) string {
+	switch e := e.(type) {
+	case BinExpr:
+		return e.op
+	case *CallExpr:
+		return e.fun + "()"
+	case PowExpr:
+		return fmt.Sprintf("^%v", e.n)
+	case IfExpr:
+		return "select"
+	case LetExpr:
+		return e.name + " :="
+	case Constant:
+		return formatConst(e.value)
+	}
+	return fmt.Sprint(e)
+}
+
+// dotEscape returns the lines of a label as the contents of a quoted DOT string.
+func dotEscape(lines []string) string {
+	for i, l := range lines {
+		lines[i] = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(l)
+	}
+	return strings.Join(lines, `\n`)
+}
@@ -0,0 +1,90 @@
+package jit
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatDot(t *testing.T) {
+	root, err := Parse("(x+1)*y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := FormatDot(root, false, "x", "y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph AST {
+	node [shape=box fontname=monospace];
+	n0 [label="*\n#5 depth 2"];
+	n1 [label="+\n#3 depth 1\nxmm0 -> xmm2"];
+	n2 [label="x\n#2 depth 0"];
+	n1 -> n2;
+	n3 [label="1\n#1 depth 0\nxmm0 -> xmm2"];
+	n1 -> n3;
+	n0 -> n1;
+	n4 [label="y\n#4 depth 0"];
+	n0 -> n4;
+}
+`
+	if !useRegisters || !useCallDepth {
+		t.Skip("output depends on optimization settings")
+	}
+	if have != want {
+		t.Errorf("have:\n%v\nwant:\n%v", have, want)
+	}
+}
+
+func TestFormatDotCalls(t *testing.T) {
+	root, err := Parse("(x*x+y*y)*sin(x*x+y*y)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := FormatDot(root, false, "x", "y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(plain, "label="); n != 16 {
+		t.Errorf("have %v nodes, want 16:\n%v", n, plain)
+	}
+	// the branch with the call is evaluated first, then kept in a register
+	if want := `[label="sin()\n#8 depth 3\nxmm0 -> xmm2" style=filled fillcolor=lightgray]`; useRegisters && useCallDepth && !strings.Contains(plain, want) {
+		t.Errorf("missing %q in:\n%v", want, plain)
+	}
+
+	if !useCSE {
+		return
+	}
+	opt, err := FormatDot(root, true, "x", "y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(opt, `$0 :=`) {
+		t.Errorf("no common subexpression in:\n%v", opt)
+	}
+}
+
+// with calls on both sides, the first one to be evaluated must be stashed on the stack
+func TestFormatDotStack(t *testing.T) {
+	root, err := Parse("sin(x)*cos(y)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := FormatDot(root, false, "x", "y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[label="cos()\n#2 depth 0\nxmm0 -> stack -24(%rbp)" style=filled fillcolor=lightgray]`; !strings.Contains(have, want) {
+		t.Errorf("missing %q in:\n%v", want, have)
+	}
+}
+
+func TestFormatDotErrors(t *testing.T) {
+	if _, err := FormatDot(NewVariable("z"), false, "x"); err == nil {
+		t.Errorf("undefined variable: no error")
+	}
+	if _, err := FormatDot(NewCallExpr("sin"), true, "x"); err == nil {
+		t.Errorf("wrong arity: no error")
+	}
+}
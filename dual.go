@@ -0,0 +1,345 @@
+package jit
+
+// This file implements forward-mode automatic differentiation:
+// code that evaluates expressions on dual numbers (value, derivative).
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// source is what code was compiled from,
+// kept for compiling its dual code when first needed.
+type source struct {
+	ex   string              // source text, for errors
+	root Expr                // parsed expression, before inlining
+	vars []string            // variables, in the order of the arguments
+	defs map[string]*funcDef // user functions that may be called
+}
+
+// EvalDual evaluates the code and its directional derivative,
+// the derivative of f(x + t*dx, y + t*dy) with respect to t at t = 0.
+// E.g., with dx = 1 and dy = 0, it returns f(x, y) and ∂f/∂x.
+// The code must have been compiled for two variables, like by Compile.
+//
+// The dual code is compiled on the first call. If the expression calls a function
+// without a known derivative, like one registered with RegisterFunc, EvalDual returns
+// a *CompileError of kind KindNoDerivative. Dual returns the same error up front.
+func (c *Code) EvalDual(x, y, dx, dy float64) (v, dv float64, err error) {
+	if c.nvars != 2 {
+		panic(fmt.Sprintf("evalDual: need code of 2 variables, have %v", c.nvars))
+	}
+	code, err := c.dualCode()
+	if err != nil {
+		return 0, 0, err
+	}
+	args := [5]float64{x, y, dx, dy}
+	v = eval(code, args[:])
+	return v, args[4], nil
+}
+
+// EvalDualN is like EvalDual, for code of any number of variables:
+// it evaluates the code at args and its derivative in the direction dargs.
+func (c *Code) EvalDualN(args, dargs []float64) (v, dv float64, err error) {
+	if len(args) != c.nvars || len(dargs) != c.nvars {
+		panic(fmt.Sprintf("evalDual: need %v arguments, have %v, %v", c.nvars, len(args), len(dargs)))
+	}
+	code, err := c.dualCode()
+	if err != nil {
+		return 0, 0, err
+	}
+	a := make([]float64, 2*c.nvars+1)
+	copy(a, args)
+	copy(a[c.nvars:], dargs)
+	v = eval(code, a)
+	return v, a[2*c.nvars], nil
+}
+
+// Dual compiles the dual code used by EvalDual and EvalDualN, if not done yet.
+// It returns the *CompileError they would return, e.g. if the expression
+// calls a function without a known derivative.
+func (c *Code) Dual() error {
+	_, err := c.dualCode()
+	return err
+}
+
+// dualCode returns the dual code, compiling it if needed.
+func (c *Code) dualCode() ([]byte, error) {
+	if len(c.instr) == 0 {
+		panic("eval called on nil code")
+	}
+	c.dualOnce.Do(func() {
+		c.dual, c.dualErr = compileDual(c.src)
+	})
+	return c.dual, c.dualErr
+}
+
+// freeDual unmaps the dual code, if it has been compiled.
+// It is called when the code itself is freed, so the dual code is not needed anymore.
+func (c *Code) freeDual() {
+	if c.dual != nil {
+		unix.Munmap(c.dual)
+		c.dual = nil
+	}
+}
+
+// compileDual compiles the dual code for src, a function of an array holding
+// the values of the n variables, followed by their derivatives and room for the result:
+// 	double f(double *args); // args: x, y, ..., dx, dy, ..., dv
+// which returns the value and stores the derivative in args[2*n].
+//
+// Each expression leaves its value in xmm0 and its derivative in xmm1.
+// Binary arithmetic combines the operands in xmm0-xmm3, so those are not used for stashing.
+// Other expressions, like calls, bind their operands and derivatives as local bindings,
+// and evaluate the rule for the result (like cos(a)*da for sin(a)) with the normal code generator.
+// User functions are always inlined.
+func compileDual(src *source) (instr []byte, e error) {
+	defer func() {
+		if err := recover(); err != nil {
+			instr, e = nil, compileError(src.ex, err)
+		}
+	}()
+
+	root := optimizeAST(newInliner(src.defs, src.vars, true).expand(src.root))
+	if err := checkDerivatives(root); err != nil {
+		return nil, compileError(src.ex, err)
+	}
+
+	d := dualBuf{buf: newBuf(root, src.vars, nil), nvars: len(src.vars)}
+	recordDualCalls(root, d.hasCall)
+	d.usedReg[2], d.usedReg[3] = true, true // scratch for binary arithmetic
+
+	d.frame = 16
+	d.emit(push_rbp, mov_rsp_rbp, push_rbx, sub_rsp(8), mov_rdi_rbx) // see assemble
+	d.compileDual(root)
+	d.emit(mov_xmm_x_rbx(1, int32(8*2*d.nvars))) // derivative -> args[2*n]
+	d.emit(add_rsp(8), pop_rbx, pop_rbp, ret)
+
+	instr, err := MakeExecutable(d.Bytes())
+	if err != nil {
+		return nil, &CompileError{Expr: src.ex, Kind: KindSystem, Msg: err.Error(), Err: err}
+	}
+	return instr, nil
+}
+
+// recordDualCalls is like recordCalls, but also records
+// the function calls made when evaluating derivatives, like cos(a) for sin(a).
+// The derivatives must have been checked with checkDerivatives.
+func recordDualCalls(root Expr, m map[Expr]bool) {
+	for _, c := range root.children() {
+		recordDualCalls(c, m)
+		if m[c] {
+			m[root] = true
+		}
+	}
+	if e, ok := root.(*CallExpr); ok {
+		a := make([]Expr, len(e.args))
+		da := make([]Expr, len(e.args))
+		for i := range a {
+			a[i], da[i] = Ref{name: "a"}, Ref{name: "da"}
+		}
+		dv := mustCallDerivative(e.fun, a, da)
+		calls := make(map[Expr]bool)
+		recordCalls(dv, calls)
+		if calls[dv] {
+			m[root] = true
+		}
+	}
+}
+
+// dualBuf accumulates machine code for dual numbers.
+type dualBuf struct {
+	*buf
+	nvars   int // number of variables
+	nlocals int // number of local bindings introduced for operands
+}
+
+// derivName returns the name under which the derivative of a local binding is kept.
+// The quote cannot occur in identifiers, so it does not clash with other bindings.
+func derivName(name string) string {
+	return name + "'"
+}
+
+// compileDual emits code leaving the value of e in xmm0, its derivative in xmm1.
+func (d *dualBuf) compileDual(e Expr) {
+	switch e := e.(type) {
+	default:
+		panic(fmt.Sprintf("compileDual %T", e))
+	case Variable:
+		i, ok := d.vars[e.name]
+		if !ok {
+			panic("undefined variable:" + e.name)
+		}
+		d.emit(mov_x_rbx_xmm(int32(8*i), 0), mov_x_rbx_xmm(int32(8*(d.nvars+i)), 1))
+	case Constant:
+		d.compileConstant(e)
+		d.emit(xor_xmm1_xmm1)
+	case Ref:
+		d.compileRef(Ref{name: derivName(e.name)})
+		d.emit(mov_xmm(0, 1))
+		d.compileRef(e)
+	case LetExpr:
+		d.compileDual(e.value)
+		regs := d.bindDual(e.name, d.hasCall[e.body])
+		d.compileDual(e.body)
+		d.unbindDual(e.name, regs)
+	case BinExpr:
+		d.compileDualBinexpr(e)
+	case *CallExpr, PowExpr, IfExpr:
+		d.compileRule(derivRule(e))
+	}
+}
+
+// derivRule returns the operands of e and a rule for its value and derivative,
+// in terms of the operands a and their derivatives da.
+func derivRule(e Expr) (args []Expr, rule func(a, da []Expr) (v, dv Expr)) {
+	switch e := e.(type) {
+	default:
+		panic(fmt.Sprintf("derivRule %T", e))
+	case BinExpr:
+		return []Expr{e.x, e.y}, func(a, da []Expr) (Expr, Expr) {
+			return BinExpr{op: e.op, x: a[0], y: a[1]}, binexprDerivative(e.op, a[0], a[1], da[0], da[1])
+		}
+	case *CallExpr:
+		return e.args, func(a, da []Expr) (Expr, Expr) {
+			return &CallExpr{fun: e.fun, args: a}, mustCallDerivative(e.fun, a, da)
+		}
+	case PowExpr: // x^n -> n*x^(n-1)*dx
+		return []Expr{e.x}, func(a, da []Expr) (Expr, Expr) {
+			return PowExpr{x: a[0], n: e.n}, mul(mul(num(float64(e.n)), powConst(a[0], float64(e.n-1))), da[0])
+		}
+	case IfExpr:
+		return []Expr{e.cond, e.x, e.y}, func(a, da []Expr) (Expr, Expr) {
+			return IfExpr{cond: a[0], x: a[1], y: a[2]}, IfExpr{cond: a[0], x: da[1], y: da[2]}
+		}
+	}
+}
+
+// compileDualBinexpr emits code for binary arithmetic on dual numbers:
+// the operands are evaluated like in compileBinexpr,
+// and combined with x in xmm2, dx in xmm3, y in xmm0 and dy in xmm1.
+func (d *dualBuf) compileDualBinexpr(e BinExpr) {
+	switch e.op {
+	default: // comparisons and logical operators are piecewise constant
+		d.compileExpr(e)
+		d.emit(xor_xmm1_xmm1)
+		return
+	case "^":
+		d.compileRule(derivRule(e))
+		return
+	case "+", "-", "*", "/":
+	}
+
+	first, second := d.order(e)
+	d.compileDual(first)
+	regs := d.stashDual(d.hasCall[second])
+	d.compileDual(second)
+	if first == e.y {
+		d.emit(mov_xmm(0, 2), mov_xmm(1, 3))
+		d.unstashDual(regs, 0, 1)
+	} else {
+		d.unstashDual(regs, 2, 3)
+	}
+
+	switch e.op {
+	case "+":
+		d.emit(arith_xmm(op_add, 2, 0), arith_xmm(op_add, 3, 1))
+	case "-":
+		d.emit(arith_xmm(op_sub, 0, 2), arith_xmm(op_sub, 1, 3))
+		d.emit(mov_xmm(2, 0), mov_xmm(3, 1))
+	case "*": // d(x*y) = dx*y + x*dy
+		d.emit(arith_xmm(op_mul, 0, 3)) // dx*y -> xmm3
+		d.emit(arith_xmm(op_mul, 2, 1)) // x*dy -> xmm1
+		d.emit(arith_xmm(op_add, 3, 1)) // sum -> xmm1
+		d.emit(arith_xmm(op_mul, 2, 0)) // x*y -> xmm0
+	case "/": // d(x/y) = (dx - (x/y)*dy) / y
+		d.emit(arith_xmm(op_div, 0, 2)) // x/y -> xmm2
+		d.emit(arith_xmm(op_mul, 2, 1)) // (x/y)*dy -> xmm1
+		d.emit(arith_xmm(op_sub, 1, 3)) // dx - ... -> xmm3
+		d.emit(arith_xmm(op_div, 0, 3)) // ... / y -> xmm3
+		d.emit(mov_xmm(2, 0), mov_xmm(3, 1))
+	}
+}
+
+// compileRule evaluates args as dual numbers and binds them to new local bindings.
+// Then it emits normal code for the value and derivative returned by rule,
+// given references to those bindings (constant arguments are passed as they are, with derivative 0).
+func (d *dualBuf) compileRule(args []Expr, rule func(a, da []Expr) (v, dv Expr)) {
+	a := make([]Expr, len(args))
+	da := make([]Expr, len(args))
+	for i, arg := range args {
+		if c, ok := arg.(Constant); ok {
+			a[i], da[i] = c, num(0)
+			continue
+		}
+		name := fmt.Sprint("#", d.nlocals)
+		d.nlocals++
+		a[i], da[i] = Ref{name: name}, Ref{name: derivName(name)}
+	}
+	v, dv := rule(a, da)
+	dv = expandPow(simplify(FoldConst(dv)))
+	for _, e := range []Expr{v, dv} {
+		recordCalls(e, d.hasCall)
+		recordDepth(e, d.callDepth)
+	}
+
+	// bind the arguments, in registers unless a call follows.
+	regs := make([][2]int, len(args))
+	for i, arg := range args {
+		if _, ok := arg.(Constant); ok {
+			continue
+		}
+		d.compileDual(arg)
+		destroyRegs := d.hasCall[v] || d.hasCall[dv]
+		for _, later := range args[i+1:] {
+			destroyRegs = destroyRegs || d.hasCall[later]
+		}
+		regs[i] = d.bindDual(a[i].(Ref).name, destroyRegs)
+	}
+
+	d.compileExpr(v)
+	reg := d.stash(d.hasCall[dv])
+	d.compileExpr(dv)
+	d.emit(mov_xmm(0, 1))
+	d.unstash(reg, 0)
+
+	for i := len(args) - 1; i >= 0; i-- {
+		if r, ok := a[i].(Ref); ok {
+			d.unbindDual(r.name, regs[i])
+		}
+	}
+}
+
+// stashDual stashes the dual number in xmm0, xmm1 (see stash).
+func (d *dualBuf) stashDual(destroyRegs bool) [2]int {
+	reg := d.stash(destroyRegs)
+	d.emit(mov_xmm(1, 0))
+	dreg := d.stash(destroyRegs)
+	return [2]int{reg, dreg}
+}
+
+// unstashDual moves a dual number stashed by stashDual into xmm<dest>, xmm<ddest>.
+func (d *dualBuf) unstashDual(regs [2]int, dest, ddest int) {
+	d.unstash(regs[1], ddest)
+	d.unstash(regs[0], dest)
+}
+
+// bindDual stashes the dual number in xmm0, xmm1 as the local binding name
+// and its derivative, like compileLetexpr.
+func (d *dualBuf) bindDual(name string, destroyRegs bool) [2]int {
+	reg := d.stash(destroyRegs)
+	d.locals[name] = local{reg: reg, off: -(d.frame + 8*int32(d.nPushed))}
+	d.emit(mov_xmm(1, 0))
+	dreg := d.stash(destroyRegs)
+	d.locals[derivName(name)] = local{reg: dreg, off: -(d.frame + 8*int32(d.nPushed))}
+	return [2]int{reg, dreg}
+}
+
+// unbindDual removes a binding made by bindDual.
+func (d *dualBuf) unbindDual(name string, regs [2]int) {
+	delete(d.locals, name)
+	delete(d.locals, derivName(name))
+	d.drop(regs[1])
+	d.drop(regs[0])
+}
@@ -0,0 +1,155 @@
+package jit
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// EvalDual must return exactly the same value as Eval.
+func TestEvalDualValue(t *testing.T) {
+	defer func() {
+		useCallDepth = true
+		useRegisters = true
+	}()
+	for expr, want := range tests {
+		for _, useCallDepth = range []bool{true, false} {
+			for _, useRegisters = range []bool{true, false} {
+				code, err := Compile(expr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, x := range []float64{3, -1e3, -123.4, -1, 0, 1, 123.4, 1e3} {
+					for _, y := range []float64{5, -1e3, -123.4, -1, 0, 1, 123.4, 1e3} {
+						have, _, err := code.EvalDual(x, y, 1, 0)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if !equal(have, want(x, y)) {
+							t.Errorf("%v with x=%v,y=%v: have %v, want: %v", expr, x, y, have, want(x, y))
+						}
+					}
+				}
+				code.Free()
+			}
+		}
+	}
+}
+
+// EvalDual must agree with the symbolic derivatives.
+func TestEvalDual(t *testing.T) {
+	defer func() {
+		useCallDepth = true
+		useRegisters = true
+	}()
+	for _, ex := range gradientTests {
+		for _, useCallDepth = range []bool{true, false} {
+			for _, useRegisters = range []bool{true, false} {
+				g, err := CompileGradient(ex)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range gradientPoints {
+					x, y := p[0], p[1]
+					for _, dir := range [][2]float64{{1, 0}, {0, 1}, {0.6, -0.8}} {
+						v, dv, err := g.F.EvalDual(x, y, dir[0], dir[1])
+						if err != nil {
+							t.Fatal(err)
+						}
+						f, dfdx, dfdy := g.Eval(x, y)
+						want := dir[0]*dfdx + dir[1]*dfdy
+						if v != f || !approx(dv, want) {
+							t.Errorf("%q at (%v, %v) in direction %v: have %v, %v, want %v, %v", ex, x, y, dir, v, dv, f, want)
+						}
+					}
+				}
+				g.Free()
+			}
+		}
+	}
+}
+
+func TestEvalDualN(t *testing.T) {
+	code, err := CompileVars(bigDef+"; f(s, t) = big(s, s+t); sin(f(u, v)) * f(v, w) / w", "u", "v", "w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	f := func(u, v, w float64) float64 {
+		g := func(s, t float64) float64 { return big(s, s+t) }
+		return math.Sin(g(u, v)) * g(v, w) / w
+	}
+	u, v, w := 0.7, 1.3, 2.1
+	du, dv, dw := 0.3, -0.5, 0.2
+	const h = 1e-6
+	want := (f(u+h*du, v+h*dv, w+h*dw) - f(u-h*du, v-h*dv, w-h*dw)) / (2 * h)
+	haveV, haveD, err := code.EvalDualN([]float64{u, v, w}, []float64{du, dv, dw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if haveV != code.EvalN([]float64{u, v, w}) || !approx(haveD, want) {
+		t.Errorf("have %v, %v, want %v, %v", haveV, haveD, f(u, v, w), want)
+	}
+}
+
+func TestEvalDualModule(t *testing.T) {
+	m, err := CompileModule(map[string]string{"sq(a)": "a*a", "f(a, b)": "sq(a) * sin(b)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Free()
+	v, dv, err := m.Lookup("f").EvalDual(2, 1, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 4*math.Cos(1) + 4*math.Sin(1); v != m.Lookup("f").Eval(2, 1) || !approx(dv, want) {
+		t.Errorf("have %v, %v, want %v", v, dv, want)
+	}
+}
+
+func TestEvalDualUnknown(t *testing.T) {
+	name := uniqueName("nodual_test")
+	if err := RegisterGoFunc(name, func(x float64) float64 { return x }, true); err != nil {
+		t.Fatal(err)
+	}
+	code, err := Compile(name + "(x) + y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	var cerr *CompileError
+	if err := code.Dual(); !errors.As(err, &cerr) || cerr.Kind != KindNoDerivative {
+		t.Errorf("Dual: have %v, want KindNoDerivative", err)
+	}
+	if _, _, err := code.EvalDual(1, 2, 1, 0); !errors.As(err, &cerr) || cerr.Kind != KindNoDerivative {
+		t.Errorf("EvalDual: have %v, want KindNoDerivative", err)
+	}
+	if _, _, err := code.EvalDualN([]float64{1, 2}, []float64{0, 1}); !errors.As(err, &cerr) || cerr.Kind != KindNoDerivative {
+		t.Errorf("EvalDualN: have %v, want KindNoDerivative", err)
+	}
+}
+
+// Free has no effect on code of a module, which must still evaluate its dual code afterwards,
+// until the module is freed.
+func TestEvalDualFreeShared(t *testing.T) {
+	m, err := CompileModule(map[string]string{"f(a, b)": "a*b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := m.Lookup("f")
+	if err := f.Dual(); err != nil {
+		t.Fatal(err)
+	}
+	f.Free()
+	if v, dv, err := f.EvalDual(2, 3, 1, 0); v != 6 || dv != 3 || err != nil {
+		t.Errorf("have %v, %v, %v, want 6, 3", v, dv, err)
+	}
+
+	m.Free()
+	defer func() {
+		if err := recover(); err != "eval called on nil code" {
+			t.Errorf("EvalDual after freeing the module: have %v, want panic", err)
+		}
+	}()
+	f.EvalDual(2, 3, 1, 0)
+}
@@ -0,0 +1,438 @@
+package jit
+
+// this file implements serializing expressions, as JSON or in a compact binary form.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Formula is an expression together with its variables, which can be stored or sent elsewhere.
+// It implements json.Marshaler and encoding.BinaryMarshaler, and their Unmarshalers, e.g.:
+// 	data, err := json.Marshal(Formula{Vars: []string{"x", "y"}, Expr: root})
+// 	...
+// 	var f Formula
+// 	err = json.Unmarshal(data, &f)
+// 	...
+// 	code, err := CompileExpr(f.Expr, f.Vars...)
+// Decoding validates the tree like CompileExpr: it may only use the variables in Vars,
+// and call functions that are defined, with the right number of arguments, etc.
+// Otherwise it returns a *CompileError, or another error if the data is malformed.
+//
+// Constants are encoded by their bits, so that they are preserved exactly,
+// including NaNs, infinities and the sign of zero.
+type Formula struct {
+	Vars []string // variables the expression may use
+	Expr Expr
+}
+
+// encodingVersion is the version of the JSON and binary formats.
+// It must be increased when the formats change incompatibly.
+const encodingVersion = 1
+
+// maxDepth is the maximum nesting of a decoded tree, to bound the recursion.
+// Like the limit of encoding/json, it is far beyond any reasonable expression.
+const maxDepth = 10000
+
+// JSON format:
+// 	{"version": 1, "vars": ["x", "y"], "expr": node}
+// where each node has a kind, one of
+// 	{"kind": "var", "name": "x"}
+// 	{"kind": "const", "bits": "3ff0000000000000"}
+// 	{"kind": "binary", "op": "+", "args": [x, y]}
+// 	{"kind": "call", "fun": "atan2", "args": [y, x]}
+// 	{"kind": "if", "args": [cond, x, y]}
+// 	{"kind": "let", "name": "r", "args": [value, body]}
+// 	{"kind": "ref", "name": "r"}
+// 	{"kind": "pow", "n": 3, "args": [x]}
+type jsonFormula struct {
+	Version int       `json:"version"`
+	Vars    []string  `json:"vars"`
+	Expr    *jsonNode `json:"expr"`
+}
+
+type jsonNode struct {
+	Kind string      `json:"kind"`
+	Name string      `json:"name,omitempty"`
+	Bits string      `json:"bits,omitempty"`
+	Op   string      `json:"op,omitempty"`
+	Fun  string      `json:"fun,omitempty"`
+	N    int         `json:"n,omitempty"`
+	Args []*jsonNode `json:"args,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (f Formula) MarshalJSON() ([]byte, error) {
+	root, err := toJSON(f.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonFormula{Version: encodingVersion, Vars: f.Vars, Expr: root})
+}
+
+func toJSON(e Expr) (*jsonNode, error) {
+	var n *jsonNode
+	switch e := e.(type) {
+	default:
+		return nil, fmt.Errorf("encode: invalid node: %T", e)
+	case Variable:
+		return &jsonNode{Kind: "var", Name: e.name}, nil
+	case Constant:
+		return &jsonNode{Kind: "const", Bits: fmt.Sprintf("%016x", math.Float64bits(e.value))}, nil
+	case Ref:
+		return &jsonNode{Kind: "ref", Name: e.name}, nil
+	case BinExpr:
+		if indexOf(binaryOps, e.op) < 0 {
+			return nil, fmt.Errorf("encode: unsupported operator: %q", e.op)
+		}
+		n = &jsonNode{Kind: "binary", Op: e.op}
+	case *CallExpr:
+		n = &jsonNode{Kind: "call", Fun: e.fun}
+	case IfExpr:
+		n = &jsonNode{Kind: "if"}
+	case LetExpr:
+		n = &jsonNode{Kind: "let", Name: e.name}
+	case PowExpr:
+		n = &jsonNode{Kind: "pow", N: e.n}
+	}
+	for _, c := range e.children() {
+		a, err := toJSON(c)
+		if err != nil {
+			return nil, err
+		}
+		n.Args = append(n.Args, a)
+	}
+	return n, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (f *Formula) UnmarshalJSON(data []byte) error {
+	var j jsonFormula
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.Version != encodingVersion {
+		return fmt.Errorf("decode: unsupported version: %v", j.Version)
+	}
+	root, err := fromJSON(j.Expr)
+	if err != nil {
+		return err
+	}
+	return f.set(j.Vars, root)
+}
+
+func fromJSON(n *jsonNode) (Expr, error) {
+	if n == nil {
+		return nil, errors.New("decode: missing node")
+	}
+	args := make([]Expr, len(n.Args))
+	for i, a := range n.Args {
+		var err error
+		if args[i], err = fromJSON(a); err != nil {
+			return nil, err
+		}
+	}
+	nargs := map[string]int{"var": 0, "const": 0, "ref": 0, "binary": 2, "if": 3, "let": 2, "pow": 1}
+	if want, ok := nargs[n.Kind]; ok && len(args) != want {
+		return nil, fmt.Errorf("decode: %v node needs %v arguments, have %v", n.Kind, want, len(args))
+	}
+	switch n.Kind {
+	case "var":
+		return Variable{name: n.Name}, nil
+	case "const":
+		bits, err := strconv.ParseUint(n.Bits, 16, 64)
+		if err != nil || len(n.Bits) != 16 {
+			return nil, fmt.Errorf("decode: invalid constant bits: %q", n.Bits)
+		}
+		return Constant{math.Float64frombits(bits)}, nil
+	case "ref":
+		return Ref{name: n.Name}, nil
+	case "binary":
+		return BinExpr{op: n.Op, x: args[0], y: args[1]}, nil
+	case "call":
+		return &CallExpr{fun: n.Fun, args: args}, nil
+	case "if":
+		return IfExpr{cond: args[0], x: args[1], y: args[2]}, nil
+	case "let":
+		return LetExpr{name: n.Name, value: args[0], body: args[1]}, nil
+	case "pow":
+		return PowExpr{x: args[0], n: n.N}, nil
+	}
+	return nil, fmt.Errorf("decode: unknown node kind: %q", n.Kind)
+}
+
+// set validates a decoded expression, and sets f to it.
+func (f *Formula) set(vars []string, root Expr) (e error) {
+	ex := fmt.Sprint(root)
+	defer func() {
+		if err := recover(); err != nil {
+			e = compileError(ex, err)
+		}
+	}()
+
+	if err := checkVarsDefs(ex, vars, nil); err != nil {
+		return err
+	}
+	newChecker(vars).check(root)
+	f.Vars, f.Expr = vars, root
+	return nil
+}
+
+// Binary format, using unsigned varints (see encoding/binary) for all integers:
+// 	version, number of variables, number of other strings, strings, root node
+// where each string is its length followed by the bytes: first the variables,
+// then the other names (functions, local bindings) used by the nodes.
+// Each node is a tag byte, followed by
+// 	tagVar:   index of the name in the strings
+// 	tagConst: bits, 8 bytes little endian
+// 	tagBin:   operator byte (index in binaryOps), x, y
+// 	tagCall:  index of the function name, number of arguments, arguments
+// 	tagIf:    cond, x, y
+// 	tagLet:   index of the name, value, body
+// 	tagRef:   index of the name
+// 	tagPow:   exponent, x
+const (
+	tagVar = 1 + iota
+	tagConst
+	tagBin
+	tagCall
+	tagIf
+	tagLet
+	tagRef
+	tagPow
+)
+
+// binaryOps are the binary operators, in the order of their binary encoding.
+// New operators must be added at the end.
+var binaryOps = []string{"+", "-", "*", "/", "^", "==", "!=", "<", "<=", ">", ">=", "&&", "||"}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (f Formula) MarshalBinary() ([]byte, error) {
+	enc := encoder{index: make(map[string]int)}
+	for _, v := range f.Vars {
+		enc.intern(v)
+	}
+	nvars := len(enc.strings)
+	if nvars != len(f.Vars) {
+		return nil, fmt.Errorf("encode: duplicate variable in %q", f.Vars)
+	}
+	var body []byte
+	body, err := enc.node(body, f.Expr)
+	if err != nil {
+		return nil, err
+	}
+
+	data := binary.AppendUvarint(nil, encodingVersion)
+	data = binary.AppendUvarint(data, uint64(nvars))
+	data = binary.AppendUvarint(data, uint64(len(enc.strings)-nvars))
+	for _, s := range enc.strings {
+		data = binary.AppendUvarint(data, uint64(len(s)))
+		data = append(data, s...)
+	}
+	return append(data, body...), nil
+}
+
+// encoder holds the state for MarshalBinary.
+type encoder struct {
+	strings []string       // string table
+	index   map[string]int // index of each string in the table
+}
+
+// intern returns the index of s in the string table, adding it if needed.
+func (enc *encoder) intern(s string) uint64 {
+	i, ok := enc.index[s]
+	if !ok {
+		i = len(enc.strings)
+		enc.index[s] = i
+		enc.strings = append(enc.strings, s)
+	}
+	return uint64(i)
+}
+
+// node appends the encoding of e to data.
+func (enc *encoder) node(data []byte, e Expr) ([]byte, error) {
+	switch e := e.(type) {
+	default:
+		return nil, fmt.Errorf("encode: invalid node: %T", e)
+	case Variable:
+		return binary.AppendUvarint(append(data, tagVar), enc.intern(e.name)), nil
+	case Constant:
+		return binary.LittleEndian.AppendUint64(append(data, tagConst), math.Float64bits(e.value)), nil
+	case Ref:
+		return binary.AppendUvarint(append(data, tagRef), enc.intern(e.name)), nil
+	case BinExpr:
+		op := indexOf(binaryOps, e.op)
+		if op < 0 {
+			return nil, fmt.Errorf("encode: unsupported operator: %q", e.op)
+		}
+		data = append(data, tagBin, byte(op))
+	case *CallExpr:
+		data = binary.AppendUvarint(append(data, tagCall), enc.intern(e.fun))
+		data = binary.AppendUvarint(data, uint64(len(e.args)))
+	case IfExpr:
+		data = append(data, tagIf)
+	case LetExpr:
+		data = binary.AppendUvarint(append(data, tagLet), enc.intern(e.name))
+	case PowExpr:
+		if e.n < 0 {
+			return nil, fmt.Errorf("encode: invalid exponent: %v", e.n)
+		}
+		data = binary.AppendUvarint(append(data, tagPow), uint64(e.n))
+	}
+	for _, c := range e.children() {
+		var err error
+		if data, err = enc.node(data, c); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, l := range list {
+		if l == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (f *Formula) UnmarshalBinary(data []byte) (e error) {
+	defer func() {
+		switch err := recover().(type) {
+		case nil:
+		case decodeError:
+			e = err
+		default:
+			panic(err)
+		}
+	}()
+
+	d := decoder{data: data}
+	if v := d.uvarint(); v != encodingVersion {
+		return fmt.Errorf("decode: unsupported version: %v", v)
+	}
+	nvars, nother := d.count(), d.count()
+	d.strings = make([]string, nvars+nother)
+	for i := range d.strings {
+		d.strings[i] = string(d.bytes(d.count()))
+	}
+	root := d.node(0)
+	if len(d.data) > 0 {
+		return decodeError("decode: trailing data")
+	}
+	return f.set(d.strings[:nvars], root)
+}
+
+// decodeError is a malformed binary encoding.
+// It is raised as a panic by decoder, and recovered by UnmarshalBinary.
+type decodeError string
+
+func (e decodeError) Error() string { return string(e) }
+
+// decoder holds the state for UnmarshalBinary.
+type decoder struct {
+	data    []byte   // remaining data
+	strings []string // string table
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	panic(decodeError("decode: " + fmt.Sprintf(format, args...)))
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) == 0 {
+		d.fail("unexpected end of data")
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n > len(d.data) {
+		d.fail("unexpected end of data")
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("invalid varint")
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// count decodes a number of items, each of which takes at least one byte,
+// so that a corrupt count cannot cause a huge allocation.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail("invalid count: %v", n)
+	}
+	return int(n)
+}
+
+// string decodes a reference to the string table.
+func (d *decoder) string() string {
+	i := d.uvarint()
+	if i >= uint64(len(d.strings)) {
+		d.fail("invalid string index: %v", i)
+	}
+	return d.strings[i]
+}
+
+func (d *decoder) node(depth int) Expr {
+	if depth > maxDepth {
+		d.fail("nesting too deep")
+	}
+	depth++
+	switch tag := d.byte(); tag {
+	default:
+		d.fail("invalid tag: %v", tag)
+	case tagVar:
+		return Variable{name: d.string()}
+	case tagConst:
+		return Constant{math.Float64frombits(binary.LittleEndian.Uint64(d.bytes(8)))}
+	case tagRef:
+		return Ref{name: d.string()}
+	case tagBin:
+		op := int(d.byte())
+		if op >= len(binaryOps) {
+			d.fail("invalid operator: %v", op)
+		}
+		x := d.node(depth)
+		return BinExpr{op: binaryOps[op], x: x, y: d.node(depth)}
+	case tagCall:
+		fun := d.string()
+		args := make([]Expr, d.count())
+		for i := range args {
+			args[i] = d.node(depth)
+		}
+		return &CallExpr{fun: fun, args: args}
+	case tagIf:
+		cond := d.node(depth)
+		x := d.node(depth)
+		return IfExpr{cond: cond, x: x, y: d.node(depth)}
+	case tagLet:
+		name := d.string()
+		value := d.node(depth)
+		return LetExpr{name: name, value: value, body: d.node(depth)}
+	case tagPow:
+		n := d.uvarint()
+		if n > math.MaxInt32 {
+			d.fail("invalid exponent: %v", n)
+		}
+		return PowExpr{x: d.node(depth), n: int(n)}
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,190 @@
+package jit
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// codecs are the encodings of a Formula, for testing them side by side.
+var codecs = []struct {
+	name      string
+	marshal   func(Formula) ([]byte, error)
+	unmarshal func([]byte, *Formula) error
+}{
+	{"json", func(f Formula) ([]byte, error) { return json.Marshal(f) }, func(data []byte, f *Formula) error { return json.Unmarshal(data, f) }},
+	{"binary", Formula.MarshalBinary, func(data []byte, f *Formula) error { return f.UnmarshalBinary(data) }},
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	var roots []Expr
+	for ex := range tests {
+		root, err := Parse(ex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, root)
+	}
+	inlined, err := ParseVars("sq(a) = a*a; sq(x) + sq(sq(y))", "x", "y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots = append(roots, inlined, NewLetExpr("r", NewVariable("x"), NewRef("r")))
+	roots = append(roots, expandPow(mustParse(t, "x^3 + sin(x)^3")))
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		roots = append(roots, randomExpr(rng, 6))
+	}
+
+	for _, c := range codecs {
+		for _, root := range roots {
+			data, err := c.marshal(Formula{Vars: []string{"x", "y"}, Expr: root})
+			if err != nil {
+				t.Errorf("%v: marshal %v: %v", c.name, root, err)
+				continue
+			}
+			var f Formula
+			if err := c.unmarshal(data, &f); err != nil {
+				t.Errorf("%v: unmarshal %v: %v", c.name, root, err)
+				continue
+			}
+			if !sameExpr(f.Expr, root) || strings.Join(f.Vars, ",") != "x,y" {
+				t.Errorf("%v: round trip of %v: have %v %q", c.name, root, f.Expr, f.Vars)
+			}
+		}
+	}
+}
+
+func mustParse(t *testing.T, ex string) Expr {
+	t.Helper()
+	root, err := Parse(ex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestEncodingConstBits(t *testing.T) {
+	for _, c := range codecs {
+		for _, bits := range []uint64{0, 1 << 63, 0x7ff8000000000001, 0xfff0000000000000, 1} {
+			data, err := c.marshal(Formula{Expr: NewConstant(math.Float64frombits(bits))})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var f Formula
+			if err := c.unmarshal(data, &f); err != nil {
+				t.Fatal(err)
+			}
+			if have := math.Float64bits(f.Expr.(Constant).value); have != bits {
+				t.Errorf("%v: have %016x, want %016x", c.name, have, bits)
+			}
+		}
+	}
+}
+
+func TestEncodingJSON(t *testing.T) {
+	root := NewBinExpr("+", NewCallExpr("sin", NewVariable("x")), NewConstant(1))
+	data, err := json.Marshal(Formula{Vars: []string{"x"}, Expr: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"version":1,"vars":["x"],"expr":{"kind":"binary","op":"+","args":[` +
+		`{"kind":"call","fun":"sin","args":[{"kind":"var","name":"x"}]},` +
+		`{"kind":"const","bits":"3ff0000000000000"}]}}`
+	if string(data) != want {
+		t.Errorf("have %s\nwant %s", data, want)
+	}
+}
+
+func TestEncodingBinary(t *testing.T) {
+	// the binary form is much smaller: names are stored only once
+	root := mustParse(t, "sin(x*y) + sin(x/y) + sin(x-y) + sin(x+y)")
+	f := Formula{Vars: []string{"x", "y"}, Expr: root}
+	bin, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bin) > 60 || len(bin)*5 > len(js) {
+		t.Errorf("binary: %v bytes, json: %v bytes", len(bin), len(js))
+	}
+
+	// every truncation is detected
+	for i := 0; i < len(bin); i++ {
+		var f Formula
+		if err := f.UnmarshalBinary(bin[:i]); err == nil {
+			t.Errorf("no error for %v of %v bytes", i, len(bin))
+		}
+	}
+	if err := f.UnmarshalBinary(append(bin, 0)); err == nil {
+		t.Errorf("no error for trailing data")
+	}
+	if err := f.UnmarshalBinary(append([]byte{encodingVersion, 0, 0}, bytes.Repeat([]byte{tagPow, 2}, 20000)...)); err == nil || !strings.Contains(err.Error(), "too deep") {
+		t.Errorf("have %v, want nesting too deep", err)
+	}
+}
+
+func TestEncodingErrors(t *testing.T) {
+	x := NewVariable("x")
+	tests := []struct {
+		vars []string
+		root Expr
+		kind ErrorKind
+	}{
+		{[]string{"x"}, NewVariable("y"), KindUnknownIdent},
+		{[]string{"x"}, NewCallExpr("nosuchfunc", x), KindUnknownIdent},
+		{[]string{"x"}, NewCallExpr("sin", x, x), KindArity},
+		{[]string{"x"}, NewRef("r"), KindUnknownIdent},
+		{[]string{"x"}, NewLetExpr("x", x, x), KindRedeclared},
+		{[]string{"sin"}, NewConstant(1), KindInvalidVar},
+	}
+	for _, c := range codecs {
+		for _, test := range tests {
+			data, err := c.marshal(Formula{Vars: test.vars, Expr: test.root})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var f Formula
+			err = c.unmarshal(data, &f)
+			cerr, ok := err.(*CompileError)
+			if !ok || cerr.Kind != test.kind {
+				t.Errorf("%v: unmarshal %v %q: have %v, want %v", c.name, test.root, test.vars, err, test.kind)
+			}
+			if f.Expr != nil {
+				t.Errorf("%v: unmarshal %v: Formula set despite error", c.name, test.root)
+			}
+		}
+	}
+
+	// malformed JSON
+	for _, data := range []string{
+		`{"version":2,"vars":["x"],"expr":{"kind":"var","name":"x"}}`,
+		`{"vars":["x"],"expr":{"kind":"var","name":"x"}}`,
+		`{"version":1,"vars":["x"]}`,
+		`{"version":1,"vars":["x"],"expr":{"kind":"frob"}}`,
+		`{"version":1,"vars":["x"],"expr":{"kind":"const","bits":"3ff"}}`,
+		`{"version":1,"vars":["x"],"expr":{"kind":"const","bits":"xyz0000000000000"}}`,
+		`{"version":1,"vars":["x"],"expr":{"kind":"binary","op":"+","args":[{"kind":"var","name":"x"}]}}`,
+		`{"version":1,"vars":["x"],"expr":{"kind":"binary","op":"%","args":[{"kind":"var","name":"x"},{"kind":"var","name":"x"}]}}`,
+	} {
+		var f Formula
+		if err := json.Unmarshal([]byte(data), &f); err == nil {
+			t.Errorf("no error for %s", data)
+		}
+	}
+
+	// not encodable
+	for _, root := range []Expr{nil, NewBinExpr("%", x, x), NewBinExpr("+", x, nil)} {
+		for _, c := range codecs {
+			if _, err := c.marshal(Formula{Vars: []string{"x"}, Expr: root}); err == nil {
+				t.Errorf("%v: no error for %v", c.name, root)
+			}
+		}
+	}
+}
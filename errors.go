@@ -0,0 +1,116 @@
+package jit
+
+// this file implements the error types returned by Parse and Compile.
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrorKind classifies errors in expressions.
+type ErrorKind int
+
+// error kinds
+const (
+	KindSyntax        ErrorKind = iota // malformed expression, e.g. unbalanced parentheses
+	KindUnsupportedOp                  // operator not in the language, e.g. x<<1 or x%2
+	KindUnknownIdent                   // undefined variable, constant or function
+	KindArity                          // function called with the wrong number of arguments
+	KindRedeclared                     // binding clashes with another name
+	KindInvalidVar                     // invalid variable names passed to CompileVars
+	KindSystem                         // the operating system refused to provide executable memory
+	KindInternal                       // bug in the compiler
+	KindRecursion                      // user function calls itself, directly or indirectly
+	KindNoDerivative                   // function without a known derivative
+)
+
+var kindNames = [...]string{
+	KindSyntax:        "syntax error",
+	KindUnsupportedOp: "unsupported operator",
+	KindUnknownIdent:  "unknown identifier",
+	KindArity:         "wrong number of arguments",
+	KindRedeclared:    "redeclared",
+	KindInvalidVar:    "invalid variable",
+	KindSystem:        "system error",
+	KindInternal:      "internal error",
+	KindRecursion:     "recursion",
+	KindNoDerivative:  "no derivative",
+}
+
+func (k ErrorKind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+	return kindNames[k]
+}
+
+// ParseError is returned for an expression that cannot be parsed.
+// It points to the offending token, which can be shown with Caret.
+type ParseError struct {
+	Expr   string    // the expression being parsed
+	Offset int       // byte offset of the offending token in Expr
+	Len    int       // byte length of the offending token, 0 at the end of the expression
+	Token  string    // the offending token, "" at the end of the expression
+	Kind   ErrorKind // what went wrong
+	Msg    string    // human-readable description, without position
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse %q: offset %v: %v", e.Expr, e.Offset, e.Msg)
+}
+
+// Caret renders the expression with a caret under the offending token. E.g.:
+// 	x + foo(y)
+// 	    ^^^
+func (e *ParseError) Caret() string {
+	// only render the line holding the offending token
+	start := strings.LastIndex(e.Expr[:e.Offset], "\n") + 1
+	end := len(e.Expr)
+	if i := strings.Index(e.Expr[e.Offset:], "\n"); i >= 0 {
+		end = e.Offset + i
+	}
+
+	var pad strings.Builder
+	for _, r := range e.Expr[start:e.Offset] {
+		if r == '\t' {
+			pad.WriteRune('\t') // stay aligned whatever the tab width
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+	n := utf8.RuneCountInString(e.Token)
+	if n == 0 {
+		n = 1
+	}
+	return e.Expr[start:end] + "\n" + pad.String() + strings.Repeat("^", n)
+}
+
+// CompileError is returned by Compile for errors other than parse errors.
+type CompileError struct {
+	Expr string    // the expression being compiled
+	Kind ErrorKind // what went wrong
+	Msg  string    // human-readable description
+	Err  error     // underlying error, if any
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("compile %q: %v", e.Expr, e.Msg)
+}
+
+// Unwrap returns the underlying error, if any.
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// syntaxError panics with a ParseError about token t.
+// The panic is recovered by ParseVars, which fills in the expression.
+func syntaxError(kind ErrorKind, t token, format string, args ...interface{}) {
+	panic(&ParseError{
+		Offset: t.pos,
+		Len:    len(t.text),
+		Token:  t.text,
+		Kind:   kind,
+		Msg:    fmt.Sprintf(format, args...),
+	})
+}
@@ -0,0 +1,85 @@
+package jit
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		in     string
+		kind   ErrorKind
+		offset int
+		token  string
+	}{
+		{"", KindSyntax, 0, ""},
+		{"(x+y", KindSyntax, 4, ""},
+		{"x y", KindSyntax, 2, "y"},
+		{"x + $", KindSyntax, 4, "$"},
+		{"1e999", KindSyntax, 0, "1e999"},
+		{"x<<1", KindUnsupportedOp, 1, "<<"},
+		{"1 | 2", KindUnsupportedOp, 2, "|"},
+		{"x % 2", KindUnsupportedOp, 2, "%"},
+		{"r = 1; r", KindUnsupportedOp, 2, "="},
+		{"x + zz", KindUnknownIdent, 4, "zz"},
+		{"1 + foo(x)", KindUnknownIdent, 4, "foo"},
+		{"x * atan2(x)", KindArity, 4, "atan2"},
+		{"ifelse(1, 2)", KindArity, 0, "ifelse"},
+		{"select(1, 2, 3, 4)", KindArity, 0, "select"},
+		{"r := 1; r := 2; r", KindRedeclared, 8, "r"},
+		{"pi := 1; pi", KindRedeclared, 0, "pi"},
+	}
+	for _, test := range tests {
+		_, err := Compile(test.in)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("compile %q: want *ParseError, have %#v", test.in, err)
+			continue
+		}
+		if perr.Kind != test.kind || perr.Offset != test.offset || perr.Token != test.token || perr.Len != len(test.token) || perr.Expr != test.in {
+			t.Errorf("compile %q: have %v at %v+%v (%q), want %v at %v (%q)",
+				test.in, perr.Kind, perr.Offset, perr.Len, perr.Token, test.kind, test.offset, test.token)
+		}
+	}
+}
+
+func TestCaret(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"x + foo(y)", "x + foo(y)\n    ^^^"},
+		{"(x+y", "(x+y\n    ^"},
+		{"π + $", "π + $\n    ^"},
+		{"\tx $", "\tx $\n\t  ^"},
+		{"r := x;\nr $", "r $\n  ^"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.in)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("parse %q: want *ParseError, have %#v", test.in, err)
+			continue
+		}
+		if have := perr.Caret(); have != test.want {
+			t.Errorf("caret %q:\nhave:\n%v\nwant:\n%v", test.in, have, test.want)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	_, err := CompileVars("x", "x", "x")
+	var cerr *CompileError
+	if !errors.As(err, &cerr) || cerr.Kind != KindInvalidVar {
+		t.Errorf("compile with duplicate variables: want *CompileError of kind %v, have %#v", KindInvalidVar, err)
+	}
+}
+
+// ErrorKinds are exported constants, new kinds go at the end.
+func TestErrorKindValues(t *testing.T) {
+	kinds := []ErrorKind{KindSyntax, KindUnsupportedOp, KindUnknownIdent, KindArity, KindRedeclared, KindInvalidVar, KindSystem, KindInternal, KindRecursion, KindNoDerivative}
+	for i, k := range kinds {
+		if int(k) != i {
+			t.Errorf("%v: have value %v, want %v", k, int(k), i)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package jit
+
+// this file implements printing expressions in the syntax accepted by the parser.
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Format returns the source text of an expression, with as few parentheses as possible. E.g.:
+// 	(x+1)*y^2 - -3
+// Constants are printed in the shortest form that parses back to the same value,
+// so that for any tree returned by Parse (or ParseVars), Parse(Format(e)) returns an
+// identical tree. Except for NaN payloads, which are all printed as nan.
+//
+// Trees built otherwise may have no textual form that parses back to them:
+// a LetExpr nested inside an expression (e.g. after inlining a user function)
+// is printed in parentheses, which the parser does not accept,
+// and a PowExpr is printed like x^3, which parses as a BinExpr.
+func Format(e Expr) string {
+	var p printer
+	p.print(e, precLet)
+	return p.String()
+}
+
+// FormatCanonical is like Format, but sorts the operands of commutative operators
+// (+ * == != && ||), so that expressions which differ only in their order print the same.
+// E.g., both y*x+1 and 1+x*y are printed as
+// 	1 + x*y
+// The result is suited as a cache key: it parses back to an expression with
+// the same value as e, since e.g. x+y and y+x are equal, even in IEEE arithmetic.
+func FormatCanonical(e Expr) string {
+	return Format(canonical(e))
+}
+
+// canonical returns a copy of e where the operands of commutative operators are sorted by their text.
+func canonical(e Expr) Expr {
+	return Rewrite(e, func(e Expr) Expr {
+		if b, ok := e.(BinExpr); ok && commutative(b.op) && Format(b.y) < Format(b.x) {
+			return BinExpr{op: b.op, x: b.y, y: b.x}
+		}
+		return e
+	})
+}
+
+// precedence levels for printing, higher binds tighter.
+// The binary operators have their parser precedence, in between precIf and precUnary.
+const (
+	precLet     = -1 // a := x; body
+	precIf      = 0  // c ? x : y
+	precUnary   = 6  // -x, or a negative constant
+	precPow     = 7  // x^y
+	precPrimary = 8  // number, identifier, call or parenthesized expression
+)
+
+// printer accumulates the text of an expression, see Format.
+type printer struct {
+	strings.Builder
+}
+
+// print prints e, in parentheses if it binds less tightly than minPrec.
+func (p *printer) print(e Expr, minPrec int) {
+	if prec(e) < minPrec {
+		p.WriteString("(")
+		defer p.WriteString(")")
+	}
+	switch e := e.(type) {
+	default:
+		p.WriteString("<?>") // e.g. nil
+	case Constant:
+		p.WriteString(formatConst(e.value))
+	case Variable:
+		p.WriteString(e.name)
+	case Ref:
+		p.WriteString(e.name)
+	case BinExpr:
+		p.printBinexpr(e)
+	case PowExpr:
+		p.print(e.x, precPrimary)
+		p.WriteString("^")
+		p.WriteString(strconv.Itoa(e.n))
+	case *CallExpr:
+		p.WriteString(e.fun)
+		p.WriteString("(")
+		for i, a := range e.args {
+			if i > 0 {
+				p.WriteString(", ")
+			}
+			p.print(a, precIf)
+		}
+		p.WriteString(")")
+	case IfExpr:
+		p.print(e.cond, precIf+1)
+		p.WriteString(" ? ")
+		p.print(e.x, precIf)
+		p.WriteString(" : ")
+		p.print(e.y, precIf)
+	case LetExpr:
+		p.WriteString(e.name)
+		p.WriteString(" := ")
+		p.print(e.value, precIf)
+		p.WriteString("; ")
+		p.print(e.body, precLet)
+	}
+}
+
+func (p *printer) printBinexpr(e BinExpr) {
+	switch {
+	case isUnaryMinus(e): // printed as -x
+		p.WriteString("-")
+		p.print(e.y, precUnary)
+	case e.op == "^": // right-associative, the base may not have a sign
+		p.print(e.x, precPrimary)
+		p.WriteString("^")
+		p.print(e.y, precUnary)
+	default:
+		prec := precedence[e.op]
+		p.print(e.x, prec)
+		if prec >= precedence["*"] {
+			p.WriteString(e.op)
+		} else {
+			p.WriteString(" " + e.op + " ")
+		}
+		p.print(e.y, prec+1)
+	}
+}
+
+// isUnaryMinus returns whether e is 0-x, which the parser returns for -x.
+// A negative number literal is parsed as a constant instead, so 0-3 is not printed as -3.
+func isUnaryMinus(e BinExpr) bool {
+	_, isConst := e.y.(Constant)
+	return e.op == "-" && isValue(e.x, 0) && !isConst
+}
+
+// commutative returns whether x op y == y op x for binary operator op.
+func commutative(op string) bool {
+	switch op {
+	case "+", "*", "==", "!=", "&&", "||":
+		return true
+	}
+	return false
+}
+
+// prec returns the precedence of the top-level operator of e.
+func prec(e Expr) int {
+	switch e := e.(type) {
+	case Constant:
+		if math.Signbit(e.value) && !math.IsNaN(e.value) {
+			return precUnary
+		}
+	case BinExpr:
+		switch {
+		case isUnaryMinus(e):
+			return precUnary
+		case e.op == "^":
+			return precPow
+		}
+		return precedence[e.op]
+	case PowExpr:
+		return precPow
+	case IfExpr:
+		return precIf
+	case LetExpr:
+		return precLet
+	}
+	return precPrimary
+}
+
+// formatConst returns the shortest text that parses as v.
+func formatConst(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "nan"
+	case math.IsInf(v, 1):
+		return "inf"
+	case math.IsInf(v, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,192 @@
+package jit
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"x", "x"},
+		{"((x))", "x"},
+		{"(x*x)/2.414", "x*x/2.414"},
+		{"x*(x/2)", "x*(x/2)"},
+		{"(x-y)-1", "x - y - 1"},
+		{"x-(y-1)", "x - (y - 1)"},
+		{"(x+1)*y^2", "(x + 1)*y^2"},
+		{"x^y^2", "x^y^2"},
+		{"(x^y)^2", "(x^y)^2"},
+		{"-x", "-x"},
+		{"-x^2", "-x^2"},
+		{"(-x)^2", "(-x)^2"},
+		{"(-2)^x", "(-2)^x"},
+		{"-(2^x)", "-2^x"},
+		{"x^-2", "x^-2"},
+		{"-(x+y)", "-(x + y)"},
+		{"x - -3", "x - -3"},
+		{"0-3", "0 - 3"},
+		{"x*-y", "x*-y"},
+		{"--x", "--x"},
+		{"!x", "x == 0"},
+		{"x < y && y < 1 || x == 1", "x < y && y < 1 || x == 1"},
+		{"x < (y && y)", "x < (y && y)"},
+		{"0.1", "0.1"},
+		{"1e6", "1e+06"},
+		{"1/3", "1/3"},
+		{"0.3333333333333333", "0.3333333333333333"},
+		{"pi", "3.141592653589793"},
+		{"-inf + nan", "-inf + nan"},
+		{"-0", "-0"},
+		{"atan2(y, x+1)", "atan2(y, x + 1)"},
+		{"ifelse(x, y, 1)", "x ? y : 1"},
+		{"(x ? y : 1) + 2", "(x ? y : 1) + 2"},
+		{"x ? y ? 1 : 2 : 3", "x ? y ? 1 : 2 : 3"},
+		{"(x ? y : 1) ? 2 : 3", "(x ? y : 1) ? 2 : 3"},
+		{"sin(x < 0 ? -x : x)", "sin(x < 0 ? -x : x)"},
+		{"r := x*x+y*y; s := sqrt(r); s*r", "r := x*x + y*y; s := sqrt(r); s*r"},
+	}
+	for _, test := range tests {
+		root, err := Parse(test.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := Format(root); have != test.want {
+			t.Errorf("Format %q: have %q, want %q", test.expr, have, test.want)
+		}
+	}
+}
+
+func TestFormatNotParsed(t *testing.T) {
+	x := NewVariable("x")
+	tests := []struct {
+		e    Expr
+		want string
+	}{
+		{PowExpr{x: NewBinExpr("+", x, NewConstant(1)), n: 3}, "(x + 1)^3"},
+		{NewBinExpr("*", NewLetExpr("a", x, NewRef("a")), x), "(a := x; a)*x"},
+		{nil, "<?>"},
+	}
+	for _, test := range tests {
+		if have := Format(test.e); have != test.want {
+			t.Errorf("Format %v: have %q, want %q", test.e, have, test.want)
+		}
+	}
+}
+
+// Parse(Format(e)) must return e.
+func TestFormatRoundTrip(t *testing.T) {
+	check := func(root Expr) {
+		t.Helper()
+		src := Format(root)
+		back, err := Parse(src)
+		if err != nil {
+			t.Errorf("Format(%v): %v", root, err)
+			return
+		}
+		if !sameExpr(root, back) {
+			t.Errorf("Format(%v) = %q: parses as %v", root, src, back)
+		}
+		canon := FormatCanonical(root)
+		back, err = Parse(canon)
+		if err != nil {
+			t.Errorf("FormatCanonical(%v): %v", root, err)
+			return
+		}
+		if again := FormatCanonical(back); again != canon {
+			t.Errorf("FormatCanonical(%v) = %q, but %q after parsing", root, canon, again)
+		}
+	}
+
+	for expr := range tests {
+		root, err := Parse(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(root)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		check(randomExpr(rng, 4))
+	}
+}
+
+// randomExpr returns a random tree of the given depth, of the shape returned by Parse.
+func randomExpr(rng *rand.Rand, depth int) Expr {
+	if depth == 0 || rng.Intn(4) == 0 {
+		switch rng.Intn(3) {
+		case 0:
+			return NewVariable([]string{"x", "y"}[rng.Intn(2)])
+		case 1:
+			return NewConstant([]float64{0, math.Copysign(0, -1), 1, -2, 0.1, 1e300, 5e-324, math.Inf(-1), math.NaN()}[rng.Intn(9)])
+		default:
+			v := math.Float64frombits(rng.Uint64())
+			if math.IsNaN(v) {
+				v = math.NaN() // other payloads do not survive
+			}
+			return NewConstant(v)
+		}
+	}
+	sub := func() Expr { return randomExpr(rng, depth-1) }
+	switch rng.Intn(5) {
+	case 0:
+		return NewIfExpr(sub(), sub(), sub())
+	case 1:
+		n := 1 + rng.Intn(3)
+		return NewCallExpr([]string{"", "sin", "atan2", "fma"}[n], []Expr{sub(), sub(), sub()}[:n]...)
+	case 2:
+		return NewBinExpr("-", NewConstant(0), sub()) // unary minus
+	}
+	ops := []string{"+", "-", "*", "/", "^", "==", "!=", "<", "<=", ">", ">=", "&&", "||"}
+	return NewBinExpr(ops[rng.Intn(len(ops))], sub(), sub())
+}
+
+func TestFormatCanonical(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"x+y", "y+x", true},
+		{"y*x+1", "1+x*y", true},
+		{"sin(x)*cos(y) == 2", "2 == cos(y)*sin(x)", true},
+		{"(x+y)+1", "x+(y+1)", false},
+		{"x-y", "y-x", false},
+		{"x<y", "y<x", false},
+		{"x && (y || 1)", "(1 || y) && x", true},
+	}
+	for _, test := range tests {
+		a, err := Parse(test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Parse(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ca, cb := FormatCanonical(a), FormatCanonical(b)
+		if (ca == cb) != test.same {
+			t.Errorf("FormatCanonical %q = %q, %q = %q: want same: %v", test.a, ca, test.b, cb, test.same)
+		}
+		// the canonical form is a fixed point
+		back, err := Parse(ca)
+		if err != nil {
+			t.Errorf("FormatCanonical %q = %q: %v", test.a, ca, err)
+			continue
+		}
+		if cc := FormatCanonical(back); cc != ca {
+			t.Errorf("FormatCanonical %q = %q, but %q after parsing", test.a, ca, cc)
+		}
+	}
+	root, err := Parse("y*x+1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := FormatCanonical(root), "1 + x*y"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
@@ -0,0 +1,80 @@
+package jit
+
+// this file provides the table of functions that can be called from expressions,
+// which can be extended at run time with RegisterFunc.
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// namesMu guards the global names: funcs and consts, as well as goFuncs.
+var namesMu sync.RWMutex
+
+// RegisterFunc makes the C function fn callable from expressions under the given name. E.g.:
+// 	// double besselj0(double x);
+// 	RegisterFunc("j0", unsafe.Pointer(C.besselj0), 1, true)
+// 	code, err := Compile("j0(x) * y")
+// fn must point to a C function taking arity (at most 8) double arguments and returning a double.
+// A pure function always returns the same result for the same arguments, and has no side effects.
+// Calls to pure functions with constant arguments are folded at compile time.
+// It is an error to redefine a function, to use the name of a constant,
+// or to use x or y, the variables of Compile.
+// Variables passed to CompileVars may not have the name of a function either.
+func RegisterFunc(name string, fn unsafe.Pointer, arity int, pure bool) error {
+	if fn == nil {
+		return fmt.Errorf("register %v: nil function pointer", name)
+	}
+	if arity < 0 || arity > maxArity {
+		return fmt.Errorf("register %v: arity %v out of range [0, %v]", name, arity, maxArity)
+	}
+	return register(name, builtin{ptr: fn, arity: arity, pure: pure})
+}
+
+// register adds f to the function table, under a new and valid name.
+// For Go functions, it assigns f.gofn.idx.
+func register(name string, f builtin) error {
+	if !isIdent(name) {
+		return fmt.Errorf("register %q: invalid name", name)
+	}
+	if isFixedVar(name) {
+		return fmt.Errorf("register %v: clashes with variable %v", name, name)
+	}
+	namesMu.Lock()
+	defer namesMu.Unlock()
+	if isFuncLocked(name) {
+		return fmt.Errorf("register %v: already defined", name)
+	}
+	if _, ok := consts[name]; ok {
+		return fmt.Errorf("register %v: clashes with constant %v", name, name)
+	}
+	if f.gofn != nil {
+		f.gofn.idx = len(goFuncs)
+		goFuncs = append(goFuncs, f.gofn)
+	}
+	funcs[name] = f
+	return nil
+}
+
+// lookupFunc returns the named function, if defined.
+func lookupFunc(name string) (builtin, bool) {
+	namesMu.RLock()
+	defer namesMu.RUnlock()
+	f, ok := funcs[name]
+	return f, ok
+}
+
+// isFunc returns whether name can be called like a function:
+// a builtin, or a special form like select.
+func isFunc(name string) bool {
+	namesMu.RLock()
+	defer namesMu.RUnlock()
+	return isFuncLocked(name)
+}
+
+// isFuncLocked is like isFunc, for callers already holding namesMu.
+func isFuncLocked(name string) bool {
+	_, ok := funcs[name]
+	return ok || name == "select" || name == "ifelse"
+}
@@ -0,0 +1,126 @@
+package jit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func TestRegisterFunc(t *testing.T) {
+	hypot, _ := lookupFunc("hypot")
+	norm := uniqueName("norm_test")
+	if err := RegisterFunc(norm, hypot.ptr, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	code, err := Compile(norm + "(x, y) + 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	if have, want := code.Eval(3, 4), 6.0; have != want {
+		t.Errorf("%v(x, y) + 1: have %v, want %v", norm, have, want)
+	}
+
+	if _, err := CompileVars(norm, norm); err == nil {
+		t.Errorf("variable clashing with function: expected error")
+	}
+	if err := DefineConst(norm, 1); err == nil {
+		t.Errorf("constant clashing with function: expected error")
+	}
+	if _, err := Compile("r := 1; " + norm + " := 2; r"); err == nil {
+		t.Errorf("local binding clashing with function: expected error")
+	}
+}
+
+func TestRegisterFuncPure(t *testing.T) {
+	cos, _ := lookupFunc("cos")
+	pure, impure := uniqueName("pure_test"), uniqueName("impure_test")
+	if err := RegisterFunc(pure, cos.ptr, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterFunc(impure, cos.ptr, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{pure + "(0)+x", "(1+x)"},
+		{impure + "(0)+x", "(" + impure + "(0)+x)"},
+		{impure + "(1-1)", impure + "(0)"},
+	}
+	for _, test := range tests {
+		root, err := Parse(test.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := fmt.Sprint(FoldConst(root)); have != test.want {
+			t.Errorf("FoldConst %q: have %v, want %v", test.expr, have, test.want)
+		}
+	}
+
+	code, err := Compile(impure + "(0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	if have := code.Eval(0, 0); have != 1 {
+		t.Errorf("%v(0): have %v, want 1", impure, have)
+	}
+}
+
+func TestRegisterFuncErrors(t *testing.T) {
+	sin, _ := lookupFunc("sin")
+	tests := []struct {
+		name  string
+		fn    unsafe.Pointer
+		arity int
+	}{
+		{"sin", sin.ptr, 1},
+		{"ifelse", sin.ptr, 3},
+		{"select", sin.ptr, 3},
+		{"pi", sin.ptr, 1},
+		{"x", sin.ptr, 1},
+		{"y", sin.ptr, 1},
+		{"", sin.ptr, 1},
+		{"1f", sin.ptr, 1},
+		{"a.b", sin.ptr, 1},
+		{"nil_test", nil, 1},
+		{"arity_test", sin.ptr, -1},
+		{"arity_test", sin.ptr, maxArity + 1},
+	}
+	for _, test := range tests {
+		if err := RegisterFunc(test.name, test.fn, test.arity, true); err == nil {
+			t.Errorf("RegisterFunc %q, arity %v: expected error", test.name, test.arity)
+		}
+	}
+}
+
+func TestRegisterFuncConcurrent(t *testing.T) {
+	exp, _ := lookupFunc("exp")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := uniqueName("exp_test")
+			if err := RegisterFunc(name, exp.ptr, 1, true); err != nil {
+				t.Error(err)
+				return
+			}
+			code, err := Compile(name + "(x)")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer code.Free()
+			if have, want := code.Eval(1, 0), math.E; have != want {
+				t.Errorf("%v(1): have %v, want %v", name, have, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,57 @@
+package jit
+
+// this file allows Go functions to be called from generated code,
+// through the C function go_call, which calls back into Go.
+
+//#include "shim.h"
+import "C"
+
+import "fmt"
+
+// gofunc is a Go function that can be called from expressions.
+type gofunc struct {
+	idx int                        // index in goFuncs, passed to go_call
+	fn  func(x, y float64) float64 // one-argument functions ignore y
+}
+
+// goFuncs holds all registered Go functions, guarded by namesMu.
+var goFuncs []*gofunc
+
+// RegisterGoFunc makes the Go function fn callable from expressions under the given name. E.g.:
+// 	RegisterGoFunc("damping", func(x float64) float64 { return math.Exp(-x/tau) }, true)
+// 	code, err := Compile("damping(x) * sin(y)")
+// Calling a Go function from generated code is much slower than calling a C function
+// (see RegisterFunc), and fn must not panic.
+// For the meaning of pure and the restrictions on the name, see RegisterFunc.
+func RegisterGoFunc(name string, fn func(float64) float64, pure bool) error {
+	if fn == nil {
+		return fmt.Errorf("register %v: nil function", name)
+	}
+	f := func(x, _ float64) float64 { return fn(x) }
+	return register(name, builtin{ptr: C.func_go_call, arity: 1, pure: pure, gofn: &gofunc{fn: f}})
+}
+
+// RegisterGoFunc2 is like RegisterGoFunc, for functions of two arguments.
+func RegisterGoFunc2(name string, fn func(float64, float64) float64, pure bool) error {
+	if fn == nil {
+		return fmt.Errorf("register %v: nil function", name)
+	}
+	return register(name, builtin{ptr: C.func_go_call, arity: 2, pure: pure, gofn: &gofunc{fn: fn}})
+}
+
+// call calls the function with the given arguments, used for constant folding.
+func (f *gofunc) call(args []float64) float64 {
+	var a [2]float64
+	copy(a[:], args)
+	return f.fn(a[0], a[1])
+}
+
+// goCallback is called by go_call, with the arguments passed by the generated code.
+//
+//export goCallback
+func goCallback(idx C.int64_t, x, y C.double) C.double {
+	namesMu.RLock()
+	f := goFuncs[idx]
+	namesMu.RUnlock()
+	return C.double(f.fn(float64(x), float64(y)))
+}
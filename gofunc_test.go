@@ -0,0 +1,106 @@
+package jit
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestRegisterGoFunc(t *testing.T) {
+	const tau = 3
+	damping := func(x float64) float64 { return math.Exp(-x / tau) }
+	damp, lerp := uniqueName("damping_test"), uniqueName("lerp_test")
+	if err := RegisterGoFunc(damp, damping, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterGoFunc2(lerp, func(x, y float64) float64 { return 0.25*x + 0.75*y }, true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func(x, y float64) float64{
+		"damping_test(x)":                     func(x, y float64) float64 { return damping(x) },
+		"damping_test(x) * sin(y)":            func(x, y float64) float64 { return damping(x) * math.Sin(y) },
+		"lerp_test(x, y)":                     func(x, y float64) float64 { return 0.25*x + 0.75*y },
+		"lerp_test(y, x)":                     func(x, y float64) float64 { return 0.25*y + 0.75*x },
+		"1 + lerp_test(damping_test(y), x*2)": func(x, y float64) float64 { return 1 + (0.25*damping(y) + 0.75*(x*2)) },
+		"lerp_test(x, 1) / damping_test(y) + fma(x, damping_test(x), y)": func(x, y float64) float64 {
+			return (0.25*x+0.75)/damping(y) + math.FMA(x, damping(x), y)
+		},
+	}
+	names := strings.NewReplacer("damping_test", damp, "lerp_test", lerp)
+	for expr, want := range tests {
+		expr := names.Replace(expr)
+		for _, useRegisters = range []bool{true, false} {
+			code, err := Compile(expr)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			for _, x := range []float64{-1, 0, 2.5} {
+				for _, y := range []float64{-3, 0, 1} {
+					if have, want := code.Eval(x, y), want(x, y); have != want {
+						t.Errorf("%v (x=%v, y=%v): have %v, want %v", expr, x, y, have, want)
+					}
+				}
+			}
+			code.Free()
+		}
+	}
+	useRegisters = true
+}
+
+func TestRegisterGoFuncPure(t *testing.T) {
+	calls := 0
+	count := func(x float64) float64 { calls++; return x }
+	pure, impure := uniqueName("pure_go_test"), uniqueName("impure_go_test")
+	if err := RegisterGoFunc(pure, count, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterGoFunc(impure, count, false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{pure + "(2)+x", "(2+x)"},
+		{impure + "(2)+x", "(" + impure + "(2)+x)"},
+	}
+	for _, test := range tests {
+		root, err := Parse(test.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := fmt.Sprint(FoldConst(root)); have != test.want {
+			t.Errorf("FoldConst %q: have %v, want %v", test.expr, have, test.want)
+		}
+	}
+
+	code, err := Compile(impure + "(1) + " + impure + "(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	calls = 0
+	code.Eval(1, 0)
+	if calls != 2 {
+		t.Errorf("%v: have %v calls, want 2", impure, calls)
+	}
+}
+
+func TestRegisterGoFuncErrors(t *testing.T) {
+	id := func(x float64) float64 { return x }
+	for _, name := range []string{"sin", "pi", "x", "y", "select", "ifelse", "", "1x"} {
+		if err := RegisterGoFunc(name, id, true); err == nil {
+			t.Errorf("RegisterGoFunc %q: expected error", name)
+		}
+	}
+	if err := RegisterGoFunc("nil_go_test", nil, true); err == nil {
+		t.Errorf("RegisterGoFunc nil: expected error")
+	}
+	if err := RegisterGoFunc2("nil_go_test", nil, true); err == nil {
+		t.Errorf("RegisterGoFunc2 nil: expected error")
+	}
+}
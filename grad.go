@@ -0,0 +1,227 @@
+package jit
+
+// This file implements reverse-mode (adjoint) automatic differentiation.
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// GradCode is JIT compiled machine code that evaluates an expression together with its gradient.
+type GradCode struct {
+	instr []byte
+	nvars int // number of variables expected by the code
+}
+
+// CompileGrad compiles an expression of the given variables, like CompileVars,
+// into code that evaluates its value and its gradient with respect to all variables in one call.
+// The cost of the gradient is a small multiple of the cost of the value,
+// independent of the number of variables.
+// If no longer needed, the returned code must be explicitly freed with Free().
+//
+// Functions without a known derivative, like those registered with RegisterFunc,
+// cause a *CompileError of kind KindNoDerivative.
+func CompileGrad(ex string, vars ...string) (c *GradCode, e error) {
+	defer func() {
+		if err := recover(); err != nil {
+			c, e = nil, compileError(ex, err)
+		}
+	}()
+
+	if err := checkVars(vars); err != nil {
+		return nil, &CompileError{Expr: ex, Kind: KindInvalidVar, Msg: err.Error(), Err: err}
+	}
+	root, defs, err := parse(ex, vars, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	root = optimizeAST(newInliner(defs, vars, true).expand(root))
+	if err := checkDerivatives(root); err != nil {
+		return nil, compileError(ex, err)
+	}
+
+	instr, err := MakeExecutable(assembleGrad(root, vars))
+	if err != nil {
+		return nil, &CompileError{Expr: ex, Kind: KindSystem, Msg: err.Error(), Err: err}
+	}
+	return &GradCode{instr: instr, nvars: len(vars)}, nil
+}
+
+// Eval evaluates the code, passing values for all variables,
+// in the order they were passed to CompileGrad.
+// It stores the gradient, the derivatives with respect to each variable, in grad,
+// and returns the value.
+func (c *GradCode) Eval(args, grad []float64) float64 {
+	if len(c.instr) == 0 {
+		panic("eval called on nil code")
+	}
+	if len(args) != c.nvars || len(grad) != c.nvars {
+		panic(fmt.Sprintf("eval: need %v arguments and gradients, have %v, %v", c.nvars, len(args), len(grad)))
+	}
+	return evalGrad(c.instr, args, grad)
+}
+
+// Free unmaps the code, after which Eval cannot be called anymore.
+func (c *GradCode) Free() {
+	unix.Munmap(c.instr)
+	c.instr = nil
+}
+
+// tape is the sequence of operations that evaluate an expression,
+// in the order used by compileExpr, recorded for reverse-mode differentiation.
+//
+// The value of each operation is kept in its own slot on the stack, the variables occupy the first slots.
+// The forward sweep evaluates the operations in order, the backward sweep
+// runs over them in reverse and accumulates the adjoint of each slot: the derivative of the result with respect to it.
+// E.g. for an operation c = a*b, the adjoint of c is added to those of a and b as
+// 	ā += c̄ * b
+// 	b̄ += c̄ * a
+// where the partial derivatives (b and a) follow from the same rules as Derivative.
+type tape struct {
+	*buf
+	ops    []tapeOp
+	nslots int
+	bound  map[string]Expr // local bindings -> their operand
+}
+
+// tapeOp is an operation on the tape, storing its value in slot.
+// The operands are references to slots, or constants.
+type tapeOp struct {
+	slot int
+	args []Expr
+	rule func(a, da []Expr) (v, dv Expr) // see derivRule
+}
+
+// slotName returns the name of the local binding holding the value of slot s.
+// Its adjoint is bound to derivName(slotName(s)).
+func slotName(s int) string {
+	return fmt.Sprint("#", s)
+}
+
+// assembleGrad returns the machine code evaluating root and its gradient:
+// 	double f(double *vars, double *grad);
+func assembleGrad(root Expr, vars []string) []byte {
+	t := &tape{buf: newBuf(root, vars, nil), nslots: len(vars), bound: make(map[string]Expr)}
+	result := t.record(root)
+
+	// stack frame: saved rbx, pointer to grad, the values and adjoints of all slots.
+	n := t.nslots
+	t.frame = 16 + 16*int32(n)
+	valueOff := func(s int) int32 { return -(24 + 8*int32(s)) }
+	adjointOff := func(s int) int32 { return valueOff(n + s) }
+	for s := 0; s < n; s++ {
+		t.locals[slotName(s)] = local{reg: -1, off: valueOff(s)}
+		t.locals[derivName(slotName(s))] = local{reg: -1, off: adjointOff(s)}
+	}
+
+	t.emit(push_rbp, mov_rsp_rbp, push_rbx, sub_rsp(uint32(t.frame-8)))
+	t.emit(mov_rdi_rbx, mov_rsi_x_rbp(-16))
+	for i := range vars {
+		t.emit(mov_x_rbx_xmm(int32(8*i), 0), mov_xmm_x_rbp(0, valueOff(i)))
+	}
+
+	// forward sweep
+	for _, o := range t.ops {
+		v, _ := o.rule(o.args, unitVector(len(o.args), -1))
+		t.compileOp(v)
+		t.emit(mov_xmm_x_rbp(0, valueOff(o.slot)))
+	}
+
+	// backward sweep: all adjoints start at zero, except that of the result.
+	t.emit(xor_xmm1_xmm1)
+	for s := 0; s < n; s++ {
+		t.emit(mov_xmm_x_rbp(1, adjointOff(s)))
+	}
+	if r, ok := result.(Ref); ok {
+		t.compileConstant(Constant{1})
+		t.emit(mov_xmm_x_rbp(0, t.locals[derivName(r.name)].off))
+	}
+	for k := len(t.ops) - 1; k >= 0; k-- {
+		o := t.ops[k]
+		adjoint := Ref{name: derivName(slotName(o.slot))}
+		for j, a := range o.args {
+			a, ok := a.(Ref)
+			if !ok {
+				continue
+			}
+			// partial derivative with respect to operand j
+			_, partial := o.rule(o.args, unitVector(len(o.args), j))
+			partial = simplify(FoldConst(partial))
+			if isZero(partial) {
+				continue
+			}
+			aAdjoint := Ref{name: derivName(a.name)}
+			t.compileOp(simplify(add(aAdjoint, mul(adjoint, partial))))
+			t.emit(mov_xmm_x_rbp(0, t.locals[aAdjoint.name].off))
+		}
+	}
+
+	// store the adjoints of the variables in grad.
+	t.emit(mov_x_rbp_rbx(-16))
+	for i := range vars {
+		t.emit(mov_x_rbp_xmm(adjointOff(i), 0), mov_xmm_x_rbx(0, int32(8*i)))
+	}
+	t.compileOp(result)
+	t.emit(add_rsp(uint32(t.frame-8)), pop_rbx, pop_rbp, ret)
+	return t.Bytes()
+}
+
+// unitVector returns n constants, all 0 except the j'th, which is 1.
+func unitVector(n, j int) []Expr {
+	u := make([]Expr, n)
+	for i := range u {
+		u[i] = num(0)
+	}
+	if j >= 0 {
+		u[j] = num(1)
+	}
+	return u
+}
+
+// record adds the operations evaluating e to the tape,
+// and returns the operand holding its value: a reference to a slot, or a constant.
+func (t *tape) record(e Expr) Expr {
+	switch e := e.(type) {
+	case Constant:
+		return e
+	case Variable:
+		i, ok := t.vars[e.name]
+		if !ok {
+			panic("undefined variable:" + e.name)
+		}
+		return Ref{name: slotName(i)}
+	case Ref:
+		return t.bound[e.name]
+	case LetExpr:
+		t.bound[e.name] = t.record(e.value)
+		return t.record(e.body)
+	}
+
+	args, rule := derivRule(e)
+	a := make([]Expr, len(args))
+	if b, ok := e.(BinExpr); ok {
+		if first, _ := t.order(b); first == b.x {
+			a[0] = t.record(b.x)
+			a[1] = t.record(b.y)
+		} else {
+			a[1] = t.record(b.y)
+			a[0] = t.record(b.x)
+		}
+	} else {
+		for i := range args {
+			a[i] = t.record(args[i])
+		}
+	}
+	t.ops = append(t.ops, tapeOp{slot: t.nslots, args: a, rule: rule})
+	t.nslots++
+	return Ref{name: slotName(t.nslots - 1)}
+}
+
+// compileOp emits normal code for e, an expression of slots, leaving the result in xmm0.
+func (t *tape) compileOp(e Expr) {
+	e = expandPow(e)
+	recordCalls(e, t.hasCall)
+	recordDepth(e, t.callDepth)
+	t.compileExpr(e)
+}
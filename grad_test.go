@@ -0,0 +1,136 @@
+package jit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// CompileGrad must agree with the symbolic derivatives, and return exactly the same value as Eval.
+func TestCompileGrad(t *testing.T) {
+	for _, ex := range gradientTests {
+		c, err := CompileGrad(ex, "x", "y")
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := CompileGradient(ex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range gradientPoints {
+			x, y := p[0], p[1]
+			grad := make([]float64, 2)
+			v := c.Eval([]float64{x, y}, grad)
+			f, dfdx, dfdy := g.Eval(x, y)
+			if v != f || !approx(grad[0], dfdx) || !approx(grad[1], dfdy) {
+				t.Errorf("%q at (%v, %v): have %v, %v, want %v, %v", ex, x, y, v, grad, f, []float64{dfdx, dfdy})
+			}
+		}
+		c.Free()
+		g.Free()
+	}
+}
+
+func TestCompileGradMany(t *testing.T) {
+	// sum of a_i * a_(i+1), with dozens of variables
+	const n = 40
+	var vars, terms []string
+	for i := 0; i < n; i++ {
+		vars = append(vars, fmt.Sprint("a", i))
+	}
+	for i := 0; i < n-1; i++ {
+		terms = append(terms, fmt.Sprintf("a%v*sin(a%v)", i, i+1))
+	}
+	c, err := CompileGrad("s := "+strings.Join(terms, "+")+"; s*s", vars...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Free()
+
+	args := make([]float64, n)
+	for i := range args {
+		args[i] = float64(i%7) / 3
+	}
+	s := 0.
+	for i := 0; i < n-1; i++ {
+		s += args[i] * math.Sin(args[i+1])
+	}
+	grad := make([]float64, n)
+	if v := c.Eval(args, grad); !approx(v, s*s) {
+		t.Errorf("value: have %v, want %v", v, s*s)
+	}
+	for i := range args {
+		ds := 0. // ∂s/∂a_i
+		if i < n-1 {
+			ds += math.Sin(args[i+1])
+		}
+		if i > 0 {
+			ds += args[i-1] * math.Cos(args[i])
+		}
+		if want := 2 * s * ds; !approx(grad[i], want) {
+			t.Errorf("∂/∂a%v: have %v, want %v", i, grad[i], want)
+		}
+	}
+}
+
+func TestCompileGradUserFuncs(t *testing.T) {
+	c, err := CompileGrad(bigDef+"; big(u, v) * w + (w > 1)", "u", "v", "w", "unused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Free()
+	u, v, w := 0.7, 1.3, 2.1
+	grad := make([]float64, 4)
+	c.Eval([]float64{u, v, w, 5}, grad)
+	const h = 1e-6
+	want := []float64{
+		(big(u+h, v) - big(u-h, v)) / (2 * h) * w,
+		(big(u, v+h) - big(u, v-h)) / (2 * h) * w,
+		big(u, v),
+		0,
+	}
+	for i := range want {
+		if !approx(grad[i], want[i]) {
+			t.Errorf("have %v, want %v", grad, want)
+			break
+		}
+	}
+}
+
+func TestCompileGradErrors(t *testing.T) {
+	name := uniqueName("nograd_test")
+	if err := RegisterGoFunc(name, func(x float64) float64 { return x }, true); err != nil {
+		t.Fatal(err)
+	}
+	var cerr *CompileError
+	if _, err := CompileGrad(name+"(x)", "x"); !errors.As(err, &cerr) || cerr.Kind != KindNoDerivative {
+		t.Errorf("have %v, want KindNoDerivative", err)
+	}
+	if _, err := CompileGrad("x", "x", "x"); !errors.As(err, &cerr) || cerr.Kind != KindInvalidVar {
+		t.Errorf("have %v, want KindInvalidVar", err)
+	}
+	var perr *ParseError
+	if _, err := CompileGrad("x+", "x"); !errors.As(err, &perr) {
+		t.Errorf("have %v, want *ParseError", err)
+	}
+}
+
+func TestCompileGradTrivial(t *testing.T) {
+	for ex, want := range map[string][3]float64{
+		"3":   {3, 0, 0},
+		"y":   {2, 0, 1},
+		"x+x": {2, 2, 0},
+	} {
+		c, err := CompileGrad(ex, "x", "y")
+		if err != nil {
+			t.Fatal(err)
+		}
+		grad := make([]float64, 2)
+		if v := c.Eval([]float64{1, 2}, grad); v != want[0] || grad[0] != want[1] || grad[1] != want[2] {
+			t.Errorf("%q: have %v, %v, want %v", ex, v, grad, want)
+		}
+		c.Free()
+	}
+}
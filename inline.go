@@ -0,0 +1,86 @@
+package jit
+
+// this file implements builtin functions with inline SSE instructions,
+// avoiding the overhead of a call, and allowing registers to be used across them.
+
+import (
+	"fmt"
+	"math"
+
+	"golang.org/x/sys/cpu"
+)
+
+// hasSSE41 tells whether the CPU supports roundsd.
+var hasSSE41 = cpu.X86.HasSSE41
+
+// inlined returns whether calls to function fun are compiled inline,
+// rather than calling the C function.
+func inlined(fun string) bool {
+	if !useInlining {
+		return false
+	}
+	switch fun {
+	case "sqrt", "fabs", "min", "max":
+		return true
+	case "floor", "ceil", "round", "trunc":
+		return hasSSE41
+	}
+	return false
+}
+
+// compileInline emits inline code for function fun,
+// with the arguments already in xmm0 (and xmm1), leaving the result in xmm0.
+// The results are identical to those of the C functions,
+// except that min(-0, 0) and max(-0, 0) may return either zero.
+func (b *buf) compileInline(fun string) {
+	switch fun {
+	default:
+		panic(fmt.Sprintf("compileInline %v", fun))
+	case "sqrt":
+		b.emit(sqrt_xmm0)
+	case "fabs": // clear the sign bit
+		b.emit(mov_uint_rax(math.MaxInt64), mov_rax_xmm1, and_xmm1_xmm0)
+	case "floor":
+		b.emit(round_xmm0(round_floor))
+	case "ceil":
+		b.emit(round_xmm0(round_ceil))
+	case "trunc":
+		b.emit(round_xmm0(round_trunc))
+	case "round":
+		b.compileRound()
+	case "min":
+		b.compileMinMax(min_xmm0_xmm1)
+	case "max":
+		b.compileMinMax(max_xmm0_xmm1)
+	}
+}
+
+// compileRound emits code for C's round(x), which rounds half-way cases away from zero,
+// unlike any of the roundsd modes. We use
+// 	round(x) = trunc(x + copysign(0.49999999999999994, x))
+// where adding the largest double below 0.5 (rather than 0.5)
+// avoids rounding up x = 0.49999999999999994.
+func (b *buf) compileRound() {
+	b.emit(mov_xmm0_rax)
+	b.emit(mov_uint_rcx(1<<63), and_rcx_rax) // sign of x
+	b.emit(mov_uint_rcx(math.Float64bits(0.49999999999999994)), or_rcx_rax)
+	b.emit(mov_rax_xmm1, add_xmm1_xmm0)
+	b.emit(round_xmm0(round_trunc))
+}
+
+// compileMinMax emits code for C's fmin(x, y) or fmax(x, y),
+// given the minsd (or maxsd) instruction op %xmm0,%xmm1.
+//
+// minsd returns its second operand if either one is NaN,
+// while fmin returns the other operand if one of them is NaN.
+// t = minsd(y, x) is therefore correct, unless x is NaN,
+// in which case we select y instead:
+// 	t ^ (isNaN(x) & (y ^ t))
+func (b *buf) compileMinMax(op_xmm0_xmm1 []byte) {
+	b.emit(mov_xmm1_rax)                // y aside
+	b.emit(op_xmm0_xmm1)                // t = op(y, x) -> xmm1
+	b.emit(cmpsd(cmp_unord, 0, 0))      // isNaN(x) -> xmm0
+	b.emit(mov_xmm1_rcx, xor_rcx_rax)   // t -> rcx, y^t -> rax
+	b.emit(mov_rax_xmm1, and_xmm1_xmm0) // isNaN(x) & (y^t) -> xmm0
+	b.emit(mov_rcx_xmm1, xor_xmm1_xmm0) // t ^ ... -> xmm0
+}
@@ -0,0 +1,620 @@
+// Interval arithmetic, see EvalInterval.
+//
+// Each value is an interval [lo, hi], which holds all results of an expression
+// over a range of its variables, plus a flag for whether the result may be NaN.
+// An empty interval (lo > hi) is NaN everywhere.
+//
+// The bounds of + - * / and sqrt are computed with the rounding mode
+// set to down or up in MXCSR, so that they enclose the result rounded to nearest.
+// The math library is called with the default rounding, and its results,
+// which are not correctly rounded, are widened by a few ulps.
+
+#include <math.h>
+#include <xmmintrin.h>
+#include "shim.h"
+
+// ULPS is by how many ulps the results of the math library are widened.
+// It must be at least twice the error of the library, which is at most a few ulps (e.g. for glibc),
+// so that the bounds hold for both the exact function and the library's result.
+#define ULPS 8
+
+// OPAQUE hides the value of x from the compiler, so that computations on it
+// are not moved across changes of the rounding mode, nor merged.
+#define OPAQUE(x) __asm__ volatile("" : "+x"(x))
+
+static void set_rounding(unsigned int mode) {
+	_mm_setcsr((_mm_getcsr() & ~_MM_ROUND_MASK) | mode);
+}
+
+// DIRECTED defines the function name(a, b), returning expr rounded with the given mode.
+#define DIRECTED(name, mode, expr)         \
+	static double name(double a, double b) { \
+		double r;                            \
+		set_rounding(mode);                  \
+		OPAQUE(a);                           \
+		OPAQUE(b);                           \
+		r = expr;                            \
+		OPAQUE(r);                           \
+		set_rounding(_MM_ROUND_NEAREST);     \
+		return r;                            \
+	}
+
+DIRECTED(add_down, _MM_ROUND_DOWN, a + b)
+DIRECTED(add_up, _MM_ROUND_UP, a + b)
+DIRECTED(sub_down, _MM_ROUND_DOWN, a - b)
+DIRECTED(sub_up, _MM_ROUND_UP, a - b)
+DIRECTED(mul_down, _MM_ROUND_DOWN, a * b)
+DIRECTED(mul_up, _MM_ROUND_UP, a * b)
+DIRECTED(div_down, _MM_ROUND_DOWN, a / b)
+DIRECTED(div_up, _MM_ROUND_UP, a / b)
+
+// sqrt_rounded returns sqrt(a) rounded with the given mode, for a >= 0.
+static double sqrt_rounded(double a, unsigned int mode) {
+	double r;
+	set_rounding(mode);
+	OPAQUE(a);
+	r = sqrt(a);
+	OPAQUE(r);
+	set_rounding(_MM_ROUND_NEAREST);
+	return r;
+}
+
+// down and up widen a result of the math library.
+static double down(double v) {
+	int i;
+	for(i=0; i<ULPS; i++){
+		v = nextafter(v, -INFINITY);
+	}
+	return v;
+}
+
+static double up(double v) {
+	int i;
+	for(i=0; i<ULPS; i++){
+		v = nextafter(v, INFINITY);
+	}
+	return v;
+}
+
+static const interval empty = {INFINITY, -INFINITY, 1};
+
+static int is_empty(interval x) {
+	return !(x.lo <= x.hi);
+}
+
+static int contains(interval x, double v) {
+	return x.lo <= v && v <= x.hi;
+}
+
+// make returns [lo, hi]. A NaN bound, e.g. from inf-inf,
+// means that the bound is unknown and NaN is possible.
+static interval make(double lo, double hi, int nan) {
+	interval r = {lo, hi, nan};
+	if(isnan(lo)){
+		r.lo = -INFINITY;
+		r.nan = 1;
+	}
+	if(isnan(hi)){
+		r.hi = INFINITY;
+		r.nan = 1;
+	}
+	return r;
+}
+
+static interval point(double v) {
+	if(isnan(v)){
+		return empty;
+	}
+	return make(v, v, 0);
+}
+
+// hull returns the smallest interval holding x and y.
+static interval hull(interval x, interval y) {
+	interval r = {fmin(x.lo, y.lo), fmax(x.hi, y.hi), x.nan || y.nan};
+	return r;
+}
+
+static interval neg(interval x) {
+	interval r = {-x.hi, -x.lo, x.nan};
+	return r;
+}
+
+// clamp narrows x to the range [lo, hi] of a function, undoing the widening of its bounds.
+static interval clamp(interval x, double lo, double hi) {
+	if(!is_empty(x)){
+		x.lo = fmax(x.lo, lo);
+		x.hi = fmin(x.hi, hi);
+	}
+	return x;
+}
+
+// domain returns the part of x within the domain [lo, hi] of a function,
+// which returns NaN for the rest.
+static interval domain(interval x, double lo, double hi) {
+	interval r = x;
+	if(is_empty(x)){
+		return empty;
+	}
+	if(x.lo < lo){
+		r.lo = lo;
+		r.nan = 1;
+	}
+	if(x.hi > hi){
+		r.hi = hi;
+		r.nan = 1;
+	}
+	if(is_empty(r)){
+		return empty;
+	}
+	return r;
+}
+
+// increasing returns f(x) for a non-decreasing function f from the math library.
+static interval increasing(double (*f)(double), interval x) {
+	if(is_empty(x)){
+		return empty;
+	}
+	return make(down(f(x.lo)), up(f(x.hi)), x.nan);
+}
+
+// exact returns f(x) for a non-decreasing function f without rounding errors, like floor.
+static interval exact(double (*f)(double), interval x) {
+	if(is_empty(x)){
+		return empty;
+	}
+	return make(f(x.lo), f(x.hi), x.nan);
+}
+
+static interval iv_add(interval x, interval y) {
+	if(is_empty(x) || is_empty(y)){
+		return empty;
+	}
+	return make(add_down(x.lo, y.lo), add_up(x.hi, y.hi), x.nan || y.nan);
+}
+
+static interval iv_sub(interval x, interval y) {
+	if(is_empty(x) || is_empty(y)){
+		return empty;
+	}
+	return make(sub_down(x.lo, y.hi), sub_up(x.hi, y.lo), x.nan || y.nan);
+}
+
+// iv_mul returns the hull of the products of the bounds.
+static interval iv_mul(interval x, interval y) {
+	double a[2] = {x.lo, x.hi}, b[2] = {y.lo, y.hi};
+	double lo = INFINITY, hi = -INFINITY;
+	int nan = x.nan || y.nan;
+	int i, j;
+	if(is_empty(x) || is_empty(y)){
+		return empty;
+	}
+	for(i=0; i<2; i++){
+		for(j=0; j<2; j++){
+			if((a[i] == 0 && isinf(b[j])) || (isinf(a[i]) && b[j] == 0)){
+				// 0*inf is NaN, but the products of the nearby numbers are near 0
+				nan = 1;
+				lo = fmin(lo, 0);
+				hi = fmax(hi, 0);
+			} else {
+				lo = fmin(lo, mul_down(a[i], b[j]));
+				hi = fmax(hi, mul_up(a[i], b[j]));
+			}
+		}
+	}
+	return make(lo, hi, nan);
+}
+
+// iv_div returns the hull of the quotients of the bounds, if y does not hold 0.
+static interval iv_div(interval x, interval y) {
+	double a[2] = {x.lo, x.hi}, b[2] = {y.lo, y.hi};
+	double lo = INFINITY, hi = -INFINITY, q;
+	int nan = x.nan || y.nan;
+	int i, j;
+	if(is_empty(x) || is_empty(y)){
+		return empty;
+	}
+	if(contains(y, 0)){
+		// x/0 is inf or -inf, depending on the sign of the zero, and 0/0 is NaN
+		nan = nan || contains(x, 0) || ((isinf(x.lo) || isinf(x.hi)) && (isinf(y.lo) || isinf(y.hi)));
+		return make(-INFINITY, INFINITY, nan);
+	}
+	for(i=0; i<2; i++){
+		for(j=0; j<2; j++){
+			q = div_down(a[i], b[j]);
+			lo = isnan(q) ? -INFINITY : fmin(lo, q); // inf/inf
+			q = div_up(a[i], b[j]);
+			hi = isnan(q) ? INFINITY : fmax(hi, q);
+			nan = nan || isnan(q);
+		}
+	}
+	return make(lo, hi, nan);
+}
+
+// powi returns x^n for x >= 0, computed like the generated code does (see compilePowexpr),
+// but rounding each product with mul, so that the bound holds for the rounded result too.
+static double powi(double x, int n, double (*mul)(double, double)) {
+	double acc = 1;
+	int have = 0;
+	for(; n > 0; n >>= 1){
+		if(n & 1){
+			acc = have ? mul(acc, x) : x;
+			have = 1;
+		}
+		if(n > 1){
+			x = mul(x, x);
+		}
+	}
+	return acc;
+}
+
+static interval iv_fabs(interval x) {
+	if(is_empty(x)){
+		return empty;
+	}
+	if(x.hi <= 0){
+		return neg(x);
+	}
+	if(x.lo < 0){
+		x.hi = fmax(-x.lo, x.hi);
+		x.lo = 0;
+	}
+	return x;
+}
+
+// iv_powi returns x^n, for an integer n > 0.
+static interval iv_powi(interval x, int n) {
+	double lo, hi;
+	if(is_empty(x)){
+		return empty;
+	}
+	if(n % 2 == 0){
+		x = iv_fabs(x);
+		return make(powi(x.lo, n, mul_down), powi(x.hi, n, mul_up), x.nan);
+	}
+	lo = x.lo >= 0 ? powi(x.lo, n, mul_down) : -powi(-x.lo, n, mul_up);
+	hi = x.hi >= 0 ? powi(x.hi, n, mul_up) : -powi(-x.hi, n, mul_down);
+	return make(lo, hi, x.nan);
+}
+
+// has_int returns whether [lo, hi] holds an integer, which must be odd if parity is 1,
+// even if parity is 0, or either if parity is -1.
+static int has_int(double lo, double hi, int parity) {
+	double k = ceil(lo);
+	if(!(k <= hi)){
+		return 0;
+	}
+	if(isinf(k)){
+		return k < 0 && hi > k;
+	}
+	if(parity < 0 || fabs(fmod(k, 2)) == parity){
+		return 1;
+	}
+	return k + 1 <= hi;
+}
+
+// has_fraction returns whether [lo, hi] holds a finite number that is not an integer.
+static int has_fraction(double lo, double hi) {
+	return lo < hi || (isfinite(lo) && lo != floor(lo));
+}
+
+// pow_corners returns pow(x, y) for x in [a, b], with 0 <= a <= b.
+// pow(x, y) = exp(y*log(x)), where y*log(x) takes its extremes at the corners.
+static interval pow_corners(double a, double b, interval y) {
+	double xs[2] = {a, b}, ys[2] = {y.lo, y.hi};
+	double lo = INFINITY, hi = -INFINITY, p;
+	int i, j;
+	for(i=0; i<2; i++){
+		for(j=0; j<2; j++){
+			p = pow(xs[i], ys[j]);
+			lo = fmin(lo, down(p));
+			hi = fmax(hi, up(p));
+		}
+	}
+	return make(fmax(lo, 0), hi, 0);
+}
+
+// iv_pow returns pow(x, y), following the special cases of C's pow.
+static interval iv_pow(interval x, interval y) {
+	interval r = empty, m;
+	int nan = x.nan || y.nan;
+	if(x.nan && contains(y, 0)){
+		r = hull(r, point(1)); // pow(NaN, 0) = 1
+	}
+	if(y.nan && contains(x, 1)){
+		r = hull(r, point(1)); // pow(1, NaN) = 1
+	}
+	if(is_empty(x) || is_empty(y)){
+		r.nan = nan;
+		return r;
+	}
+	if(x.hi >= 0){
+		r = hull(r, pow_corners(fmax(x.lo, 0), x.hi, y));
+		if(x.lo <= 0 && has_int(y.lo, fmin(y.hi, -1), 1)){
+			r.lo = -INFINITY; // pow(-0, -1) = -inf
+		}
+	}
+	if(x.lo < 0){
+		// pow(-a, n) = ±pow(a, n) for integers n, NaN for other exponents,
+		// except that pow(-inf, y) is 0 or inf, and pow(-a, ±inf) is 0, 1 or inf.
+		int fraction = has_fraction(y.lo, y.hi);
+		m = pow_corners(fmax(-x.hi, 0), -x.lo, y);
+		if(has_int(y.lo, y.hi, 1)){
+			r = hull(r, neg(m));
+		}
+		if(has_int(y.lo, y.hi, 0) || isinf(y.lo) || isinf(y.hi) || (fraction && x.lo == -INFINITY)){
+			r = hull(r, m);
+		}
+		nan = nan || (fraction && x.hi > -INFINITY);
+	}
+	r.nan = nan;
+	return r;
+}
+
+// iv_min returns fmin(x, y), which returns the other argument if one is NaN.
+static interval iv_min(interval x, interval y) {
+	interval r = empty;
+	if(!is_empty(x) && !is_empty(y)){
+		r = make(fmin(x.lo, y.lo), fmin(x.hi, y.hi), 0);
+	}
+	if(x.nan){
+		r = hull(r, y);
+	}
+	if(y.nan){
+		r = hull(r, x);
+	}
+	r.nan = x.nan && y.nan;
+	return r;
+}
+
+static interval iv_max(interval x, interval y) {
+	interval r = empty;
+	if(!is_empty(x) && !is_empty(y)){
+		r = make(fmax(x.lo, y.lo), fmax(x.hi, y.hi), 0);
+	}
+	if(x.nan){
+		r = hull(r, y);
+	}
+	if(y.nan){
+		r = hull(r, x);
+	}
+	r.nan = x.nan && y.nan;
+	return r;
+}
+
+// iv_hypot returns hypot(x, y), which grows with |x| and |y|.
+static interval iv_hypot(interval x, interval y) {
+	interval r = empty, ax = iv_fabs(x), ay = iv_fabs(y);
+	if(!is_empty(ax) && !is_empty(ay)){
+		r = clamp(make(down(hypot(ax.lo, ay.lo)), up(hypot(ax.hi, ay.hi)), 0), 0, INFINITY);
+	}
+	if((x.nan && ay.hi == INFINITY) || (y.nan && ax.hi == INFINITY)){
+		r = hull(r, point(INFINITY)); // hypot(NaN, inf) = inf
+	}
+	r.nan = x.nan || y.nan;
+	return r;
+}
+
+// iv_copysign returns copysign(x, y), with either sign if y may be zero or NaN.
+static interval iv_copysign(interval x, interval y) {
+	interval r = empty, m = iv_fabs(x);
+	if(is_empty(m)){
+		return empty;
+	}
+	if(y.nan || y.hi >= 0){
+		r = hull(r, m);
+	}
+	if(y.nan || y.lo <= 0){
+		r = hull(r, neg(m));
+	}
+	r.nan = x.nan;
+	return r;
+}
+
+// iv_fmod returns fmod(x, y), which has the sign of x, and is smaller than |x| and |y|.
+static interval iv_fmod(interval x, interval y) {
+	interval ay = iv_fabs(y);
+	double a, b, lo, hi;
+	int nan = x.nan || y.nan || contains(y, 0) || isinf(x.lo) || isinf(x.hi);
+	if(is_empty(x) || is_empty(y) || ay.hi == 0){
+		return empty;
+	}
+	if(y.lo == y.hi && isfinite(x.lo) && isfinite(x.hi) && (x.lo >= 0 || x.hi <= 0)){
+		// for a constant y, fmod increases with x, except where it wraps around,
+		// which is between x.lo and x.hi if those are less than a period apart and fmod decreases.
+		a = fmod(x.lo, ay.hi);
+		b = fmod(x.hi, ay.hi);
+		if(sub_up(x.hi, x.lo) < ay.hi && a <= b){
+			return make(a, b, nan);
+		}
+	}
+	lo = x.lo >= 0 ? 0 : -fmin(ay.hi, -x.lo);
+	hi = x.hi <= 0 ? 0 : fmin(ay.hi, x.hi);
+	return make(lo, hi, nan);
+}
+
+// iv_atan2 returns atan2(y, x), the angle of the point (x, y).
+static interval iv_atan2(interval y, interval x) {
+	double ys[2] = {y.lo, y.hi}, xs[2] = {x.lo, x.hi};
+	double pi = nextafter(M_PI, INFINITY), lo = INFINITY, hi = -INFINITY, a;
+	int nan = x.nan || y.nan;
+	int i, j;
+	if(is_empty(x) || is_empty(y)){
+		return empty;
+	}
+	if(x.lo <= 0 && contains(y, 0)){
+		// atan2 jumps from pi to -pi across the negative x axis
+		return make(-pi, pi, nan);
+	}
+	// elsewhere, atan2 is continuous, and monotonic along the edges of the box,
+	// so its extremes are at the corners
+	for(i=0; i<2; i++){
+		for(j=0; j<2; j++){
+			a = atan2(ys[i], xs[j]);
+			lo = fmin(lo, down(a));
+			hi = fmax(hi, up(a));
+		}
+	}
+	return clamp(make(lo, hi, nan), -pi, pi);
+}
+
+// maxTrig is the largest argument for which iv_trig and iv_tan locate the extremes and poles.
+#define maxTrig 1e15
+
+// has_multiple returns whether [lo, hi] may hold a number (r + k*period) * pi/2 for an integer k.
+// These are the extremes of sin and cos, and the poles of tan.
+// The test is conservative: it allows for the rounding errors in t = x * 2/pi,
+// less than 1e-15*|t| for |x| <= maxTrig.
+static int has_multiple(double lo, double hi, int r, int period) {
+	double t1 = lo * M_2_PI, t2 = hi * M_2_PI;
+	double a = ceil(t1 - 1e-9 - fabs(t1) * 1e-15);
+	double b = floor(t2 + 1e-9 + fabs(t2) * 1e-15);
+	double j = a + fmod(fmod(r - a, period) + period, period); // first j >= a with j = r mod period
+	return j <= b;
+}
+
+// iv_trig returns f(x) for sin or cos, which have their maxima at (rmax + 4k) * pi/2,
+// and their minima at (rmin + 4k) * pi/2. In between, they are monotonic.
+static interval iv_trig(double (*f)(double), int rmax, int rmin, interval x) {
+	double a, b, lo, hi;
+	int nan = x.nan || isinf(x.lo) || isinf(x.hi); // sin(inf) is NaN
+	if(is_empty(x) || (isinf(x.lo) && x.lo == x.hi)){
+		return empty;
+	}
+	if(isinf(x.lo) || isinf(x.hi) || fabs(x.lo) > maxTrig || fabs(x.hi) > maxTrig || x.hi - x.lo > 7){
+		return make(-1, 1, nan);
+	}
+	a = f(x.lo);
+	b = f(x.hi);
+	lo = has_multiple(x.lo, x.hi, rmin, 4) ? -1 : fmax(-1, down(fmin(a, b)));
+	hi = has_multiple(x.lo, x.hi, rmax, 4) ? 1 : fmin(1, up(fmax(a, b)));
+	return make(lo, hi, nan);
+}
+
+// iv_tan returns tan(x), which increases between its poles at (1 + 2k) * pi/2.
+static interval iv_tan(interval x) {
+	int nan = x.nan || isinf(x.lo) || isinf(x.hi);
+	if(is_empty(x) || (isinf(x.lo) && x.lo == x.hi)){
+		return empty;
+	}
+	if(isinf(x.lo) || isinf(x.hi) || fabs(x.lo) > maxTrig || fabs(x.hi) > maxTrig || has_multiple(x.lo, x.hi, 1, 2)){
+		return make(-INFINITY, INFINITY, nan);
+	}
+	return make(down(tan(x.lo)), up(tan(x.hi)), nan);
+}
+
+// iv_cosh returns cosh(x), which has its minimum 1 at 0.
+static interval iv_cosh(interval x) {
+	x = iv_fabs(x);
+	if(is_empty(x)){
+		return empty;
+	}
+	return make(fmax(1, down(cosh(x.lo))), up(cosh(x.hi)), x.nan);
+}
+
+static interval iv_sqrt(interval x) {
+	x = domain(x, 0, INFINITY);
+	if(is_empty(x)){
+		return empty;
+	}
+	return make(sqrt_rounded(x.lo, _MM_ROUND_DOWN), sqrt_rounded(x.hi, _MM_ROUND_UP), x.nan);
+}
+
+static interval iv_acos(interval x) {
+	x = domain(x, -1, 1);
+	if(is_empty(x)){
+		return empty;
+	}
+	return make(fmax(0, down(acos(x.hi))), up(acos(x.lo)), x.nan);
+}
+
+// iv_bool returns the interval of the results 0 (false) and 1 (true) of a comparison.
+static interval iv_bool(int maybe_false, int maybe_true) {
+	interval r = {maybe_false ? 0 : 1, maybe_true ? 1 : 0, !maybe_false && !maybe_true};
+	return r;
+}
+
+// maybe_true and maybe_false return whether x may be true (non-zero or NaN), or false (zero).
+static int maybe_true(interval x) {
+	return x.nan || (!is_empty(x) && (x.lo != 0 || x.hi != 0));
+}
+
+static int maybe_false(interval x) {
+	return contains(x, 0);
+}
+
+// iv_compare returns the results of a comparison, which is false for NaN, except for !=.
+static interval iv_compare(int op, interval x, interval y) {
+	int some = !is_empty(x) && !is_empty(y); // numbers to compare
+	int nan = x.nan || y.nan;
+	int maybe_eq = some && x.lo <= y.hi && y.lo <= x.hi;
+	int maybe_ne = nan || (some && !(x.lo == x.hi && y.lo == y.hi && x.lo == y.lo));
+	switch(op){
+	case IV_EQ: return iv_bool(maybe_ne, maybe_eq);
+	case IV_NE: return iv_bool(maybe_eq, maybe_ne);
+	case IV_LT: return iv_bool(nan || (some && x.hi >= y.lo), some && x.lo < y.hi);
+	case IV_LE: return iv_bool(nan || (some && x.hi > y.lo), some && x.lo <= y.hi);
+	case IV_GT: return iv_bool(nan || (some && x.lo <= y.hi), some && x.hi > y.lo);
+	case IV_GE: return iv_bool(nan || (some && x.lo < y.hi), some && x.hi >= y.lo);
+	}
+	return make(-INFINITY, INFINITY, 1);
+}
+
+// iv_eval returns the result of instruction p, given its operands.
+static interval iv_eval(const iv_instr *p, interval a, interval b, interval c) {
+	switch(p->op){
+	case IV_CONST: return point(p->k);
+	case IV_POWI: return iv_powi(a, (int)p->k);
+	case IV_IF:
+		if(maybe_true(a) && maybe_false(a)){
+			return hull(b, c);
+		}
+		return maybe_true(a) ? b : c;
+	case IV_ADD: return iv_add(a, b);
+	case IV_SUB: return iv_sub(a, b);
+	case IV_MUL: return iv_mul(a, b);
+	case IV_DIV: return iv_div(a, b);
+	case IV_POW: return iv_pow(a, b);
+	case IV_EQ: case IV_NE: case IV_LT: case IV_LE: case IV_GT: case IV_GE:
+		return iv_compare(p->op, a, b);
+	case IV_AND: return iv_bool(maybe_false(a) || maybe_false(b), maybe_true(a) && maybe_true(b));
+	case IV_OR: return iv_bool(maybe_false(a) && maybe_false(b), maybe_true(a) || maybe_true(b));
+	case IV_ACOS: return iv_acos(a);
+	case IV_ASIN: return increasing(asin, domain(a, -1, 1));
+	case IV_ATAN: return increasing(atan, a);
+	case IV_COS: return iv_trig(cos, 0, 2, a);
+	case IV_COSH: return iv_cosh(a);
+	case IV_SIN: return iv_trig(sin, 1, 3, a);
+	case IV_SINH: return increasing(sinh, a);
+	case IV_TAN: return iv_tan(a);
+	case IV_TANH: return clamp(increasing(tanh, a), -1, 1);
+	case IV_EXP: return clamp(increasing(exp, a), 0, INFINITY);
+	case IV_LOG: return increasing(log, domain(a, 0, INFINITY));
+	case IV_LOG10: return increasing(log10, domain(a, 0, INFINITY));
+	case IV_SQRT: return iv_sqrt(a);
+	case IV_FABS: return iv_fabs(a);
+	case IV_FLOOR: return exact(floor, a);
+	case IV_CEIL: return exact(ceil, a);
+	case IV_ROUND: return exact(round, a);
+	case IV_TRUNC: return exact(trunc, a);
+	case IV_ATAN2: return iv_atan2(a, b);
+	case IV_HYPOT: return iv_hypot(a, b);
+	case IV_FMOD: return iv_fmod(a, b);
+	case IV_MIN: return iv_min(a, b);
+	case IV_MAX: return iv_max(a, b);
+	case IV_COPYSIGN: return iv_copysign(a, b);
+	case IV_FMA: return iv_add(iv_mul(a, b), c);
+	}
+	return make(-INFINITY, INFINITY, 1); // IV_ENTIRE: no better bounds known
+}
+
+// eval_interval runs the n instructions of prog on the intervals v,
+// which holds the intervals of the nvars variables, followed by room for the results.
+// The result of instruction i is stored in v[nvars+i].
+void eval_interval(const iv_instr *prog, int n, interval *v, int nvars) {
+	int i;
+	const iv_instr *p;
+	for(i=0; i<n; i++){
+		p = &prog[i];
+		v[nvars+i] = iv_eval(p, v[p->a], v[p->b], v[p->c]);
+	}
+}
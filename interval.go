@@ -0,0 +1,217 @@
+package jit
+
+// This file implements interval arithmetic: bounds on the values
+// of an expression over ranges of its variables. The expression is compiled
+// into instructions for eval_interval, which does the arithmetic in interval.c.
+
+//#include "shim.h"
+import "C"
+
+import (
+	"fmt"
+	"math"
+)
+
+// EvalInterval returns bounds on the values of the code for all x in [xlo, xhi] and y in [ylo, yhi]:
+// 	lo <= Eval(x, y) <= hi
+// except where Eval returns NaN, like sqrt(x) for x < 0, which is left out.
+// If Eval returns NaN everywhere in the box, lo and hi are NaN.
+// E.g., whether the curve f(x, y) = 0 may pass through a pixel:
+// 	lo, hi := code.EvalInterval(x, x+dx, y, y+dy)
+// 	maybe := lo <= 0 && hi >= 0
+// The bounds are guaranteed, despite rounding errors, but not always tight.
+// In particular, a variable that appears more than once is treated as if each
+// occurrence could take a different value: for x in [-1, 1], x*x is in [-1, 1] but x^2 in [0, 1].
+// Functions registered with RegisterFunc or RegisterGoFunc are assumed to return any value.
+//
+// The code must have been compiled for two variables, like by Compile.
+// The interval code is compiled on the first call.
+func (c *Code) EvalInterval(xlo, xhi, ylo, yhi float64) (lo, hi float64) {
+	if c.nvars != 2 {
+		panic(fmt.Sprintf("evalInterval: need code of 2 variables, have %v", c.nvars))
+	}
+	return c.EvalIntervalN([]float64{xlo, ylo}, []float64{xhi, yhi})
+}
+
+// EvalIntervalN is like EvalInterval, for code of any number of variables,
+// each of which ranges over [lo[i], hi[i]].
+func (c *Code) EvalIntervalN(lo, hi []float64) (rlo, rhi float64) {
+	if len(lo) != c.nvars || len(hi) != c.nvars {
+		panic(fmt.Sprintf("evalInterval: need %v arguments, have %v, %v", c.nvars, len(lo), len(hi)))
+	}
+	for i := range lo {
+		if !(lo[i] <= hi[i]) {
+			panic(fmt.Sprintf("evalInterval: invalid interval [%v, %v]", lo[i], hi[i]))
+		}
+	}
+	return c.intervalCode().eval(lo, hi)
+}
+
+// intervalCode returns the interval code, compiling it if needed.
+func (c *Code) intervalCode() *intervalCode {
+	if len(c.instr) == 0 {
+		panic("eval called on nil code")
+	}
+	c.intervalOnce.Do(func() {
+		c.interval, c.intervalErr = compileInterval(c.src)
+	})
+	if c.intervalErr != nil {
+		panic(c.intervalErr)
+	}
+	return c.interval
+}
+
+// intervalCode is an expression compiled for eval_interval.
+// It works on a list of intervals: first those of the variables,
+// then the result of each instruction, which uses earlier ones.
+type intervalCode struct {
+	prog  []C.iv_instr
+	nvars int
+	root  int // index of the result
+}
+
+// intervalOps are the instructions for binary operators.
+var intervalOps = map[string]int32{
+	"+":  C.IV_ADD,
+	"-":  C.IV_SUB,
+	"*":  C.IV_MUL,
+	"/":  C.IV_DIV,
+	"^":  C.IV_POW,
+	"==": C.IV_EQ,
+	"!=": C.IV_NE,
+	"<":  C.IV_LT,
+	"<=": C.IV_LE,
+	">":  C.IV_GT,
+	">=": C.IV_GE,
+	"&&": C.IV_AND,
+	"||": C.IV_OR,
+}
+
+// intervalFuncs are the instructions for the builtin functions (see funcs).
+// Other functions are evaluated as IV_ENTIRE: any value.
+var intervalFuncs = map[string]int32{
+	"acos":     C.IV_ACOS,
+	"asin":     C.IV_ASIN,
+	"atan":     C.IV_ATAN,
+	"cos":      C.IV_COS,
+	"cosh":     C.IV_COSH,
+	"sin":      C.IV_SIN,
+	"sinh":     C.IV_SINH,
+	"tan":      C.IV_TAN,
+	"tanh":     C.IV_TANH,
+	"exp":      C.IV_EXP,
+	"log":      C.IV_LOG,
+	"log10":    C.IV_LOG10,
+	"sqrt":     C.IV_SQRT,
+	"fabs":     C.IV_FABS,
+	"atan2":    C.IV_ATAN2,
+	"hypot":    C.IV_HYPOT,
+	"fmod":     C.IV_FMOD,
+	"pow":      C.IV_POW,
+	"min":      C.IV_MIN,
+	"max":      C.IV_MAX,
+	"copysign": C.IV_COPYSIGN,
+	"fma":      C.IV_FMA,
+	"floor":    C.IV_FLOOR,
+	"ceil":     C.IV_CEIL,
+	"round":    C.IV_ROUND,
+	"trunc":    C.IV_TRUNC,
+}
+
+// compileInterval compiles the interval code for src,
+// optimized like the code evaluated by Eval.
+func compileInterval(src *source) (ic *intervalCode, e error) {
+	defer func() {
+		if err := recover(); err != nil {
+			ic, e = nil, compileError(src.ex, err)
+		}
+	}()
+
+	root := optimizeAST(newInliner(src.defs, src.vars, true).expand(src.root))
+	ic = &intervalCode{nvars: len(src.vars)}
+	names := make(map[string]int) // index of each variable and local binding
+	for i, v := range src.vars {
+		names[v] = i
+	}
+	ic.root = ic.compile(root, names)
+	return ic, nil
+}
+
+// compile adds the instructions for e, and returns the index of its result.
+func (ic *intervalCode) compile(e Expr, names map[string]int) int {
+	switch e := e.(type) {
+	default:
+		panic(fmt.Sprintf("compileInterval %T", e))
+	case Constant:
+		return ic.emit(C.IV_CONST, e.value)
+	case Variable:
+		return ic.lookup(e.name, names)
+	case Ref:
+		return ic.lookup(e.name, names)
+	case LetExpr:
+		names[e.name] = ic.compile(e.value, names)
+		defer delete(names, e.name)
+		return ic.compile(e.body, names)
+	case BinExpr:
+		op, ok := intervalOps[e.op]
+		if !ok {
+			panic(fmt.Sprintf("compileInterval %v", e.op))
+		}
+		x := ic.compile(e.x, names)
+		return ic.emit(op, 0, x, ic.compile(e.y, names))
+	case PowExpr:
+		return ic.emit(C.IV_POWI, float64(e.n), ic.compile(e.x, names))
+	case IfExpr:
+		cond := ic.compile(e.cond, names)
+		x := ic.compile(e.x, names)
+		return ic.emit(C.IV_IF, 0, cond, x, ic.compile(e.y, names))
+	case *CallExpr:
+		op, ok := intervalFuncs[e.fun]
+		if !ok {
+			op = C.IV_ENTIRE
+		}
+		args := make([]int, len(e.args))
+		for i, a := range e.args {
+			args[i] = ic.compile(a, names)
+		}
+		if op == C.IV_ENTIRE {
+			args = nil // only the first 3 fit in an instruction, and none are used
+		}
+		return ic.emit(op, 0, args...)
+	}
+}
+
+func (ic *intervalCode) lookup(name string, names map[string]int) int {
+	i, ok := names[name]
+	if !ok {
+		panic("undefined: " + name)
+	}
+	return i
+}
+
+// emit adds an instruction with operands args (at most 3), and returns the index of its result.
+func (ic *intervalCode) emit(op int32, k float64, args ...int) int {
+	in := C.iv_instr{op: C.int32_t(op), k: C.double(k)}
+	operands := []*C.int32_t{&in.a, &in.b, &in.c}
+	for i, a := range args {
+		*operands[i] = C.int32_t(a)
+	}
+	ic.prog = append(ic.prog, in)
+	return ic.nvars + len(ic.prog) - 1
+}
+
+// eval evaluates the code for variables in [lo[i], hi[i]].
+func (ic *intervalCode) eval(lo, hi []float64) (rlo, rhi float64) {
+	v := make([]C.interval, ic.nvars+len(ic.prog))
+	for i := range lo {
+		v[i] = C.interval{lo: C.double(lo[i]), hi: C.double(hi[i])}
+	}
+	if len(ic.prog) > 0 {
+		C.eval_interval(&ic.prog[0], C.int(len(ic.prog)), &v[0], C.int(ic.nvars))
+	}
+	r := v[ic.root]
+	if !(r.lo <= r.hi) {
+		return math.NaN(), math.NaN() // empty
+	}
+	return float64(r.lo), float64(r.hi)
+}
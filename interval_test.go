@@ -0,0 +1,290 @@
+package jit
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// intervalTests are expressions for testing EvalInterval,
+// in addition to those in tests and a call to every builtin function.
+var intervalTests = []string{
+	"x^y", "y^x", "x^3", "x^2", "x^-2", "x^-3", "x^0.5", "(x-y)^2", "x^x", "(-2)^y", "x^(y/3)",
+	"x*x - y*y", "x/y", "y/x", "1/x", "x-y", "x*y", "x*y+1",
+	"x < y", "x <= y", "x > y", "x >= y", "x == y", "x != y",
+	"x == 1", "sqrt(x) < 10", "sqrt(x) != 1", "log(x) >= -1",
+	"x && y", "x || y", "!x", "sqrt(x) && y", "sqrt(x) || 0",
+	"x > 0 ? sqrt(x) : -x", "ifelse(sqrt(x), y, 2)", "sin(x) ? x : y",
+	"a := x*y; a*a - sin(a)", "f(t) = t*t+1; f(x)/f(y)",
+	"fmod(x, 3)", "fmod(x, -0.5)", "fmod(3, y)", "fmod(x, y)",
+	"min(sqrt(x), y)", "max(log(x), log(y))", "hypot(sqrt(x), y)", "copysign(1, sqrt(x))",
+	"atan2(y, x)", "atan2(sqrt(y), x)", "tan(x*y)", "sin(x)*cos(y) - 0.5", "cos(1e10*x)",
+	"pow(x, y*2)", "pow(sqrt(x), 0)", "pow(1, sqrt(y))",
+}
+
+// intervalBoxes returns random ranges for x and y,
+// narrow and wide, around zero or not, including infinite ones.
+func intervalBox(rng *rand.Rand) (lo, hi [2]float64) {
+	for i := range lo {
+		scale := math.Pow(10, float64(rng.Intn(8)-4))
+		a, b := scale*rng.NormFloat64(), scale*rng.NormFloat64()
+		switch rng.Intn(8) {
+		case 0:
+			b = a // point
+		case 1:
+			a, b = math.Round(a), math.Round(b) // integers
+		case 2:
+			b = a + 1e-3*scale*rng.Float64() // narrow
+		case 3:
+			a = math.Inf(-1)
+		case 4:
+			b = math.Inf(1)
+		case 5:
+			a, b = 0, math.Abs(b)
+		}
+		lo[i], hi[i] = math.Min(a, b), math.Max(a, b)
+	}
+	return lo, hi
+}
+
+// samples returns points in [lo, hi], including the bounds.
+func samples(rng *rand.Rand, lo, hi float64) []float64 {
+	s := []float64{lo, hi}
+	a, b := math.Max(lo, -1e300), math.Min(hi, 1e300)
+	for i := 0; i < 8; i++ {
+		s = append(s, a+rng.Float64()*(b-a))
+	}
+	for _, v := range []float64{0, 1, -1, math.Pi / 2, -math.Pi / 2, math.Pi, 0.5} {
+		if lo <= v && v <= hi {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+func TestEvalInterval(t *testing.T) {
+	exprs := append([]string{}, intervalTests...)
+	for ex := range tests {
+		exprs = append(exprs, ex)
+	}
+	for name, f := range funcs {
+		if _, ok := intervalFuncs[name]; !ok {
+			continue // registered by other tests
+		}
+		args := []string{"x", "y", "x*y"}[:f.arity]
+		exprs = append(exprs, fmt.Sprintf("%v(%v)", name, joinArgs(args)))
+		if f.arity == 1 {
+			exprs = append(exprs, fmt.Sprintf("%v(3*x+y)", name), fmt.Sprintf("%v(1/x)", name))
+		}
+	}
+	sort.Strings(exprs)
+
+	rng := rand.New(rand.NewSource(1))
+	for _, ex := range exprs {
+		code, err := Compile(ex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 300; i++ {
+			lo, hi := intervalBox(rng)
+			rlo, rhi := code.EvalInterval(lo[0], hi[0], lo[1], hi[1])
+		points:
+			for _, x := range samples(rng, lo[0], hi[0]) {
+				for _, y := range samples(rng, lo[1], hi[1]) {
+					v := code.Eval(x, y)
+					if !math.IsNaN(v) && !(rlo <= v && v <= rhi) {
+						t.Errorf("%v: x in [%v, %v], y in [%v, %v]: have [%v, %v], but f(%v, %v) = %v",
+							ex, lo[0], hi[0], lo[1], hi[1], rlo, rhi, x, y, v)
+						break points
+					}
+				}
+			}
+		}
+		code.Free()
+	}
+}
+
+func joinArgs(args []string) string {
+	s := ""
+	for i, a := range args {
+		if i > 0 {
+			s += ", "
+		}
+		s += a
+	}
+	return s
+}
+
+func TestEvalIntervalBounds(t *testing.T) {
+	inf, nan := math.Inf(1), math.NaN()
+	tests := []struct {
+		ex             string
+		xlo, xhi       float64
+		ylo, yhi       float64
+		wantLo, wantHi float64
+	}{
+		{"x*x", -1, 2, 0, 0, -2, 4},
+		{"x^2", -1, 2, 0, 0, 0, 4},
+		{"x^3", -2, 1, 0, 0, -8, 1},
+		{"x+y", 1, 2, 10, 20, 11, 22},
+		{"x-y", 1, 2, 10, 20, -19, -8},
+		{"x/y", 1, 2, -4, -2, -1, -0.25},
+		{"1/x", -1, 1, 0, 0, -inf, inf},
+		{"sqrt(x)", -1, 4, 0, 0, 0, 2},
+		{"sqrt(x)", -4, -1, 0, 0, nan, nan},
+		{"log(x)", 0, 1, 0, 0, -inf, 0},
+		{"fabs(x)", -3, 2, 0, 0, 0, 3},
+		{"floor(x)", -1.5, 2.5, 0, 0, -2, 2},
+		{"min(x, y)", 1, 3, 2, 4, 1, 3},
+		{"sin(x)", 1, 2, 0, 0, math.Sin(1), 1},
+		{"sin(x)", 0, 100, 0, 0, -1, 1},
+		{"cos(x)", 3, 4, 0, 0, -1, math.Cos(4)},
+		{"tan(x)", 1.5, 1.6, 0, 0, -inf, inf},
+		{"x < y", 0, 1, 2, 3, 1, 1},
+		{"x < y", 0, 2, 1, 3, 0, 1},
+		{"x == y", 1, 1, 1, 1, 1, 1},
+		{"sqrt(x) < 10", -1, 4, 0, 0, 0, 1}, // NaN < 10 is false
+		{"sqrt(x) != 1", -4, -1, 0, 0, 1, 1},
+		{"x > 0 ? 1 : 2", 1, 2, 0, 0, 1, 1},
+		{"x > 0 ? 1 : 2", -1, 2, 0, 0, 1, 2},
+		{"fmod(x, 1)", 2.25, 2.75, 0, 0, 0.25, 0.75},
+		{"fmod(x, 1)", 2.5, 3.5, 0, 0, 0, 1},
+		{"atan2(y, x)", 1, 1, 0, 1, 0, math.Pi / 4},
+		{"atan2(y, x)", -1, -1, -1, 1, -math.Pi, math.Pi},
+		{"x^y", 2, 4, 1, 2, 2, 16},
+		{"x^y", -2, -2, 3, 3, -8, -8},
+		{"x^y", -2, -1, 0.5, 0.5, nan, nan},
+		{"pow(x, 0)", nan, nan, 0, 0, 1, 1},
+	}
+	for _, test := range tests {
+		code, err := Compile(test.ex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.IsNaN(test.xlo) {
+			// NaN is not a valid interval: use an expression that is NaN everywhere
+			code, err = Compile("pow(sqrt(-1-x*x), 0)")
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.xlo, test.xhi = 0, 1
+		}
+		lo, hi := code.EvalInterval(test.xlo, test.xhi, test.ylo, test.yhi)
+		// the bounds from the math library are widened by a few ulps
+		if !near(lo, test.wantLo) || !near(hi, test.wantHi) || lo > test.wantLo || hi < test.wantHi {
+			t.Errorf("%v: x in [%v, %v], y in [%v, %v]: have [%v, %v], want [%v, %v]",
+				test.ex, test.xlo, test.xhi, test.ylo, test.yhi, lo, hi, test.wantLo, test.wantHi)
+		}
+		code.Free()
+	}
+}
+
+// near returns whether a and b are equal up to 1e-14 (or 1e-300 near zero), or both NaN.
+func near(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return a == b || math.Abs(a-b) <= 1e-14*math.Max(math.Abs(a), math.Abs(b))+1e-300
+}
+
+// TestEvalIntervalRounding tests that the bounds are rounded outwards:
+// for a single point, they are the numbers below and above the exact result.
+func TestEvalIntervalRounding(t *testing.T) {
+	// each test returns the result rounded to nearest,
+	// and the error: the exact result minus the rounded one (computed exactly, or just its sign).
+	tests := []struct {
+		ex    string
+		exact func(x, y float64) (v, err float64)
+	}{
+		{"x+y", twoSum},
+		{"x-y", func(x, y float64) (float64, float64) { return twoSum(x, -y) }},
+		{"x*y", func(x, y float64) (float64, float64) { p := x * y; return p, math.FMA(x, y, -p) }},
+		{"x/y", func(x, y float64) (float64, float64) { q := x / y; return q, math.FMA(-q, y, x) * y }},
+		{"sqrt(x)", func(x, _ float64) (float64, float64) { s := math.Sqrt(x); return s, math.FMA(-s, s, x) }},
+	}
+	for _, test := range tests {
+		code, err := Compile(test.ex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range [][2]float64{{0.1, 0.2}, {2, 3}, {1e10, 3e-10}, {-5.5, 0.7}, {1, 1}} {
+			x, y := p[0], p[1]
+			if test.ex == "sqrt(x)" {
+				x = math.Abs(x)
+			}
+			lo, hi := code.EvalInterval(x, x, y, y)
+			v, e := test.exact(x, y)
+			want := [2]float64{v, v}
+			if e > 0 {
+				want[1] = math.Nextafter(v, math.Inf(1))
+			}
+			if e < 0 {
+				want[0] = math.Nextafter(v, math.Inf(-1))
+			}
+			if lo != want[0] || hi != want[1] {
+				t.Errorf("%v(%v, %v): have [%v, %v], want [%v, %v]", test.ex, x, y, lo, hi, want[0], want[1])
+			}
+		}
+		code.Free()
+	}
+
+	// the rounding mode is restored
+	x, y := 0.1, 0.2
+	if x+y != 0.30000000000000004 || -x-y != -0.30000000000000004 {
+		t.Errorf("rounding mode not restored: %v, %v", x+y, -x-y)
+	}
+}
+
+// twoSum returns x+y, and its rounding error.
+func twoSum(x, y float64) (s, err float64) {
+	s = x + y
+	b := s - x
+	return s, (x - (s - b)) + (y - b)
+}
+
+func TestEvalIntervalN(t *testing.T) {
+	code, err := CompileVars("a*b + c", "a", "b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	lo, hi := code.EvalIntervalN([]float64{1, -2, 10}, []float64{2, 3, 20})
+	if lo != 6 || hi != 26 {
+		t.Errorf("have [%v, %v], want [6, 26]", lo, hi)
+	}
+}
+
+func TestEvalIntervalUnknownFunc(t *testing.T) {
+	name := uniqueName("interval_test")
+	if err := RegisterGoFunc(name, func(x float64) float64 { return x }, true); err != nil {
+		t.Fatal(err)
+	}
+	code, err := Compile("1 + " + name + "(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	if lo, hi := code.EvalInterval(0, 1, 0, 1); lo != math.Inf(-1) || hi != math.Inf(1) {
+		t.Errorf("have [%v, %v], want [-inf, inf]", lo, hi)
+	}
+}
+
+func TestEvalIntervalPanics(t *testing.T) {
+	code, err := Compile("x+y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	for _, box := range [][4]float64{{1, 0, 0, 1}, {0, 1, math.NaN(), 1}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v: no panic", box)
+				}
+			}()
+			code.EvalInterval(box[0], box[1], box[2], box[3])
+		}()
+	}
+}
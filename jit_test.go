@@ -81,6 +81,192 @@ var tests = map[string]func(float64, float64) float64{
 	"(1+2+(3+2*4+((((5+6*2)+7)+(8))+9)+10*(2-x+y/3))+11)*(sin(x*y*2+1)*cos(1+2+x+y)+sin(2/x)+cos(sqrt(x+y+1)))": func(x float64, y float64) float64 {
 		return (1 + 2 + (3 + 2*4 + ((((5 + 6*2) + 7) + (8)) + 9) + 10*(2-x+y/3)) + 11) * (sin(x*y*2+1)*cos(1+2+x+y) + sin(2/x) + cos(sqrt(x+y+1)))
 	},
+	"x<y": func(x float64, y float64) float64 {
+		return b2f(x < y)
+	},
+	"x<=y": func(x float64, y float64) float64 {
+		return b2f(x <= y)
+	},
+	"x>y": func(x float64, y float64) float64 {
+		return b2f(x > y)
+	},
+	"x>=y": func(x float64, y float64) float64 {
+		return b2f(x >= y)
+	},
+	"x==y": func(x float64, y float64) float64 {
+		return b2f(x == y)
+	},
+	"x!=y": func(x float64, y float64) float64 {
+		return b2f(x != y)
+	},
+	"(0/0)<x": func(x float64, y float64) float64 {
+		return 0
+	},
+	"(0/0)!=x": func(x float64, y float64) float64 {
+		return 1
+	},
+	"select(x<0, -x, x*x)": func(x float64, y float64) float64 {
+		if x < 0 {
+			return -x
+		}
+		return x * x
+	},
+	"ifelse(0/0, 1, 2)": func(x float64, y float64) float64 {
+		return 1
+	},
+	"ifelse(x-y, sin(x), y+1)": func(x float64, y float64) float64 {
+		if x-y != 0 {
+			return sin(x)
+		}
+		return y + 1
+	},
+	"1+ifelse(sin(x)<0, 1, cos(y))*(2+ifelse(y<x, sqrt(y), x+ifelse(x>y*y, x, y)))": func(x float64, y float64) float64 {
+		a := cos(y)
+		if sin(x) < 0 {
+			a = 1
+		}
+		c := y
+		if x > y*y {
+			c = x
+		}
+		b := x + c
+		if y < x {
+			b = sqrt(y)
+		}
+		return 1 + a*(2+b)
+	},
+	"x*x+y*y < 1e4 && y > 0": func(x float64, y float64) float64 {
+		return b2f(x*x+y*y < 1e4 && y > 0)
+	},
+	"x < 0 || sin(y) < 0": func(x float64, y float64) float64 {
+		return b2f(x < 0 || sin(y) < 0)
+	},
+	"x && y": func(x float64, y float64) float64 {
+		return b2f(x != 0 && y != 0)
+	},
+	"!x": func(x float64, y float64) float64 {
+		return b2f(x == 0)
+	},
+	"!(x<y) || !!y": func(x float64, y float64) float64 {
+		return b2f(!(x < y) || y != 0)
+	},
+	"(0/0) && 1": func(x float64, y float64) float64 {
+		return 1
+	},
+	"!(0/0)": func(x float64, y float64) float64 {
+		return 0
+	},
+	"x**2": func(x float64, y float64) float64 {
+		return x * x
+	},
+	"2*x**3*y": func(x float64, y float64) float64 {
+		return 2 * x * x * x * y
+	},
+	"-x**2": func(x float64, y float64) float64 {
+		return -x * x
+	},
+	"y/x**-2": func(x float64, y float64) float64 {
+		return y / (1 / (x * x))
+	},
+	"2**2**3": func(x float64, y float64) float64 {
+		return 256
+	},
+	"x**0.5": func(x float64, y float64) float64 {
+		return math.Pow(x, 0.5)
+	},
+	"pow(x, 3.5)": func(x float64, y float64) float64 {
+		return math.Pow(x, 3.5)
+	},
+	"pow(x, y/100)": func(x float64, y float64) float64 {
+		return math.Pow(x, y/100)
+	},
+	"sin(x)**13 + (x+y)**-3": func(x float64, y float64) float64 {
+		return math.Pow(sin(x), 13) + math.Pow(x+y, -3)
+	},
+	"1+(x*y)**y**0*(x**0)": func(x float64, y float64) float64 {
+		return 1 + x*y
+	},
+	"atan2(y, x)": func(x float64, y float64) float64 {
+		return math.Atan2(y, x)
+	},
+	"hypot(x, y) - fmod(x, 7)": func(x float64, y float64) float64 {
+		return math.Hypot(x, y) - math.Mod(x, 7)
+	},
+	"min(x, y) * max(x, 2*y) + copysign(3, y)": func(x float64, y float64) float64 {
+		return fmin(x, y)*fmax(x, 2*y) + math.Copysign(3, y)
+	},
+	"atan2(sin(y), x+cos(x)) * hypot(min(x, 1+y), sqrt(x*x+1))": func(x float64, y float64) float64 {
+		return math.Atan2(sin(y), x+cos(x)) * math.Hypot(fmin(x, 1+y), sqrt(x*x+1))
+	},
+	"1+x*(2+y*(3+x*atan2(x+y*(x-y*(1+x)), y*(x+1))))": func(x float64, y float64) float64 {
+		return 1 + x*(2+y*(3+x*math.Atan2(x+y*(x-y*(1+x)), y*(x+1))))
+	},
+	"fma(x, y, 1) + x*fma(sin(y), 2, x*fma(x, y+1, cos(x)))": func(x float64, y float64) float64 {
+		return math.FMA(x, y, 1) + x*math.FMA(sin(y), 2, x*math.FMA(x, y+1, cos(x)))
+	},
+	"sqrt(x*x+y*y)-1": func(x float64, y float64) float64 {
+		return sqrt(x*x+y*y) - 1
+	},
+	"fabs(x) + 2*fabs(y-1)": func(x float64, y float64) float64 {
+		return math.Abs(x) + 2*math.Abs(y-1)
+	},
+	"floor(x/7) + ceil(y/7) + trunc(x/3)": func(x float64, y float64) float64 {
+		return math.Floor(x/7) + math.Ceil(y/7) + math.Trunc(x/3)
+	},
+	"round(x/2) + round(y/4) + round(x/10)": func(x float64, y float64) float64 {
+		return math.Round(x/2) + math.Round(y/4) + math.Round(x/10)
+	},
+	"round(x*0.49999999999999994)": func(x float64, y float64) float64 {
+		return math.Round(x * 0.49999999999999994)
+	},
+	"min(0/0, x) + max(y, 0/0) + min(0/0, 0/0)": func(x float64, y float64) float64 {
+		return math.NaN()
+	},
+	"min(0/0, x) + max(y, 0/0)": func(x float64, y float64) float64 {
+		return x + y
+	},
+	"max(x, y) - min(y, 1-x)*max(sqrt(y), x)": func(x float64, y float64) float64 {
+		return fmax(x, y) - fmin(y, 1-x)*fmax(sqrt(y), x)
+	},
+	"sin(pi/2)*x + e*y - tau": func(x float64, y float64) float64 {
+		return x + math.E*y - 2*math.Pi
+	},
+	"x < inf && ln2*log2e == 1": func(x float64, y float64) float64 {
+		return 1
+	},
+	"nan*x": func(x float64, y float64) float64 {
+		return math.NaN()
+	},
+	"r := sqrt(x*x+y*y); th := atan(y/x); sin(5*th) - r + 1": func(x float64, y float64) float64 {
+		r := sqrt(x*x + y*y)
+		th := math.Atan(y / x)
+		return sin(5*th) - r + 1
+	},
+	"a := x+1; b := a*a; c := sin(b); a + b*c + c": func(x float64, y float64) float64 {
+		a := x + 1
+		b := a * a
+		c := sin(b)
+		return a + b*c + c
+	},
+	"k := 2; k2 := k*k; k2*x": func(x float64, y float64) float64 {
+		return 4 * x
+	},
+	"a := x; b := y; c := a*b; d := c+a; e2 := d*b; f := e2-c; g := f*f; a+b+c+d+e2+f+g": func(x float64, y float64) float64 {
+		a := x
+		b := y
+		c := a * b
+		d := c + a
+		e2 := d * b
+		f := e2 - c
+		g := f * f
+		return a + b + c + d + e2 + f + g
+	},
+	"a := sin(x); b := cos(y); c := atan2(a, b); a*(b*c + sin(a+b+c)*(1+b*(2+c))) + b": func(x float64, y float64) float64 {
+		a := sin(x)
+		b := cos(y)
+		c := math.Atan2(a, b)
+		return a*(b*c+sin(a+b+c)*(1+b*(2+c))) + b
+	},
 }
 
 func TestJIT(t *testing.T) {
@@ -88,38 +274,184 @@ func TestJIT(t *testing.T) {
 		useConstFolding = true
 		useCallDepth = true
 		useRegisters = true
+		useInlining = true
+		useCSE = true
 	}()
 	for expr, want := range tests {
 		for _, useConstFolding = range []bool{true, false} {
 			for _, useCallDepth = range []bool{true, false} {
 				for _, useRegisters = range []bool{true, false} {
-					code, err := Compile(expr)
-					if err != nil {
-						t.Fatal(err)
-					}
-					for _, x := range []float64{3, -1e3, -123.4, -1, 0, 1, 123.4, 1e3} {
-						for _, y := range []float64{5, -1e3, -123.4, -1, 0, 1, 123.4, 1e3} {
-							have := code.Eval(x, y)
-							if !equal(have, want(x, y)) {
-								t.Errorf("%v with x=%v,y=%v: have %v, want: %v", expr, x, y, have, want(x, y))
+					for _, useInlining = range []bool{true, false} {
+						for _, useCSE = range []bool{true, false} {
+							code, err := Compile(expr)
+							if err != nil {
+								t.Fatal(err)
+							}
+							for _, x := range []float64{3, -1e3, -123.4, -1, 0, 1, 123.4, 1e3} {
+								for _, y := range []float64{5, -1e3, -123.4, -1, 0, 1, 123.4, 1e3} {
+									have := code.Eval(x, y)
+									if !equal(have, want(x, y)) {
+										t.Errorf("%v with x=%v,y=%v: have %v, want: %v", expr, x, y, have, want(x, y))
+									}
+								}
 							}
+
+							code.Free()
 						}
 					}
-
-					code.Free()
 				}
 			}
 		}
 	}
 }
 
+func TestCompileVars(t *testing.T) {
+	tests := []struct {
+		expr string
+		vars []string
+		args []float64
+		want float64
+	}{
+		{"1", nil, nil, 1},
+		{"t", []string{"t"}, []float64{3}, 3},
+		{"rho*v0*v0/2", []string{"rho", "v0"}, []float64{2, 3}, 9},
+		{"v0*v0*rho/2", []string{"rho", "v0"}, []float64{2, 3}, 9},
+		{"a-b+sin(c)*d", []string{"a", "b", "c", "d"}, []float64{1, 2, 0, 4}, -1},
+		{"x-y", []string{"y", "x"}, []float64{1, 2}, 1},
+	}
+	for _, test := range tests {
+		code, err := CompileVars(test.expr, test.vars...)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := code.EvalN(test.args); have != test.want {
+			t.Errorf("%v with %v=%v: have %v, want %v", test.expr, test.vars, test.args, have, test.want)
+		}
+		code.Free()
+	}
+}
+
+func TestCompileVarsErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		vars []string
+	}{
+		{"x", nil},
+		{"x+z", []string{"x", "y"}},
+		{"x", []string{"x", "x"}},
+		{"sin", []string{"sin"}},
+		{"1", []string{"1a"}},
+		{"1", []string{""}},
+	}
+	for _, test := range tests {
+		if _, err := CompileVars(test.expr, test.vars...); err == nil {
+			t.Errorf("CompileVars %q, %q: expected error, got nil", test.expr, test.vars)
+		}
+	}
+}
+
+func TestCompileExpr(t *testing.T) {
+	x, y, r := NewVariable("x"), NewVariable("y"), NewRef("r")
+	tests := []struct {
+		root Expr
+		want float64
+	}{
+		{NewConstant(3), 3},
+		{NewBinExpr("-", x, y), -1},
+		{NewCallExpr("atan2", y, x), math.Atan2(2, 1)},
+		{NewLetExpr("r", NewBinExpr("+", NewBinExpr("*", x, x), NewBinExpr("*", y, y)), NewCallExpr("sqrt", r)), math.Sqrt(5)},
+		{NewIfExpr(NewBinExpr(">", x, y), x, y), 2},
+		{NewBinExpr("-", NewLetExpr("r", x, NewCallExpr("exp", r)), NewLetExpr("r", y, NewCallExpr("exp", r))), math.E - math.Exp(2)},
+	}
+	for _, test := range tests {
+		code, err := CompileExpr(test.root, "x", "y")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := code.Eval(1, 2); have != test.want {
+			t.Errorf("%v: have %v, want %v", test.root, have, test.want)
+		}
+		code.Free()
+	}
+
+	// parsed trees compile to the same result
+	root, err := ParseVars("f(t) = t*t+1; a := f(x); a*a - 2a", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := CompileExpr(root, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	if have, want := code.EvalN([]float64{2}), 15.; have != want {
+		t.Errorf("%v: have %v, want %v", root, have, want)
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	x := NewVariable("x")
+	tests := []struct {
+		root Expr
+		vars []string
+		kind ErrorKind
+	}{
+		{nil, []string{"x"}, KindSyntax},
+		{x, nil, KindUnknownIdent},
+		{x, []string{"x", "x"}, KindInvalidVar},
+		{NewRef("r"), []string{"x"}, KindUnknownIdent},
+		{NewBinExpr("%", x, x), []string{"x"}, KindUnsupportedOp},
+		{NewBinExpr("+", x, nil), []string{"x"}, KindSyntax},
+		{NewCallExpr("nosuchfunc", x), []string{"x"}, KindUnknownIdent},
+		{NewCallExpr("ifelse", x, x, x), []string{"x"}, KindUnknownIdent},
+		{NewCallExpr("select", x, x, x), []string{"x"}, KindUnknownIdent},
+		{NewCallExpr("sin", x, x), []string{"x"}, KindArity},
+		{NewLetExpr("x", x, x), []string{"x"}, KindRedeclared},
+		{NewLetExpr("pi", x, x), []string{"x"}, KindRedeclared},
+		{NewLetExpr("a b", x, x), []string{"x"}, KindSyntax},
+		{NewLetExpr("a", x, NewLetExpr("a", x, x)), []string{"x"}, KindRedeclared},
+		{NewLetExpr("a", NewRef("a"), x), []string{"x"}, KindUnknownIdent},
+		{NewBinExpr("+", NewLetExpr("a", x, NewRef("a")), NewRef("a")), []string{"x"}, KindUnknownIdent},
+	}
+	for _, test := range tests {
+		_, err := CompileExpr(test.root, test.vars...)
+		cerr, ok := err.(*CompileError)
+		if !ok {
+			t.Errorf("CompileExpr %v, %q: have %v, want *CompileError", test.root, test.vars, err)
+			continue
+		}
+		if cerr.Kind != test.kind {
+			t.Errorf("CompileExpr %v, %q: have %v, want %v", test.root, test.vars, cerr.Kind, test.kind)
+		}
+	}
+}
+
 func TestErrors(t *testing.T) {
 	tests := []string{
 		"",
 		"notafunc(x)",
 		"a.b",
 		"a.",
-		"1||2",
+		"1|2",
+		"x<<1",
+		"x * *y",
+		"*x",
+		"pow(x)",
+		"atan2(x)",
+		"r := x; r := y; r",
+		"x := 1; x",
+		"pi := 1; pi",
+		"sin := 1; sin",
+		"r := r+1; r",
+		"r := 1;",
+		"r = 1; r",
+		"1; 2",
+		"r := 1; s := r; t",
+		"}; func f() {",
+		"sin(x, y)",
+		"ifelse(1, 2)",
 	}
 
 	for _, test := range tests {
@@ -169,6 +501,48 @@ func TestEval2D(t *testing.T) {
 	}
 }
 
+func TestEval2DMask(t *testing.T) {
+	nx := 100
+	ny := 4
+	code, err := Compile("x*x+y*y < 1 && y > 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	xmin, xmax := -2.0, 2.0
+	ymin, ymax := -2.0, 2.0
+	dst := make([]uint64, (nx*ny+63)/64)
+	for i := range dst {
+		dst[i] = 0xdeadbeef // must be overwritten
+	}
+	code.Eval2DMask(dst, xmin, xmax, nx, ymin, ymax, ny)
+
+	for iy := 0; iy < ny; iy++ {
+		y := ymin + ((ymax-ymin)*(float64(iy)+0.5))/float64(ny)
+		for ix := 0; ix < nx; ix++ {
+			x := xmin + ((xmax-xmin)*(float64(ix)+0.5))/float64(nx)
+			i := iy*nx + ix
+			have := dst[i/64]&(1<<uint(i%64)) != 0
+			if want := code.EvalBool(x, y); have != want {
+				t.Errorf("eval2DMask x=%v, y=%v: have %v, want %v", x, y, have, want)
+			}
+		}
+	}
+	if n := countBits(dst); n == 0 || n == nx*ny {
+		t.Errorf("eval2DMask: %v bits set", n)
+	}
+}
+
+func countBits(mask []uint64) int {
+	n := 0
+	for _, m := range mask {
+		for ; m != 0; m &= m - 1 {
+			n++
+		}
+	}
+	return n
+}
+
 // equal returns whether x and y are approximately equal
 func equal(x, y float64) bool {
 	if math.IsNaN(x) && math.IsNaN(y) {
@@ -180,6 +554,36 @@ func equal(x, y float64) bool {
 	return math.Abs((x-y)/(x+y)) < 1e-14
 }
 
+// b2f converts true to 1, false to 0.
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// fmin is C's fmin: unlike math.Min, it ignores a NaN operand.
+func fmin(x, y float64) float64 {
+	switch {
+	case math.IsNaN(x):
+		return y
+	case math.IsNaN(y):
+		return x
+	}
+	return math.Min(x, y)
+}
+
+// fmax is C's fmax: unlike math.Max, it ignores a NaN operand.
+func fmax(x, y float64) float64 {
+	switch {
+	case math.IsNaN(x):
+		return y
+	case math.IsNaN(y):
+		return x
+	}
+	return math.Max(x, y)
+}
+
 func sqrt(x float64) float64 { return math.Sqrt(x) }
 func sin(x float64) float64  { return math.Sin(x) }
 func cos(x float64) float64  { return math.Cos(x) }
@@ -0,0 +1,137 @@
+package jit
+
+// this file implements the lexer for the expression language.
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// token kinds
+const (
+	tokEOF    = iota // end of input
+	tokNumber        // number literal, like 1.5e-3
+	tokIdent         // identifier, like x or sin
+	tokOp            // operator or punctuation, like + or (
+)
+
+// token is a lexical token of the expression language.
+type token struct {
+	kind   int
+	text   string
+	pos    int  // byte offset in the source
+	spaced bool // preceded by white space
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// operators, longest first so that e.g. "<=" is not lexed as "<", "=".
+var operators = []string{
+	"**", "&&", "||", "==", "!=", "<=", ">=", ":=",
+	"<<", ">>", "&^", // unsupported
+	"+", "-", "*", "/", "^", "<", ">", "!", "?", ":", "(", ")", ",", ";",
+	"=",
+	"%", "&", "|", "~", // unsupported
+}
+
+// unsupported operators are lexed only to report them as such.
+var unsupported = map[string]bool{
+	"<<": true, ">>": true, "&^": true, "%": true, "&": true, "|": true, "~": true,
+}
+
+// lex splits src into tokens, ending with a tokEOF token.
+// It panics with a syntax error on invalid input.
+func lex(src string) []token {
+	var toks []token
+	spaced := false
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			spaced = true
+			continue
+		case isDigit(r) || r == '.' && i+1 < len(src) && isDigit(rune(src[i+1])):
+			n := lexNumber(src[i:])
+			toks = append(toks, token{tokNumber, src[i : i+n], i, spaced})
+			i += n
+		case unicode.IsLetter(r) || r == '_':
+			n := lexIdent(src[i:])
+			toks = append(toks, token{tokIdent, src[i : i+n], i, spaced})
+			i += n
+		default:
+			op := lexOp(src[i:])
+			t := token{tokOp, op, i, spaced}
+			switch {
+			case op == "":
+				t.text = string(r)
+				syntaxError(KindSyntax, t, "unexpected %v", t)
+			case unsupported[op]:
+				syntaxError(KindUnsupportedOp, t, "unsupported operator %v", t)
+			}
+			toks = append(toks, t)
+			i += len(op)
+		}
+		spaced = false
+	}
+	return append(toks, token{tokEOF, "", len(src), spaced})
+}
+
+// lexNumber returns the length of the number literal at the start of s:
+// digits, optionally followed by a fraction and an exponent.
+func lexNumber(s string) int {
+	i := digits(s, 0)
+	if i < len(s) && s[i] == '.' {
+		i = digits(s, i+1)
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		// only an exponent if followed by digits, so that 2e is 2*e.
+		if k := digits(s, j); k > j {
+			i = k
+		}
+	}
+	return i
+}
+
+// digits returns the index of the first non-digit in s, starting from i.
+func digits(s string, i int) int {
+	for i < len(s) && isDigit(rune(s[i])) {
+		i++
+	}
+	return i
+}
+
+// lexIdent returns the length of the identifier at the start of s.
+func lexIdent(s string) int {
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// lexOp returns the operator at the start of s, or "" if there is none.
+func lexOp(s string) string {
+	for _, op := range operators {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
@@ -1,6 +1,11 @@
 package jit
 
-import "golang.org/x/sys/unix"
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
 
 // functionality for making the generated machine code executable, and executing it.
 
@@ -19,32 +24,83 @@ func MakeExecutable(code []byte) ([]byte, error) {
 
 	err = unix.Mprotect(mem, unix.PROT_READ|unix.PROT_EXEC)
 	if err != nil {
-		return nil, err
 		unix.Munmap(mem)
+		return nil, err
 	}
 	return mem, nil
 }
 
 // Code stores JIT compiled machine code and allows to evaluate it.
 type Code struct {
-	instr []byte
+	instr  []byte
+	nvars  int     // number of variables expected by the code
+	shared bool    // part of a CompiledModule, which owns the memory
+	src    *source // what the code was compiled from
+
+	dualOnce sync.Once // compiles the dual code on demand, see EvalDual
+	dual     []byte
+	dualErr  error
+
+	intervalOnce sync.Once // compiles the interval code on demand, see EvalInterval
+	interval     *intervalCode
+	intervalErr  error
 }
 
 // Eval executes the code, passing values for the variables x and y,
 // and returns the result.
+// The code must have been compiled for two variables, like by Compile.
 func (c *Code) Eval(x, y float64) float64 {
+	args := [2]float64{x, y}
+	return c.EvalN(args[:])
+}
+
+// EvalN executes the code, passing values for all variables,
+// in the order they were passed to CompileVars, and returns the result.
+func (c *Code) EvalN(args []float64) float64 {
 	if len(c.instr) == 0 {
 		panic("eval called on nil code")
 	}
-	return eval(c.instr, x, y)
+	if len(args) != c.nvars {
+		panic(fmt.Sprintf("eval: need %v arguments, have %v", c.nvars, len(args)))
+	}
+	return eval(c.instr, args)
 }
 
+// Eval2D evaluates the code in the centers of an nx x ny grid spanning
+// [xmin, xmax] x [ymin, ymax], and stores the results in dst (row-major).
+// The code must have been compiled for two variables, like by Compile.
 func (c *Code) Eval2D(dst []float64, xmin, xmax float64, nx int, ymin, ymax float64, ny int) {
+	if c.nvars != 2 {
+		panic(fmt.Sprintf("eval2D: need code of 2 variables, have %v", c.nvars))
+	}
 	eval2D(c.instr, dst, xmin, xmax, nx, ymin, ymax, ny)
 }
 
+// EvalBool executes the code, passing values for the variables x and y,
+// and returns whether the result is true: non-zero, or NaN.
+// Intended for predicates like "x*x+y*y < 1 && y > 0".
+func (c *Code) EvalBool(x, y float64) bool {
+	return c.Eval(x, y) != 0
+}
+
+// Eval2DMask is like Eval2D, but stores the results as a bitmask:
+// bit i%64 of dst[i/64] is set if the result for grid cell i is true (see EvalBool).
+// dst must have length (nx*ny+63)/64.
+func (c *Code) Eval2DMask(dst []uint64, xmin, xmax float64, nx int, ymin, ymax float64, ny int) {
+	if c.nvars != 2 {
+		panic(fmt.Sprintf("eval2DMask: need code of 2 variables, have %v", c.nvars))
+	}
+	eval2DMask(c.instr, dst, xmin, xmax, nx, ymin, ymax, ny)
+}
+
 // Free unmaps the code, after which Eval cannot be called anymore.
+// Code obtained from a CompiledModule is freed together with the module,
+// Free has no effect on it.
 func (c *Code) Free() {
+	if c.shared {
+		return
+	}
+	c.freeDual()
 	unix.Munmap(c.instr)
 	c.instr = nil
 }
@@ -0,0 +1,197 @@
+package jit
+
+// this file implements compiling many functions into one piece of executable memory.
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CompiledModule holds many compiled functions, sharing one piece of executable memory.
+// Each function can be evaluated through the Code returned by Lookup.
+// It is obtained by linking a Module, or directly from the definitions with CompileModule.
+type CompiledModule struct {
+	mem   []byte
+	codes map[string]*Code
+}
+
+// CompileModule compiles function definitions, keyed by their header. E.g.:
+// 	CompileModule(map[string]string{
+// 		"sq(t)":         "t*t",
+// 		"energy(m, v)":  "m*sq(v)/2",
+// 		"ellipse(x, y)": "sq(x/2) + sq(y) < 1",
+// 	})
+// The functions may call each other, in any order, but not recursively.
+// It is the same as defining all functions in a Module, and linking it.
+// Errors in a definition are returned as a *ParseError, holding the definition like "sq(t) = t*t".
+func CompileModule(defs map[string]string) (*CompiledModule, error) {
+	headers := make([]string, 0, len(defs))
+	for h := range defs {
+		headers = append(headers, h)
+	}
+	sort.Strings(headers)
+	srcs := make([]string, len(headers))
+	for i, h := range headers {
+		srcs[i] = h + " = " + defs[h]
+	}
+	m, _, err := compileModule(srcs)
+	return m, err
+}
+
+// CompileModuleText is like CompileModule, for definitions in a text format:
+// one definition per line, like "sq(t) = t*t". Empty lines are ignored,
+// as is everything following a #. E.g.:
+// 	# kinetic energy
+// 	energy(m, v) = m*sq(v)/2
+// 	sq(t) = t*t
+// The offset of a *ParseError is relative to the whole text.
+func CompileModuleText(text string) (*CompiledModule, error) {
+	var srcs []string
+	var starts []int // offset of each definition in text
+	start := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		def := line
+		if i := strings.Index(def, "#"); i >= 0 {
+			def = def[:i]
+		}
+		if strings.TrimSpace(def) != "" {
+			srcs = append(srcs, def)
+			starts = append(starts, start)
+		}
+		start += len(line)
+	}
+	m, i, err := compileModule(srcs)
+	if perr, ok := err.(*ParseError); ok {
+		perr.Expr = text
+		perr.Offset += starts[i]
+	}
+	return m, err
+}
+
+// compileModule compiles the function definitions in srcs, one per source.
+// On error, it returns the index of the offending source.
+func compileModule(srcs []string) (*CompiledModule, int, error) {
+	defs, i, err := parseModule(srcs)
+	if err != nil {
+		return nil, i, err
+	}
+	m, err := (&Module{defs: defs, srcs: srcs}).Link()
+	return m, 0, err
+}
+
+// Link compiles all functions of the module into a CompiledModule. E.g.:
+// 	m := NewModule()
+// 	err := m.Define("sq(t) = t*t; energy(m, v) = m*sq(v)/2")
+// 	cm, err := m.Link()
+// 	code := cm.Lookup("energy")
+// Functions defined later are not part of the CompiledModule.
+func (m *Module) Link() (cm *CompiledModule, e error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ex := strings.Join(m.srcs, "\n")
+	names := make([]string, 0, len(m.defs))
+	for name := range m.defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return &CompiledModule{codes: make(map[string]*Code)}, nil // nothing to map
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			cm, e = nil, compileError(ex, err)
+		}
+	}()
+
+	// Each function gets an entry point taking its arguments as an array, for EvalN,
+	// which loads them into registers and falls through to the code for calls.
+	cc := newCompilation(m.defs, nil)
+	entries := make(map[string]int)
+	for _, name := range names {
+		d := m.defs[name]
+		entries[name] = cc.Len()
+		for i := range d.params {
+			cc.Write(mov_x_rdi_xmm(int32(8*i), byte(i)))
+		}
+		cc.assembleFunc(name)
+	}
+	mem := cc.link()
+
+	cm = &CompiledModule{mem: mem, codes: make(map[string]*Code)}
+	for _, name := range names {
+		d := m.defs[name]
+		src := &source{ex: ex, root: d.body, vars: d.params, defs: m.defs}
+		cm.codes[name] = &Code{instr: mem[entries[name]:], nvars: len(d.params), shared: true, src: src}
+	}
+	return cm, nil
+}
+
+// parseModule parses the function definitions in srcs, one per source,
+// which may call each other in any order.
+// On error, it returns the index of the offending source.
+func parseModule(srcs []string) (defs map[string]*funcDef, i int, e error) {
+	defer func() {
+		if err := recover(); err != nil {
+			perr, ok := err.(*ParseError)
+			if !ok {
+				panic(err)
+			}
+			perr.Expr = srcs[i]
+			defs, e = nil, perr
+		}
+	}()
+
+	// declare all functions first, then parse their bodies.
+	defs = make(map[string]*funcDef)
+	ps := make([]*parser, len(srcs))
+	for i = range srcs {
+		ps[i] = newParser(lex(srcs[i]), nil, nil)
+		ps[i].funcs = defs
+		ps[i].scanDefs()
+	}
+	for i = range ps {
+		p := ps[i]
+		n := defHeaderLen(p.toks)
+		if n == 0 {
+			t := p.peek(0)
+			syntaxError(KindSyntax, t, "expected function definition, like f(t) = t*t, have %v", t)
+		}
+		p.parseDef(n)
+		if p.peek(0).kind != tokEOF {
+			p.unexpected()
+		}
+	}
+	for i = range ps {
+		ps[i].checkRecursion()
+	}
+	return defs, 0, nil
+}
+
+// Lookup returns the code for the named function, or nil if it is not defined.
+// The code takes the function's arguments, in order, as the variables passed to EvalN.
+func (m *CompiledModule) Lookup(name string) *Code {
+	return m.codes[name]
+}
+
+// Names returns the names of all functions in the module, sorted.
+func (m *CompiledModule) Names() []string {
+	names := make([]string, 0, len(m.codes))
+	for name := range m.codes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Free unmaps the code of all functions, which cannot be evaluated anymore.
+func (m *CompiledModule) Free() {
+	unix.Munmap(m.mem)
+	for _, c := range m.codes {
+		c.freeDual()
+		c.instr = nil
+	}
+	m.mem = nil
+}
@@ -0,0 +1,159 @@
+package jit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestCompileModule(t *testing.T) {
+	defs := map[string]string{
+		"sq(t)":            "t*t",
+		"cube(t)":          "s := sq(t); s*t",
+		"energy(m, v)":     "m*sq(v)/2",
+		"ellipse(x, y)":    "sq(x/2) + sq(y) < 1",
+		"answer()":         "42",
+		"big(a, b)":        "a*a*a - b*b*b + a/(1+b*b) + sqrt(a*a+b*b) + a*b",
+		"twice(a, b)":      "big(a, b) + big(b, a)",
+		"mix(a, b, c, d_)": "fma(a, b, c) - twice(d_, c)*answer()",
+	}
+	tests := []struct {
+		name string
+		args []float64
+		want float64
+	}{
+		{"sq", []float64{3}, 9},
+		{"cube", []float64{3}, 27},
+		{"energy", []float64{2, 3}, 9},
+		{"ellipse", []float64{1, 0.5}, 1},
+		{"ellipse", []float64{2, 0.5}, 0},
+		{"answer", nil, 42},
+		{"big", []float64{2, 3}, big(2, 3)},
+		{"twice", []float64{-1, 0.5}, big(-1, 0.5) + big(0.5, -1)},
+		{"mix", []float64{1, 2, 3, 4}, math.FMA(1, 2, 3) - (big(4, 3)+big(3, 4))*42},
+	}
+	for _, useInlining = range []bool{true, false} {
+		m, err := CompileModule(defs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range tests {
+			code := m.Lookup(test.name)
+			if code == nil {
+				t.Errorf("lookup %v: not found", test.name)
+				continue
+			}
+			if have := code.EvalN(test.args); have != test.want {
+				t.Errorf("%v%v (inline=%v): have %v, want %v", test.name, test.args, useInlining, have, test.want)
+			}
+		}
+		if m.Lookup("nope") != nil {
+			t.Errorf("lookup undefined function: expected nil")
+		}
+		if have := len(m.Names()); have != len(defs) {
+			t.Errorf("names: have %v, want %v", have, len(defs))
+		}
+		m.Free()
+	}
+	useInlining = true
+}
+
+func TestModuleLink(t *testing.T) {
+	m := NewModule()
+	if err := m.Define("sq(t) = t*t; energy(m, v) = m*sq(v)/2"); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := m.Link()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Free()
+	if err := m.Define("later(t) = t"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := cm.Lookup("energy").EvalN([]float64{2, 3}), 9.0; have != want {
+		t.Errorf("energy(2, 3): have %v, want %v", have, want)
+	}
+	if have, want := cm.Names(), []string{"energy", "sq"}; fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("names: have %v, want %v", have, want)
+	}
+
+	empty, err := NewModule().Link()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty.Names()) != 0 {
+		t.Errorf("empty module: have %v", empty.Names())
+	}
+	empty.Free()
+}
+
+func TestCompileModuleEval2D(t *testing.T) {
+	m, err := CompileModule(map[string]string{"sq(t)": "t*t", "f(x, y)": "sq(x) - y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Free()
+	code := m.Lookup("f")
+	code.Free() // no effect, the module owns the code
+	dst := make([]float64, 4)
+	code.Eval2D(dst, 0, 2, 2, 0, 2, 2)
+	for i, want := range []float64{0.5*0.5 - 0.5, 1.5*1.5 - 0.5, 0.5*0.5 - 1.5, 1.5*1.5 - 1.5} {
+		if dst[i] != want {
+			t.Errorf("Eval2D: dst[%v]: have %v, want %v", i, dst[i], want)
+		}
+	}
+}
+
+func TestCompileModuleText(t *testing.T) {
+	text := `
+# kinetic energy
+energy(m, v) = m*sq(v)/2 # in J
+
+sq(t) = t*t
+cube(t) = s := sq(t); s*t
+`
+	m, err := CompileModuleText(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Free()
+	if have := m.Lookup("energy").EvalN([]float64{2, 3}); have != 9 {
+		t.Errorf("energy(2, 3): have %v, want 9", have)
+	}
+	if have := m.Lookup("cube").EvalN([]float64{3}); have != 27 {
+		t.Errorf("cube(3): have %v, want 27", have)
+	}
+}
+
+func TestCompileModuleErrors(t *testing.T) {
+	tests := []map[string]string{
+		{"f(x)": "x", "f(y)": "y"},         // redefined
+		{"f(x)": "g(x)", "g(x)": "f(x)+1"}, // recursive
+		{"f(x)": "g(x, x)", "g(x)": "x"},   // arity
+		{"f(x)": "x*y"},                    // undefined
+		{"f": "x"},                         // no header
+		{"f(x)": "x; g(x) = x"},            // more than one definition
+		{"sin(x)": "x"},                    // builtin
+		{"f(x)": "x +"},                    // syntax
+		{"f(a,b,c,d,e_,g,h,i,j)": "a"},     // too many arguments
+	}
+	for _, defs := range tests {
+		if _, err := CompileModule(defs); err == nil {
+			t.Errorf("compile module %q: expected error", defs)
+		}
+	}
+}
+
+func TestCompileModuleTextErrors(t *testing.T) {
+	text := "sq(t) = t*t\n# comment\nf(x) = sq(x) + y\n"
+	_, err := CompileModuleText(text)
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("want *ParseError, have %#v", err)
+	}
+	if have, want := perr.Caret(), "f(x) = sq(x) + y\n               ^"; have != want {
+		t.Errorf("caret:\nhave:\n%v\nwant:\n%v", have, want)
+	}
+}
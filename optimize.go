@@ -0,0 +1,246 @@
+package jit
+
+import "math"
+
+// OptLevel selects the rewrites done by Optimize.
+type OptLevel int
+
+const (
+	OptNone OptLevel = iota // no rewrites
+	OptFold                 // only constant folding, see FoldConst
+	OptSafe                 // also algebraic identities that preserve IEEE-754 results exactly (default)
+	OptFast                 // also rewrites that may change the result for infinite, NaN or zero operands, or its rounding
+)
+
+// Optimize returns a simplified expression, equivalent to e. E.g.:
+// 	x*1 + y/4  -> (x+(y*0.25))
+// At level OptSafe, used by Compile, the result is guaranteed to evaluate to exactly
+// the same value (including NaN and the sign of zero) as e, for all values of the variables.
+// OptFast additionally rewrites, e.g.:
+// 	x*0     -> 0     (wrong for infinite or NaN x)
+// 	x+0     -> x     (wrong for x = -0)
+// 	x-x     -> 0     (wrong for infinite or NaN x)
+// 	--x     -> x     (wrong for x = -0)
+// 	1+x+2   -> (x+3) (may round differently)
+// 	x/3     -> (x*0.3333333333333333)
+// but not x/c if 1/c overflows, like for subnormal c.
+// Subexpressions that call impure functions are never removed.
+func Optimize(e Expr, level OptLevel) Expr {
+	switch {
+	case level <= OptNone:
+		return e
+	case level == OptFold:
+		return FoldConst(e)
+	default:
+		o := optimizer{fast: level >= OptFast}
+		return o.optimize(FoldConst(e))
+	}
+}
+
+// optimizer rewrites expressions bottom-up.
+type optimizer struct {
+	fast bool // allow rewrites that do not preserve IEEE-754 results
+}
+
+func (o optimizer) optimize(e Expr) Expr {
+	e = rebuild(e, o.optimize)
+	switch e := e.(type) {
+	default:
+		return e
+	case BinExpr:
+		return o.optimizeBinexpr(e)
+	case IfExpr:
+		return foldIfexpr(e)
+	case LetExpr:
+		if isConst(e.value) {
+			return o.optimize(substitute(e.body, e.name, e.value))
+		}
+		return e
+	}
+}
+
+func (o optimizer) optimizeBinexpr(e BinExpr) Expr {
+	x, y := e.x, e.y
+	if isConst(x) && isConst(y) {
+		return foldBinexpr(e)
+	}
+
+	// identities that hold for all x, including -0, ±Inf and NaN
+	switch e.op {
+	case "+":
+		switch {
+		case isValue(y, math.Copysign(0, -1)): // x + -0 == x, while -0 + 0 == 0
+			return x
+		case isValue(x, math.Copysign(0, -1)):
+			return y
+		}
+	case "-":
+		if isValue(y, 0) {
+			return x
+		}
+	case "*":
+		switch {
+		case isValue(y, 1):
+			return x
+		case isValue(x, 1):
+			return y
+		}
+	case "/":
+		if isValue(y, 1) {
+			return x
+		}
+		if c, ok := y.(Constant); ok {
+			if r, ok := exactReciprocal(c.value); ok || (o.fast && !math.IsInf(r, 0)) { // x*Inf differs from x/c
+				return o.optimizeBinexpr(BinExpr{op: "*", x: x, y: Constant{r}})
+			}
+		}
+	}
+	if !o.fast {
+		return e
+	}
+
+	switch e.op {
+	case "+":
+		switch {
+		case isZero(y):
+			return x
+		case isZero(x):
+			return y
+		}
+	case "-":
+		switch {
+		case isZero(y):
+			return x
+		case isZero(x) && isNeg(y): // --x
+			return y.(BinExpr).y
+		case sameExpr(x, y) && isPure(x):
+			return Constant{0}
+		case isConst(y): // reassociated below
+			return o.reassociate(BinExpr{op: "+", x: x, y: Constant{-y.(Constant).value}})
+		}
+	case "*":
+		if (isZero(x) && isPure(y)) || (isZero(y) && isPure(x)) {
+			return Constant{0}
+		}
+	}
+	if e.op == "+" || e.op == "*" {
+		return o.reassociate(e)
+	}
+	return e
+}
+
+// reassociate collects the constants in a chain of additions (or multiplications), like
+// 	1+x+2 -> (x+3)
+// It keeps the order of the other operands.
+func (o optimizer) reassociate(e BinExpr) Expr {
+	var terms []Expr
+	nconst := 0
+	acc := 0.0
+	if e.op == "*" {
+		acc = 1
+	}
+	var collect func(e Expr)
+	collect = func(x Expr) {
+		switch x := x.(type) {
+		case Constant:
+			nconst++
+			if e.op == "+" {
+				acc += x.value
+			} else {
+				acc *= x.value
+			}
+			return
+		case BinExpr:
+			if x.op == e.op {
+				collect(x.x)
+				collect(x.y)
+				return
+			}
+		}
+		terms = append(terms, x)
+	}
+	collect(e)
+	if nconst == 0 {
+		return e
+	}
+
+	if e.op == "*" && acc == 0 && isPure(e) {
+		return Constant{0}
+	}
+	if len(terms) == 0 {
+		return Constant{acc}
+	}
+	r := terms[0]
+	for _, t := range terms[1:] {
+		r = BinExpr{op: e.op, x: r, y: t}
+	}
+	if (e.op == "+" && acc != 0) || (e.op == "*" && acc != 1) {
+		r = BinExpr{op: e.op, x: r, y: Constant{acc}}
+	}
+	return r
+}
+
+// exactReciprocal returns 1/c, and whether x/c == x*(1/c) for all x:
+// when c is a (positive or negative) power of two and 1/c does not overflow.
+// Then both are the correctly rounded value of the same real number.
+func exactReciprocal(c float64) (float64, bool) {
+	frac, _ := math.Frexp(c)
+	r := 1 / c
+	return r, math.Abs(frac) == 0.5 && !math.IsInf(r, 0)
+}
+
+// isValue returns whether e is the constant v, distinguishing 0 and -0.
+func isValue(e Expr, v float64) bool {
+	c, ok := e.(Constant)
+	return ok && math.Float64bits(c.value) == math.Float64bits(v)
+}
+
+// isPure returns whether e calls only pure functions,
+// so that it may be removed without changing the behavior of the program.
+func isPure(e Expr) bool {
+	if c, ok := e.(*CallExpr); ok {
+		if f, ok := lookupFunc(c.fun); !ok || !f.pure {
+			return false
+		}
+	}
+	for _, c := range e.children() {
+		if !isPure(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameExpr returns whether a and b are structurally identical.
+func sameExpr(a, b Expr) bool {
+	switch a := a.(type) {
+	case Constant:
+		return isValue(b, a.value)
+	case Variable, Ref:
+		return a == b
+	case BinExpr:
+		b, ok := b.(BinExpr)
+		return ok && a.op == b.op && sameExpr(a.x, b.x) && sameExpr(a.y, b.y)
+	case *CallExpr:
+		b, ok := b.(*CallExpr)
+		if !ok || a.fun != b.fun || len(a.args) != len(b.args) {
+			return false
+		}
+		for i := range a.args {
+			if !sameExpr(a.args[i], b.args[i]) {
+				return false
+			}
+		}
+		return true
+	case PowExpr:
+		b, ok := b.(PowExpr)
+		return ok && a.n == b.n && sameExpr(a.x, b.x)
+	case IfExpr:
+		b, ok := b.(IfExpr)
+		return ok && sameExpr(a.cond, b.cond) && sameExpr(a.x, b.x) && sameExpr(a.y, b.y)
+	case LetExpr:
+		b, ok := b.(LetExpr)
+		return ok && a.name == b.name && sameExpr(a.value, b.value) && sameExpr(a.body, b.body)
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package jit
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		expr  string
+		level OptLevel
+		want  string
+	}{
+		{"x*1 + 0", OptNone, "((x*1)+0)"},
+		{"x*1 + 2*3", OptFold, "((x*1)+6)"},
+		{"x*1", OptSafe, "x"},
+		{"1*x", OptSafe, "x"},
+		{"x/1", OptSafe, "x"},
+		{"x-0", OptSafe, "x"},
+		{"x+0", OptSafe, "(x+0)"},
+		{"x+(-0)", OptSafe, "x"},
+		{"x*0", OptSafe, "(x*0)"},
+		{"x-x", OptSafe, "(x-x)"},
+		{"-(-x)", OptSafe, "(0-(0-x))"},
+		{"x/4", OptSafe, "(x*0.25)"},
+		{"x/-0.5", OptSafe, "(x*-2)"},
+		{"x/3", OptSafe, "(x/3)"},
+		{"x/0", OptSafe, "(x/0)"},
+		{"1+x+2", OptSafe, "((1+x)+2)"},
+		{"ifelse(1*1, x*1, y)", OptSafe, "x"},
+		{"a := 2*1; a*x", OptSafe, "(2*x)"},
+
+		{"x+0", OptFast, "x"},
+		{"0+x", OptFast, "x"},
+		{"x*0", OptFast, "0"},
+		{"0*sin(x)", OptFast, "0"},
+		{"x-x", OptFast, "0"},
+		{"x/5e-324", OptFast, "(x/5e-324)"},
+		{"x/0", OptFast, "(x/0)"},
+		{"sin(x)-sin(x)", OptFast, "0"},
+		{"-(-x)", OptFast, "x"},
+		{"x/3", OptFast, "(x*0.3333333333333333)"},
+		{"1+x+2", OptFast, "(x+3)"},
+		{"1+x+y-1", OptFast, "(x+y)"},
+		{"2*x*y*3", OptFast, "((x*y)*6)"},
+		{"x*2/2", OptFast, "x"},
+		{"x+(y+z)", OptFast, "(x+(y+z))"},
+	}
+	for _, test := range tests {
+		root, err := ParseVars(test.expr, "x", "y", "z")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := fmt.Sprint(Optimize(root, test.level)); have != test.want {
+			t.Errorf("Optimize %q, level %v: have %v, want %v", test.expr, test.level, have, test.want)
+		}
+	}
+}
+
+// impure calls must not be removed.
+func TestOptimizeImpure(t *testing.T) {
+	cos, _ := lookupFunc("cos")
+	impure := uniqueName("impure_opt_test")
+	if err := RegisterFunc(impure, cos.ptr, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, ex := range []string{"0*" + impure + "(x)", impure + "(x)-" + impure + "(x)"} {
+		root, err := Parse(ex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := Optimize(root, OptFast); isConst(have) {
+			t.Errorf("Optimize %q: have %v", ex, have)
+		}
+	}
+}
+
+// OptSafe must not change any result, bit for bit.
+func TestOptimizeSafe(t *testing.T) {
+	defer func() { useConstFolding = true }()
+	exprs := []string{
+		"x*1 + y", "x-0", "x+(-0)", "(-0)+x", "1*x/1", "x/4", "x/0.125", "y/-2", "x/1.1125369292536007e-308",
+		"x*1 - y/1", "ifelse(1*1, x*1, y)", "a := 2*1; a*x/1",
+	}
+	special := []float64{0, math.Copysign(0, -1), 1, -1, 3, math.Inf(1), math.Inf(-1), math.NaN(),
+		math.MaxFloat64, math.SmallestNonzeroFloat64, 0x1p-1022, -0x1.8p-1070, 0x1p53}
+	for _, ex := range exprs {
+		useConstFolding = false
+		plain, err := Compile(ex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		useConstFolding = true
+		opt, err := Compile(ex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, x := range special {
+			for _, y := range special {
+				have, want := opt.Eval(x, y), plain.Eval(x, y)
+				if math.Float64bits(have) != math.Float64bits(want) && !(math.IsNaN(have) && math.IsNaN(want)) {
+					t.Errorf("%q at (%v, %v): have %v, want %v", ex, x, y, have, want)
+				}
+			}
+		}
+		plain.Free()
+		opt.Free()
+	}
+}
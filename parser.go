@@ -1,98 +1,452 @@
 package jit
 
+// this file implements a precedence-climbing parser for the expression language.
+
 import (
 	"fmt"
-	"go/ast"
-	"go/parser"
-	"go/token"
 	"strconv"
+	"strings"
 )
 
-func Parse(expr string) (root expr, e error) {
-	node, err := parser.ParseExpr(expr)
+// Parse parses an expression of the variables x and y.
+func Parse(expr string) (root Expr, e error) {
+	return ParseVars(expr, "x", "y")
+}
+
+// ParseVars parses an expression which may contain the given variables.
+// The expression may be preceded by local bindings and function definitions,
+// separated by semicolons. E.g.:
+// 	r := sqrt(x*x+y*y); th := atan(y/x); sin(5*th) - r + 1
+// 	f(t) = t*t - 1; f(x) * f(y)
+// Calls to functions defined in the expression are expanded inline.
+func ParseVars(expr string, vars ...string) (root Expr, e error) {
+	root, defs, err := parse(expr, vars, nil, true)
 	if err != nil {
-		return nil, fmt.Errorf("parse %q: %v", expr, err)
+		return nil, err
 	}
+	in := newInliner(defs, vars, true)
+	return in.expand(root), nil
+}
+
+// parse parses src, which may call the user functions in defs.
+// It returns the expression, and defs extended with the functions defined in src.
+// If wantExpr is false, src may only hold function definitions.
+func parse(src string, vars []string, defs map[string]*funcDef, wantExpr bool) (root Expr, all map[string]*funcDef, e error) {
 	defer func() {
 		if err := recover(); err != nil {
-			root = nil
-			e = fmt.Errorf("parse %q: %v", expr, err)
+			perr, ok := err.(*ParseError)
+			if !ok {
+				panic(err)
+			}
+			perr.Expr = src
+			root, all, e = nil, nil, perr
 		}
 	}()
-	return parseExpr(node), nil
+	p := newParser(lex(src), vars, defs)
+	p.scanDefs()
+	if wantExpr {
+		root = p.parseStmts()
+	} else {
+		p.parseDefs()
+	}
+	p.checkRecursion()
+	return root, p.funcs, nil
 }
 
-func parseExpr(node ast.Expr) expr {
-	switch node := node.(type) {
-	default:
-		panic(fmt.Sprintf("syntax error: %T", node))
-	case *ast.BasicLit:
-		return parseBasicLit(node)
-	case *ast.BinaryExpr:
-		return parseBinaryExpr(node)
-	case *ast.CallExpr:
-		return parseCallExpr(node)
-	case *ast.Ident:
-		return parseIdent(node)
-	case *ast.ParenExpr:
-		return parseExpr(node.X)
-	case *ast.UnaryExpr:
-		return parseUnaryExpr(node)
-	}
-}
-
-func parseBasicLit(node *ast.BasicLit) expr {
-	switch node.Kind {
-	default:
-		panic(fmt.Sprintf("syntax error: %v (%T)", node.Value, node))
-	case token.FLOAT, token.INT:
-		v, err := strconv.ParseFloat(node.Value, 64)
-		if err != nil {
-			panic(err)
+// parser holds the state needed to transform tokens into our AST.
+type parser struct {
+	toks   []token             // remaining tokens, ending with tokEOF
+	vars   map[string]bool     // allowed variable names
+	locals map[string]bool     // names bound so far
+	funcs  map[string]*funcDef // user functions, including those defined in the source
+	defs   []*funcDef          // functions defined in the source, in order
+}
+
+func newParser(toks []token, vars []string, defs map[string]*funcDef) *parser {
+	p := &parser{toks: toks, vars: make(map[string]bool), locals: make(map[string]bool), funcs: make(map[string]*funcDef)}
+	for _, v := range vars {
+		p.vars[v] = true
+	}
+	for name, d := range defs {
+		p.funcs[name] = d
+	}
+	return p
+}
+
+// peek returns the n'th token ahead, or the final tokEOF.
+func (p *parser) peek(n int) token {
+	if n >= len(p.toks) {
+		n = len(p.toks) - 1
+	}
+	return p.toks[n]
+}
+
+// next consumes and returns the current token.
+func (p *parser) next() token {
+	t := p.toks[0]
+	if t.kind != tokEOF {
+		p.toks = p.toks[1:]
+	}
+	return t
+}
+
+// is returns whether the n'th token ahead is operator op.
+func (p *parser) is(n int, op string) bool {
+	t := p.peek(n)
+	return t.kind == tokOp && t.text == op
+}
+
+// expect consumes operator op, or panics with a syntax error.
+func (p *parser) expect(op string) {
+	if !p.is(0, op) {
+		p.unexpected()
+	}
+	p.next()
+}
+
+// unexpected panics with a syntax error about the current token.
+func (p *parser) unexpected() {
+	t := p.peek(0)
+	if t.kind == tokOp && t.text == "=" { // only allowed in function definitions
+		syntaxError(KindUnsupportedOp, t, "unsupported operator %v, use := or ==", t)
+	}
+	syntaxError(KindSyntax, t, "unexpected %v", t)
+}
+
+// parseStmts parses a list of bindings (name := value;) and function definitions,
+// followed by an expression, into nested LetExprs.
+func (p *parser) parseStmts() Expr {
+	if n := defHeaderLen(p.toks); n > 0 {
+		p.parseDef(n)
+		p.expect(";")
+		return p.parseStmts()
+	}
+	if p.peek(0).kind == tokIdent && p.is(1, "=") { // binding with = instead of :=
+		p.next()
+		p.unexpected()
+	}
+	if p.isLet() {
+		return p.parseLet(p.parseStmts)
+	}
+	e := p.parseExpr()
+	if p.is(0, ";") {
+		p.next()
+	}
+	if p.peek(0).kind != tokEOF {
+		p.unexpected()
+	}
+	return e
+}
+
+// isLet returns whether a binding, like r := x*x;, follows.
+func (p *parser) isLet() bool {
+	return p.peek(0).kind == tokIdent && p.is(1, ":=")
+}
+
+// parseLet parses a binding, like r := x*x;, whose body follows and is parsed by body.
+func (p *parser) parseLet(body func() Expr) Expr {
+	id := p.next()
+	p.next()
+	value := p.parseExpr()
+	p.expect(";")
+	p.declare(id)
+	return LetExpr{name: id.text, value: value, body: body()}
+}
+
+// parseBody parses a function body: bindings, like r := x*x;, followed by an expression.
+func (p *parser) parseBody() Expr {
+	if p.isLet() {
+		return p.parseLet(p.parseBody)
+	}
+	return p.parseExpr()
+}
+
+// declare adds a local name, which may not clash with any other name.
+func (p *parser) declare(id token) {
+	name := id.text
+	_, isConst := lookupConst(name)
+	if p.vars[name] || p.locals[name] || isConst || isFunc(name) || p.funcs[name] != nil {
+		syntaxError(KindRedeclared, id, "%v redeclared", name)
+	}
+	p.locals[name] = true
+}
+
+// parseDefs parses function definitions, separated by semicolons.
+func (p *parser) parseDefs() {
+	for p.peek(0).kind != tokEOF {
+		n := defHeaderLen(p.toks)
+		if n == 0 {
+			t := p.peek(0)
+			syntaxError(KindSyntax, t, "expected function definition, like f(t) = t*t, have %v", t)
+		}
+		p.parseDef(n)
+		if !p.is(0, ";") {
+			break
 		}
-		return constant{value: v}
+		p.next()
+	}
+	if p.peek(0).kind != tokEOF {
+		p.unexpected()
 	}
 }
 
-func parseBinaryExpr(node *ast.BinaryExpr) expr {
-	x := parseExpr(node.X)
-	y := parseExpr(node.Y)
-	switch node.Op {
-	default:
-		panic(fmt.Sprintf("syntax error:", node.Op))
-	case token.ADD, token.SUB, token.MUL, token.QUO:
-		return binexpr{node.Op.String(), x, y}
+// defHeaderLen returns the number of tokens in the function definition header
+// at the start of toks, like "f(a, b) =", or 0 if there is none.
+func defHeaderLen(toks []token) int {
+	isOp := func(i int, op string) bool {
+		return i < len(toks) && toks[i].kind == tokOp && toks[i].text == op
+	}
+	if len(toks) == 0 || toks[0].kind != tokIdent || !isOp(1, "(") {
+		return 0
+	}
+	i := 2
+	for i < len(toks) && toks[i].kind == tokIdent {
+		i++
+		if !isOp(i, ",") {
+			break
+		}
+		i++
+	}
+	if !isOp(i, ")") || !isOp(i+1, "=") {
+		return 0
 	}
+	return i + 2
 }
 
-func parseCallExpr(node *ast.CallExpr) expr {
-	fun := node.Fun.(*ast.Ident).Name
-	if len(node.Args) != 1 {
-		panic(fmt.Sprintf("%v needs 1 argument, have %v", fun, len(node.Args)))
+// scanDefs declares all functions defined in the source, before their bodies are parsed,
+// so that they can be called before their definition.
+func (p *parser) scanDefs() {
+	for i := range p.toks {
+		if i > 0 && !(p.toks[i-1].kind == tokOp && p.toks[i-1].text == ";") {
+			continue // not at the start of a statement
+		}
+		n := defHeaderLen(p.toks[i:])
+		if n == 0 {
+			continue
+		}
+		id := p.toks[i]
+		_, isConst := lookupConst(id.text)
+		if p.vars[id.text] || isConst || isFunc(id.text) || p.funcs[id.text] != nil {
+			syntaxError(KindRedeclared, id, "%v redeclared", id.text)
+		}
+		d := &funcDef{name: id.text, tok: id}
+		for _, t := range p.toks[i+2 : i+n-2] {
+			if t.kind == tokIdent {
+				d.params = append(d.params, t.text)
+			}
+		}
+		if len(d.params) > maxArity {
+			syntaxError(KindArity, id, "%v has %v parameters, more than %v", id.text, len(d.params), maxArity)
+		}
+		p.funcs[d.name] = d
+		p.defs = append(p.defs, d)
 	}
-	arg := parseExpr(node.Args[0])
-	if funcs[fun] == 0 {
-		panic(fmt.Sprintf("undefined: %q", fun))
+}
+
+// parseDef parses the function definition starting with the header of n tokens,
+// declared before by scanDefs.
+func (p *parser) parseDef(n int) {
+	d := p.funcs[p.peek(0).text]
+	params := make(map[string]bool)
+	for _, t := range p.toks[2 : n-2] {
+		if t.kind != tokIdent {
+			continue
+		}
+		_, isConst := lookupConst(t.text)
+		if params[t.text] || isConst || isFunc(t.text) || p.funcs[t.text] != nil {
+			syntaxError(KindRedeclared, t, "%v redeclared", t.text)
+		}
+		params[t.text] = true
 	}
-	return callexpr{fun, arg}
+	p.toks = p.toks[n:]
+
+	// the body only sees the parameters, not the variables and locals of the caller.
+	vars, locals := p.vars, p.locals
+	p.vars, p.locals = params, make(map[string]bool)
+	d.body = p.parseBody()
+	p.vars, p.locals = vars, locals
 }
 
-func parseIdent(node *ast.Ident) expr {
-	switch node.Name {
-	default:
-		panic(fmt.Sprintf("undefined: %v", node.Name))
-	case "x", "y":
-		return variable{name: node.Name}
+// checkRecursion panics if a function defined in the source calls itself,
+// directly or indirectly.
+func (p *parser) checkRecursion() {
+	for _, d := range p.defs {
+		if path := callPath(d, d.name, p.funcs, make(map[string]bool)); path != nil {
+			syntaxError(KindRecursion, d.tok, "recursive function: %v", strings.Join(path, " -> "))
+		}
+	}
+}
+
+// binary operator precedence, as in Go. Higher binds tighter.
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5,
+}
+
+// parseExpr parses an expression, optionally conditional: cond ? x : y.
+func (p *parser) parseExpr() Expr {
+	cond := p.parseBinary(1)
+	if !p.is(0, "?") {
+		return cond
+	}
+	p.next()
+	x := p.parseExpr()
+	p.expect(":")
+	y := p.parseExpr()
+	return IfExpr{cond: cond, x: x, y: y}
+}
+
+// parseBinary parses left-associative binary operators
+// of at least precedence minPrec.
+func (p *parser) parseBinary(minPrec int) Expr {
+	x := p.parseUnary()
+	for {
+		t := p.peek(0)
+		prec, ok := precedence[t.text]
+		if t.kind != tokOp || !ok || prec < minPrec {
+			return x
+		}
+		p.next()
+		x = BinExpr{t.text, x, p.parseBinary(prec + 1)}
 	}
 }
 
-func parseUnaryExpr(node *ast.UnaryExpr) expr {
-	switch node.Op {
+// parseUnary parses unary operators +, - and !.
+// They bind less tightly than powers: -x^2 == -(x^2).
+func (p *parser) parseUnary() Expr {
+	t := p.peek(0)
+	if t.kind == tokOp && (t.text == "+" || t.text == "-" || t.text == "!") {
+		p.next()
+		return unary(t.text, p.parseUnary())
+	}
+	return p.parsePower()
+}
+
+// unary returns the expression for unary operator op applied to x.
+func unary(op string, x Expr) Expr {
+	switch op {
 	default:
-		panic(fmt.Sprintf("syntax error: %v", node.Op))
-	case token.ADD:
-		return parseExpr(node.X)
-	case token.SUB:
-		return binexpr{node.Op.String(), constant{value: 0}, parseExpr(node.X)}
+		panic(fmt.Sprintf("bug: unary %v", op))
+	case "+":
+		return x
+	case "-":
+		if c, ok := x.(Constant); ok { // negative number literal
+			return Constant{value: -c.value}
+		}
+		return BinExpr{"-", Constant{value: 0}, x}
+	case "!":
+		return BinExpr{"==", x, Constant{value: 0}}
+	}
+}
+
+// parsePower parses x^y, also written x**y.
+// It is right-associative, x^y^z == x^(y^z),
+// and the exponent may have a sign: x^-2.
+func (p *parser) parsePower() Expr {
+	x := p.parsePrimary()
+	if p.is(0, "^") || p.is(0, "**") {
+		p.next()
+		return BinExpr{"^", x, p.parseUnary()}
+	}
+	return x
+}
+
+// parsePrimary parses a number, identifier, function call or parenthesized expression.
+func (p *parser) parsePrimary() Expr {
+	t := p.peek(0)
+	switch {
+	case t.kind == tokNumber:
+		return p.parseNumber()
+	case t.kind == tokIdent && p.is(1, "("):
+		return p.parseCall()
+	case t.kind == tokIdent:
+		return p.parseIdent()
+	case p.is(0, "("):
+		p.next()
+		x := p.parseExpr()
+		p.expect(")")
+		return x
+	}
+	p.unexpected()
+	panic("unreachable")
+}
+
+// parseNumber parses a number literal. A number directly followed by
+// an identifier or parenthesis multiplies it: 2x^2 == 2*(x^2).
+func (p *parser) parseNumber() Expr {
+	t := p.next()
+	v, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		syntaxError(KindSyntax, t, "invalid number %q", t.text)
+	}
+	c := Constant{value: v}
+	if next := p.peek(0); !next.spaced && (next.kind == tokIdent || p.is(0, "(")) {
+		return BinExpr{"*", c, p.parsePower()}
+	}
+	return c
+}
+
+func (p *parser) parseIdent() Expr {
+	t := p.next()
+	if p.vars[t.text] {
+		return Variable{name: t.text}
+	}
+	if p.locals[t.text] {
+		return Ref{name: t.text}
+	}
+	if v, ok := lookupConst(t.text); ok {
+		return Constant{value: v}
+	}
+	syntaxError(KindUnknownIdent, t, "undefined: %v", t.text)
+	panic("unreachable")
+}
+
+// parseCall parses a function call like atan2(y, x),
+// including the special forms select(c, x, y) (or its alias ifelse) and pow(x, y).
+func (p *parser) parseCall() Expr {
+	id := p.next()
+	args := p.parseArgs()
+	switch id.text {
+	case "select", "ifelse":
+		checkArity(id, 3, len(args))
+		return IfExpr{cond: args[0], x: args[1], y: args[2]}
+	case "pow":
+		checkArity(id, 2, len(args))
+		return BinExpr{"^", args[0], args[1]}
+	}
+	if f, ok := lookupFunc(id.text); ok {
+		checkArity(id, f.arity, len(args))
+		return &CallExpr{id.text, args}
+	}
+	if d, ok := p.funcs[id.text]; ok {
+		checkArity(id, len(d.params), len(args))
+		return &CallExpr{id.text, args}
+	}
+	syntaxError(KindUnknownIdent, id, "undefined: %q", id.text)
+	panic("unreachable")
+}
+
+// parseArgs parses a parenthesized, comma-separated argument list.
+func (p *parser) parseArgs() []Expr {
+	p.expect("(")
+	var args []Expr
+	for !p.is(0, ")") {
+		args = append(args, p.parseExpr())
+		if !p.is(0, ",") {
+			break
+		}
+		p.next()
+	}
+	p.expect(")")
+	return args
+}
+
+// checkArity panics if function id is called with have instead of want arguments.
+func checkArity(id token, want, have int) {
+	if have != want {
+		syntaxError(KindArity, id, "%v needs %v arguments, have %v", id.text, want, have)
 	}
 }
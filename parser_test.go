@@ -0,0 +1,75 @@
+package jit
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseSyntax(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"x^2", "(x^2)"},
+		{"x**2", "(x^2)"},
+		{"x^y^2", "(x^(y^2))"},
+		{"-x^2", "(0-(x^2))"},
+		{"x^-2", "(x^-2)"},
+		{"2*x^y", "(2*(x^y))"},
+		{"1e3", "1000"},
+		{"1.5E-3", "0.0015"},
+		{".5e+1", "5"},
+		{"2e", "(2*2.718281828459045)"},
+		{"2x", "(2*x)"},
+		{"2x^2", "(2*(x^2))"},
+		{"3(x+1)", "(3*(x+1))"},
+		{"2 x", ""},
+		{"+-x", "(0-x)"},
+		{"-(-x)", "(0-(0-x))"},
+		{"x<y ? x : y", "select((x<y),x,y)"},
+		{"x ? 1 : y ? 2 : 3", "select(x,1,select(y,2,3))"},
+		{"select(x, 1, ifelse(y, 2, 3))", "select(x,1,select(y,2,3))"},
+		{"x || y && x", "(x||(y&&x))"},
+		{"x - y - 1", "((x-y)-1)"},
+		{"x / y * 2", "((x/y)*2)"},
+		{"r := x; r;", "r := x; r"},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.in)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("parse %q: expected error, have %v", test.in, e)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse %q: %v", test.in, err)
+			continue
+		}
+		if have := fmt.Sprint(e); have != test.want {
+			t.Errorf("parse %q: have %v, want %v", test.in, have, test.want)
+		}
+	}
+}
+
+func TestParseErrorOffset(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "offset 0: unexpected end of expression"},
+		{"x + ", "offset 4: unexpected end of expression"},
+		{"x + $", `offset 4: unexpected "$"`},
+		{"x + z", "offset 4: undefined: z"},
+		{"1 + foo(x)", `offset 4: undefined: "foo"`},
+		{"x * sin(x, y)", "offset 4: sin needs 1 arguments, have 2"},
+		{"(x+y", "offset 4: unexpected end of expression"},
+		{"x y", `offset 2: unexpected "y"`},
+		{"r := 1; r := 2; r", "offset 8: r redeclared"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.in)
+		if err == nil || !strings.HasSuffix(err.Error(), test.want) {
+			t.Errorf("parse %q: have error %v, want %v", test.in, err, test.want)
+		}
+	}
+}
@@ -10,24 +10,57 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"html"
 	"image"
 	"image/color"
 	"image/jpeg"
 	"log"
 	"net/http"
+	"net/url"
 
 	"github.com/barnex/just-in-time-compiler"
 )
 
 var port = flag.String("http", ":8080", "HTTP service address")
 
+// defaultExpr is plotted on the landing page, without an expression in the path.
+const defaultExpr = "x*x+y*y-1"
+
 func main() {
 	flag.Parse()
+	http.HandleFunc("/", handlePage)
 	http.HandleFunc("/plot/", handlePlot)
 	log.Println("Serving at", *port)
 	log.Fatal(http.ListenAndServe(*port, nil))
 }
 
+// handlePage serves a page showing the equation and its plot.
+func handlePage(w http.ResponseWriter, r *http.Request) {
+	expr := r.URL.Path[len("/"):]
+	if expr == "" {
+		expr = defaultExpr
+	}
+	root, err := jit.Parse(expr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	eq := jit.NewBinExpr("==", root, jit.NewConstant(0))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, page, jit.FormatMathML(eq), html.EscapeString("/plot/"+url.PathEscape(expr)))
+}
+
+const page = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>jit plotter</title></head>
+<body>
+<p>%s</p>
+<img src="%s">
+</body>
+</html>
+`
+
 func handlePlot(w http.ResponseWriter, r *http.Request) {
 	expr := r.URL.Path[len("/plot/"):]
 	code, err := jit.Compile(expr)
@@ -39,14 +72,7 @@ func handlePlot(w http.ResponseWriter, r *http.Request) {
 	nx, ny := 500, 500
 	xmin, xmax := -10.0, 10.0
 	ymin, ymax := -10.0, 10.0
-
-	dst := make([]float64, nx*ny)
-	matrix := make([][]float64, ny)
-	for iy := range matrix {
-		matrix[iy] = dst[iy*nx : (iy+1)*nx]
-	}
-
-	code.Eval2D(dst, xmin, xmax, nx, ymin, ymax, ny)
+	dx, dy := (xmax-xmin)/float64(nx), (ymax-ymin)/float64(ny)
 
 	img := image.NewRGBA(image.Rect(0, 0, nx, ny))
 	for iy := 0; iy < ny; iy++ {
@@ -54,21 +80,34 @@ func handlePlot(w http.ResponseWriter, r *http.Request) {
 			img.Set(ix, iy, color.White)
 		}
 	}
+
+	// Draw the pixels the curve may pass through: those where the bounds on
+	// the expression hold zero. Unlike looking for sign changes between pixels,
+	// this also finds curves that touch zero without crossing it, like (x-y)^2.
+	// Blocks of pixels without the curve are skipped at once, others are split in four.
 	pen := color.RGBA{B: 150}
-	for iy := 0; iy < ny; iy++ {
-		for ix := 0; ix < nx-1; ix++ {
-			if matrix[iy][ix]*matrix[iy][ix+1] < 0 {
-				img.Set(ix, iy, pen)
-			}
+	var plot func(ix0, ix1, iy0, iy1 int)
+	plot = func(ix0, ix1, iy0, iy1 int) {
+		lo, hi := code.EvalInterval(xmin+float64(ix0)*dx, xmin+float64(ix1)*dx, ymin+float64(iy0)*dy, ymin+float64(iy1)*dy)
+		if !(lo <= 0 && hi >= 0) {
+			return
 		}
-	}
-	for iy := 0; iy < ny-1; iy++ {
-		for ix := 0; ix < nx; ix++ {
-			if matrix[iy][ix]*matrix[iy+1][ix] < 0 {
-				img.Set(ix, iy, pen)
+		if ix1-ix0 == 1 && iy1-iy0 == 1 {
+			img.Set(ix0, iy0, pen)
+			return
+		}
+		xs := []int{ix0, (ix0 + ix1) / 2, ix1}
+		ys := []int{iy0, (iy0 + iy1) / 2, iy1}
+		for i := 0; i < 2; i++ {
+			for j := 0; j < 2; j++ {
+				if xs[i] < xs[i+1] && ys[j] < ys[j+1] {
+					plot(xs[i], xs[i+1], ys[j], ys[j+1])
+				}
 			}
 		}
 	}
+	plot(0, nx, 0, ny)
+
 	w.Header().Set("Content-Type", "image/jpeg")
 	jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
 }
@@ -0,0 +1,99 @@
+package jit
+
+// this file implements the lowering of powers x^y.
+
+import "math"
+
+// maxPowi is the largest integer exponent expanded into multiplications.
+// The rounding error of repeated squaring grows with the exponent,
+// larger exponents are passed to pow() instead.
+const maxPowi = 64
+
+// expandPow returns a new expression where powers with a constant exponent
+// have been replaced by cheaper operations:
+// 	x^0   -> 1
+// 	x^1   -> x
+// 	x^n   -> x*x*...*x (by repeated squaring, for integer n)
+// 	x^-n  -> 1/(x^n)
+// All other powers remain, and are compiled into a call to pow().
+// Note that x^0.5 is not sqrt(x), which differs for x = -0 and -Inf.
+func expandPow(e Expr) Expr {
+	e = rebuild(e, expandPow)
+	if e, ok := e.(BinExpr); ok && e.op == "^" {
+		if c, ok := e.y.(Constant); ok {
+			return powConst(e.x, c.value)
+		}
+	}
+	return e
+}
+
+// powConst returns x^c, with c a constant exponent.
+func powConst(x Expr, c float64) Expr {
+	switch {
+	case c == 0:
+		return Constant{1} // pow(x, 0) == 1, even for NaN
+	case c == 1:
+		return x
+	case c == math.Trunc(c) && c > 0 && c <= maxPowi:
+		return PowExpr{x: x, n: int(c)}
+	case c == math.Trunc(c) && c < 0 && c >= -maxPowi:
+		return BinExpr{op: "/", x: Constant{1}, y: powConst(x, -c)}
+	default:
+		return BinExpr{op: "^", x: x, y: Constant{c}}
+	}
+}
+
+// foldPow returns x^y, computed like the generated code for x^y with a constant exponent:
+// lowered by expandPow, or a call to pow(). Math.Pow may round differently.
+func foldPow(x, y float64) float64 {
+	e := powConst(Constant{x}, y)
+	if e, ok := e.(BinExpr); ok && e.op == "^" {
+		pow, _ := lookupFunc("pow")
+		return pow.call(x, y)
+	}
+	return FoldConst(e).(Constant).value
+}
+
+// powi returns x^n (n > 0), with the same multiplications as the code emitted by compilePowexpr.
+func powi(x float64, n int) float64 {
+	var acc float64
+	have := false // whether acc holds a partial product
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			if have {
+				acc *= x
+			} else {
+				acc, have = x, true
+			}
+		}
+		if n > 1 {
+			x *= x
+		}
+	}
+	return acc
+}
+
+// compilePowexpr emits code for x^n by repeated squaring (right-to-left binary exponentiation):
+// x is squared in xmm0, while the factors corresponding to set bits of n are accumulated in xmm1.
+// E.g. x^13 = x * x^4 * x^8, which takes 5 multiplications.
+func (b *buf) compilePowexpr(e PowExpr) {
+	if e.n < 1 {
+		panic("powexpr: exponent must be positive")
+	}
+	b.compileExpr(e.x)
+	acc := false // whether xmm1 holds a partial product
+	for n := e.n; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			if acc {
+				b.emit(mul_xmm0_xmm1)
+			} else {
+				b.emit(mov_xmm(0, 1))
+				acc = true
+			}
+		}
+		if n > 1 {
+			b.emit(mul_xmm0_xmm0)
+		}
+	}
+	b.emit(mov_xmm(1, 0))
+}
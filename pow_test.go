@@ -0,0 +1,95 @@
+package jit
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestExpandPow(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"x**0", "1"},
+		{"x**1", "x"},
+		{"x**2", "(x^2)"},
+		{"x**13", "(x^13)"},
+		{"x**-3", "(1/(x^3))"},
+		{"x**0.5", "(x^0.5)"},
+		{"x**1.5", "(x^1.5)"},
+		{"x**y", "(x^y)"},
+		{"x**1000", "(x^1000)"},
+		{"2*x**2/y", "((2*(x^2))/y)"},
+		{"sin(x**3)", "sin((x^3))"},
+	}
+	for _, test := range tests {
+		root, err := Parse(test.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := fmt.Sprint(expandPow(root)); have != test.want {
+			t.Errorf("expandPow %q: have %v, want %v", test.expr, have, test.want)
+		}
+	}
+
+	// PowExpr and BinExpr "^" print the same, check the node types.
+	for _, test := range []struct {
+		expr string
+		want Expr
+	}{
+		{"x**13", PowExpr{}},
+		{"x**1000", BinExpr{}},
+		{"x**1.5", BinExpr{}},
+	} {
+		root, err := Parse(test.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := expandPow(root); fmt.Sprintf("%T", have) != fmt.Sprintf("%T", test.want) {
+			t.Errorf("expandPow %q: have %T, want %T", test.expr, have, test.want)
+		}
+	}
+}
+
+// x^0.5 must call pow(), not sqrt(), which differs for -0 and -Inf.
+func TestPowHalf(t *testing.T) {
+	code, err := Compile("x^0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+	for _, test := range []struct{ x, want float64 }{
+		{math.Copysign(0, -1), 0},
+		{math.Inf(-1), math.Inf(1)},
+		{4, 2},
+	} {
+		if have := code.Eval(test.x, 0); math.Float64bits(have) != math.Float64bits(test.want) {
+			t.Errorf("%v^0.5: have %v, want %v", test.x, have, test.want)
+		}
+	}
+}
+
+func TestPowMultiplications(t *testing.T) {
+	tests := []struct {
+		n, want int
+	}{
+		{2, 1},
+		{3, 2},
+		{4, 2},
+		{8, 3},
+		{13, 5},
+		{64, 6},
+	}
+	for _, test := range tests {
+		var b buf
+		b.compilePowexpr(PowExpr{x: Constant{2}, n: test.n})
+		have := bytes.Count(b.Bytes(), mul_xmm0_xmm0) + bytes.Count(b.Bytes(), mul_xmm0_xmm1)
+		if have != test.want {
+			t.Errorf("x^%v: have %v multiplications, want %v", test.n, have, test.want)
+		}
+	}
+}
@@ -0,0 +1,569 @@
+package jit
+
+// this file implements rendering expressions as mathematical formulas, in LaTeX or MathML.
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FormatLaTeX renders an expression as a LaTeX formula, for use in math mode. E.g.:
+// 	sqrt(x*x+y*y) - 2*cos(x/2)
+// becomes
+// 	\sqrt{x \cdot x + y \cdot y} - 2\cos\left(\frac{x}{2}\right)
+// Parentheses are added where precedence requires, fractions and powers
+// are typeset as such, and Greek variable names like theta get their symbol.
+// Some functions use \operatorname, which needs the amsmath package (or MathJax, KaTeX).
+func FormatLaTeX(e Expr) string {
+	var w latexWriter
+	w.write(layout(e, mathLet))
+	return w.String()
+}
+
+// FormatMathML renders an expression as a presentation MathML element, like FormatLaTeX:
+// 	<math xmlns="http://www.w3.org/1998/Math/MathML">...</math>
+// which can be embedded in an HTML page.
+func FormatMathML(e Expr) string {
+	var w mathmlWriter
+	w.WriteString(`<math xmlns="http://www.w3.org/1998/Math/MathML">`)
+	w.write(layout(e, mathLet))
+	w.WriteString(`</math>`)
+	return w.String()
+}
+
+// A box is a typeset (part of a) formula, independent of the output format:
+// one of the types below. Each writer renders boxes in its own format.
+type box interface{}
+
+type (
+	number string // digits, like 1.5
+	ident  string // variable, binding or named constant (pi, e, inf, nan)
+	symbol string // operator: one of the language's binary operators, or neg, := , ;
+	row    []box  // juxtaposed boxes
+
+	// parenthesized box, the delimiters are ( | floor or ceil.
+	fenced struct {
+		delim string
+		body  box
+	}
+
+	frac struct{ num, den box }
+	sup  struct{ base, exp box }
+	root struct{ x box }
+
+	// function application
+	apply struct {
+		fun  string
+		args []box
+	}
+
+	// conditional value, see caseRow.
+	cases []caseRow
+)
+
+// caseRow is the value of a cases box if cond is true, or otherwise if cond is nil.
+type caseRow struct {
+	value, cond box
+}
+
+// precedence levels for typesetting, higher binds tighter.
+// Binary operators have their parser precedence, where negation binds like + and -.
+// Fractions, square roots and the exponents of powers are self-delimiting.
+const (
+	mathLet     = -1 // a = x; body
+	mathIf      = 0  // cases
+	mathNeg     = 4  // -x
+	mathFrac    = 6  // \frac{x}{y}
+	mathPow     = 7  // x^{y}
+	mathPrimary = 8  // number, identifier, function application or parenthesized formula
+)
+
+// layout typesets e, in parentheses if it binds less tightly than minPrec.
+func layout(e Expr, minPrec int) box {
+	b, prec := layoutPrec(e)
+	if prec < minPrec {
+		return fenced{"(", b}
+	}
+	return b
+}
+
+// layoutPrec typesets e and returns its precedence.
+func layoutPrec(e Expr) (box, int) {
+	switch e := e.(type) {
+	default:
+		return ident("?"), mathPrimary // e.g. nil
+	case Constant:
+		return layoutConst(e.value)
+	case Variable:
+		return ident(e.name), mathPrimary
+	case Ref:
+		return ident(e.name), mathPrimary
+	case BinExpr:
+		return layoutBinexpr(e)
+	case PowExpr:
+		return sup{layout(e.x, mathPrimary), number(strconv.Itoa(e.n))}, mathPow
+	case *CallExpr:
+		return layoutCall(e), mathPrimary
+	case IfExpr:
+		var c cases
+		for { // flatten c1? x: c2? y: z
+			c = append(c, caseRow{layout(e.x, mathIf), layout(e.cond, mathIf)})
+			next, ok := e.y.(IfExpr)
+			if !ok {
+				break
+			}
+			e = next
+		}
+		return append(c, caseRow{layout(e.y, mathIf), nil}), mathIf
+	case LetExpr:
+		return row{ident(e.name), symbol(":="), layout(e.value, mathIf), symbol(";"), layout(e.body, mathLet)}, mathLet
+	}
+}
+
+func layoutBinexpr(e BinExpr) (box, int) {
+	switch {
+	case isNegation(e):
+		return row{symbol("neg"), layout(e.y, mathNeg+1)}, mathNeg
+	case e.op == "/":
+		return frac{layout(e.x, mathLet), layout(e.y, mathLet)}, mathFrac
+	case e.op == "^":
+		return sup{layout(e.x, mathPrimary), layout(e.y, mathLet)}, mathPow
+	}
+	if x, ok := negated(e.x); ok && e.op == "*" {
+		if _, ok := negated(x); !ok { // (-x)*y == -(x*y), so we write -x \cdot y
+			b, _ := layoutBinexpr(BinExpr{op: "*", x: x, y: e.y})
+			return row{symbol("neg"), b}, mathNeg
+		}
+	}
+	prec := precedence[e.op]
+	x, y := layout(e.x, prec), layout(e.y, prec+1)
+	if e.op == "*" && juxtapose(e.x, e.y) {
+		return row{x, y}, prec
+	}
+	return row{x, symbol(e.op), y}, prec
+}
+
+// isNegation returns whether e is 0-x, which the parser returns for -x.
+func isNegation(e BinExpr) bool {
+	return e.op == "-" && isValue(e.x, 0)
+}
+
+// negated returns x if e is -x: a negation or negative constant.
+func negated(e Expr) (Expr, bool) {
+	switch e := e.(type) {
+	case BinExpr:
+		if isNegation(e) {
+			return e.y, true
+		}
+	case Constant:
+		if math.Signbit(e.value) && !math.IsNaN(e.value) {
+			return Constant{-e.value}, true
+		}
+	}
+	return nil, false
+}
+
+// juxtapose returns whether x*y is typeset without multiplication sign, like 2x or 3\sin(x).
+// That is when x is a plain number, and y starts with a letter or parenthesis.
+func juxtapose(x, y Expr) bool {
+	if b, _ := layoutPrec(x); !isNumber(b) {
+		return false
+	}
+	if _, prec := layoutPrec(y); prec < mathFrac {
+		return true // parenthesized
+	}
+	for {
+		switch e := y.(type) {
+		case Variable, Ref, *CallExpr:
+			return true
+		case Constant:
+			b, _ := layoutPrec(e)
+			_, isIdent := b.(ident)
+			return isIdent
+		case BinExpr:
+			if e.op != "^" {
+				return false
+			}
+			y = e.x
+		case PowExpr:
+			y = e.x
+		default:
+			return false
+		}
+	}
+}
+
+func isNumber(b box) bool {
+	_, ok := b.(number)
+	return ok
+}
+
+// layoutConst typesets a number. Named constants get their symbol,
+// and exponents are written as powers of 10: 1.5e-3 becomes 1.5 \cdot 10^{-3}.
+func layoutConst(v float64) (box, int) {
+	switch {
+	case math.IsNaN(v):
+		return ident("nan"), mathPrimary
+	case math.Signbit(v):
+		b, _ := layoutConst(-v)
+		return row{symbol("neg"), b}, mathNeg
+	case math.IsInf(v, 1):
+		return ident("inf"), mathPrimary
+	case v == math.Pi:
+		return ident("pi"), mathPrimary
+	case v == math.E:
+		return ident("e"), mathPrimary
+	}
+	s := strconv.FormatFloat(v, 'g', -1, 64)
+	i := strings.IndexByte(s, 'e')
+	if i < 0 {
+		return number(s), mathPrimary
+	}
+	exp, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		panic(fmt.Sprintf("bug: layoutConst %v: %v", v, err))
+	}
+	pow := sup{number("10"), layout(Constant{float64(exp)}, mathLet)}
+	if mantissa := s[:i]; mantissa != "1" {
+		return row{number(mantissa), symbol("*"), pow}, precedence["*"]
+	}
+	return pow, mathPow
+}
+
+func layoutCall(e *CallExpr) box {
+	args := make([]box, len(e.args))
+	for i, a := range e.args {
+		args[i] = layout(a, mathIf)
+	}
+	switch {
+	case e.fun == "sqrt" && len(args) == 1:
+		return root{args[0]}
+	case e.fun == "fabs" && len(args) == 1:
+		return fenced{"|", args[0]}
+	case (e.fun == "floor" || e.fun == "ceil") && len(args) == 1:
+		return fenced{e.fun, args[0]}
+	case e.fun == "pow" && len(args) == 2:
+		return sup{layout(e.args[0], mathPrimary), args[1]}
+	}
+	return apply{e.fun, args}
+}
+
+// identParts splits a variable name in its base and subscript, if any:
+// x_max -> x, max and v0 -> v, 0.
+func identParts(name string) (base, sub string) {
+	if i := strings.IndexByte(name, '_'); i > 0 && i < len(name)-1 {
+		return name[:i], name[i+1:]
+	}
+	if base := strings.TrimRightFunc(name, unicode.IsDigit); base != "" && base != name {
+		return base, name[len(base):]
+	}
+	return name, ""
+}
+
+// greek maps Greek letter names to their symbol.
+var greek = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ε", "zeta": "ζ",
+	"eta": "η", "theta": "θ", "iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ",
+	"nu": "ν", "xi": "ξ", "pi": "π", "rho": "ρ", "sigma": "σ", "tau": "τ",
+	"upsilon": "υ", "phi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π",
+	"Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+}
+
+// funcNames holds the conventional names of functions, if different from ours.
+var funcNames = map[string]string{
+	"asin": "arcsin",
+	"acos": "arccos",
+	"atan": "arctan",
+	"log":  "ln",
+}
+
+// latexWriter renders boxes as LaTeX.
+type latexWriter struct {
+	strings.Builder
+}
+
+// latexSymbols holds the LaTeX for each symbol.
+var latexSymbols = map[string]string{
+	"+": " + ", "-": " - ", "*": " \\cdot ", "neg": "-",
+	"==": " = ", "!=": " \\neq ", "<": " < ", "<=": " \\leq ", ">": " > ", ">=": " \\geq ",
+	"&&": " \\land ", "||": " \\lor ", ":=": " = ", ";": ";\\quad ",
+}
+
+// latexDelims holds the opening and closing delimiters of fenced boxes.
+var latexDelims = map[string][2]string{
+	"(":     {`\left(`, `\right)`},
+	"|":     {`\left|`, `\right|`},
+	"floor": {`\left\lfloor `, ` \right\rfloor`},
+	"ceil":  {`\left\lceil `, ` \right\rceil`},
+}
+
+// latexFuncs are the functions that have a LaTeX command.
+var latexFuncs = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "arcsin": true, "arccos": true, "arctan": true,
+	"sinh": true, "cosh": true, "tanh": true, "exp": true, "ln": true, "min": true, "max": true,
+}
+
+func (w *latexWriter) write(b box) {
+	switch b := b.(type) {
+	default:
+		panic(fmt.Sprintf("bug: latex %T", b))
+	case number:
+		w.WriteString(string(b))
+	case ident:
+		w.writeIdent(string(b))
+	case symbol:
+		w.WriteString(latexSymbols[string(b)])
+	case row:
+		for _, b := range b {
+			w.write(b)
+		}
+	case fenced:
+		d := latexDelims[b.delim]
+		w.WriteString(d[0])
+		w.write(b.body)
+		w.WriteString(d[1])
+	case frac:
+		w.WriteString(`\frac`)
+		w.group(b.num)
+		w.group(b.den)
+	case sup:
+		w.write(b.base)
+		w.WriteString("^")
+		w.group(b.exp)
+	case root:
+		w.WriteString(`\sqrt`)
+		w.group(b.x)
+	case apply:
+		w.writeFunc(b.fun)
+		w.WriteString(`\left(`)
+		for i, a := range b.args {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			w.write(a)
+		}
+		w.WriteString(`\right)`)
+	case cases:
+		w.WriteString(`\begin{cases}`)
+		for i, c := range b {
+			if i > 0 {
+				w.WriteString(` \\`)
+			}
+			w.WriteString(" ")
+			w.write(c.value)
+			if c.cond != nil {
+				w.WriteString(` & \text{if } `)
+				w.write(c.cond)
+			} else {
+				w.WriteString(` & \text{otherwise}`)
+			}
+		}
+		w.WriteString(` \end{cases}`)
+	}
+}
+
+// group writes b in braces.
+func (w *latexWriter) group(b box) {
+	w.WriteString("{")
+	w.write(b)
+	w.WriteString("}")
+}
+
+func (w *latexWriter) writeIdent(name string) {
+	switch name {
+	case "inf":
+		w.WriteString(`\infty`)
+		return
+	case "nan":
+		w.WriteString(`\mathrm{NaN}`)
+		return
+	}
+	base, sub := identParts(name)
+	w.WriteString(latexName(base))
+	if sub != "" {
+		w.WriteString("_{" + latexName(sub) + "}")
+	}
+}
+
+// latexName returns the LaTeX for (part of) a variable name.
+func latexName(s string) string {
+	switch {
+	case greek[s] != "":
+		return `\` + s
+	case len(s) == 1 || strings.Trim(s, "0123456789") == "":
+		return s
+	}
+	return `\mathit{` + strings.Replace(s, "_", `\_`, -1) + `}`
+}
+
+func (w *latexWriter) writeFunc(fun string) {
+	if f, ok := funcNames[fun]; ok {
+		fun = f
+	}
+	switch {
+	case latexFuncs[fun]:
+		w.WriteString(`\` + fun)
+	case fun == "log10":
+		w.WriteString(`\log_{10}`)
+	default:
+		w.WriteString(`\operatorname{` + strings.Replace(fun, "_", `\_`, -1) + `}`)
+	}
+}
+
+// mathmlWriter renders boxes as presentation MathML.
+type mathmlWriter struct {
+	strings.Builder
+}
+
+// mathmlSymbols holds the MathML operator for each symbol.
+var mathmlSymbols = map[string]string{
+	"+": "+", "-": "−", "*": "⋅", "neg": "−",
+	"==": "=", "!=": "≠", "<": "&lt;", "<=": "≤", ">": "&gt;", ">=": "≥",
+	"&&": "∧", "||": "∨", ":=": "=", ";": ";",
+}
+
+// mathmlDelims holds the opening and closing delimiters of fenced boxes.
+var mathmlDelims = map[string][2]string{
+	"(":     {"(", ")"},
+	"|":     {"|", "|"},
+	"floor": {"⌊", "⌋"},
+	"ceil":  {"⌈", "⌉"},
+}
+
+func (w *mathmlWriter) write(b box) {
+	switch b := b.(type) {
+	default:
+		panic(fmt.Sprintf("bug: mathml %T", b))
+	case number:
+		w.elem("mn", string(b))
+	case ident:
+		w.writeIdent(string(b))
+	case symbol:
+		w.elem("mo", mathmlSymbols[string(b)])
+		if b == ";" {
+			w.WriteString(`<mspace width="1em"/>`)
+		}
+	case row:
+		w.WriteString("<mrow>")
+		for i, c := range b {
+			if i > 0 && !isSymbol(c) && !isSymbol(b[i-1]) {
+				w.elem("mo", "&#x2062;") // invisible times
+			}
+			w.write(c)
+		}
+		w.WriteString("</mrow>")
+	case fenced:
+		d := mathmlDelims[b.delim]
+		w.WriteString("<mrow>")
+		w.elem("mo", d[0])
+		w.write(b.body)
+		w.elem("mo", d[1])
+		w.WriteString("</mrow>")
+	case frac:
+		w.WriteString("<mfrac>")
+		w.write(b.num)
+		w.write(b.den)
+		w.WriteString("</mfrac>")
+	case sup:
+		w.WriteString("<msup>")
+		w.write(b.base)
+		w.write(b.exp)
+		w.WriteString("</msup>")
+	case root:
+		w.WriteString("<msqrt>")
+		w.write(b.x)
+		w.WriteString("</msqrt>")
+	case apply:
+		w.WriteString("<mrow>")
+		w.writeFunc(b.fun)
+		w.elem("mo", "&#x2061;") // function application
+		w.WriteString("<mrow>")
+		w.elem("mo", "(")
+		for i, a := range b.args {
+			if i > 0 {
+				w.elem("mo", ",")
+			}
+			w.write(a)
+		}
+		w.elem("mo", ")")
+		w.WriteString("</mrow></mrow>")
+	case cases:
+		w.WriteString("<mrow>")
+		w.elem("mo", "{")
+		w.WriteString("<mtable>")
+		for _, c := range b {
+			w.WriteString("<mtr><mtd>")
+			w.write(c.value)
+			w.WriteString("</mtd><mtd>")
+			if c.cond != nil {
+				w.elem("mtext", "if&#xa0;")
+				w.write(c.cond)
+			} else {
+				w.elem("mtext", "otherwise")
+			}
+			w.WriteString("</mtd></mtr>")
+		}
+		w.WriteString("</mtable></mrow>")
+	}
+}
+
+func isSymbol(b box) bool {
+	_, ok := b.(symbol)
+	return ok
+}
+
+// elem writes an element with text content, which must already be escaped.
+func (w *mathmlWriter) elem(tag, text string) {
+	w.WriteString("<" + tag + ">" + text + "</" + tag + ">")
+}
+
+func (w *mathmlWriter) writeIdent(name string) {
+	switch name {
+	case "inf":
+		w.elem("mi", "∞")
+		return
+	case "nan":
+		w.elem("mi", "NaN")
+		return
+	}
+	base, sub := identParts(name)
+	if sub == "" {
+		w.elem("mi", mathmlName(base))
+		return
+	}
+	w.WriteString("<msub>")
+	w.elem("mi", mathmlName(base))
+	if strings.Trim(sub, "0123456789") == "" {
+		w.elem("mn", sub)
+	} else {
+		w.elem("mi", mathmlName(sub))
+	}
+	w.WriteString("</msub>")
+}
+
+// mathmlName returns the (escaped) text for (part of) a variable name.
+func mathmlName(s string) string {
+	if g, ok := greek[s]; ok {
+		return g
+	}
+	return html.EscapeString(s)
+}
+
+func (w *mathmlWriter) writeFunc(fun string) {
+	if f, ok := funcNames[fun]; ok {
+		fun = f
+	}
+	if fun == "log10" {
+		w.WriteString("<msub>")
+		w.elem("mi", "log")
+		w.elem("mn", "10")
+		w.WriteString("</msub>")
+		return
+	}
+	w.elem("mi", html.EscapeString(fun))
+}
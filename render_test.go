@@ -0,0 +1,142 @@
+package jit
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFormatLaTeX(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"x", `x`},
+		{"x+y*2", `x + y \cdot 2`},
+		{"(x+y)*2", `\left(x + y\right) \cdot 2`},
+		{"2*x", `2x`},
+		{"2*(x+1)", `2\left(x + 1\right)`},
+		{"2*3", `2 \cdot 3`},
+		{"2*x^2", `2x^{2}`},
+		{"2*pi", `2\pi`},
+		{"x-(y-1)", `x - \left(y - 1\right)`},
+		{"x - -y", `x - \left(-y\right)`},
+		{"-x+y", `-x + y`},
+		{"-(x+y)", `-\left(x + y\right)`},
+		{"-x*y", `-x \cdot y`},
+		{"-2*x", `-2x`},
+		{"1 - -2*x", `1 - \left(-2x\right)`},
+		{"-(-x)*y", `\left(-\left(-x\right)\right) \cdot y`},
+		{"(x+1)/(y-1)", `\frac{x + 1}{y - 1}`},
+		{"(x/y)^2", `\left(\frac{x}{y}\right)^{2}`},
+		{"x^(y+1)", `x^{y + 1}`},
+		{"(x+1)^2", `\left(x + 1\right)^{2}`},
+		{"x^y^2", `x^{y^{2}}`},
+		{"(-2)^x", `\left(-2\right)^{x}`},
+		{"-2^x", `-2^{x}`},
+		{"sqrt(x*x+y*y)", `\sqrt{x \cdot x + y \cdot y}`},
+		{"sin(x)^2", `\sin\left(x\right)^{2}`},
+		{"atan(y/x)", `\arctan\left(\frac{y}{x}\right)`},
+		{"log(x)+log10(y)", `\ln\left(x\right) + \log_{10}\left(y\right)`},
+		{"atan2(y, x)", `\operatorname{atan2}\left(y, x\right)`},
+		{"fabs(x)+floor(y)", `\left|x\right| + \left\lfloor y \right\rfloor`},
+		{"1.5e-7", `1.5 \cdot 10^{-7}`},
+		{"1e6*x", `10^{6} \cdot x`},
+		{"0.001", `0.001`},
+		{"inf", `\infty`},
+		{"x <= y && y != 1", `x \leq y \land y \neq 1`},
+		{"!x", `x = 0`},
+		{"x < 0 ? -x : x", `\begin{cases} -x & \text{if } x < 0 \\ x & \text{otherwise} \end{cases}`},
+		{"x < 0 ? -1 : x > 0 ? 1 : 0", `\begin{cases} -1 & \text{if } x < 0 \\ 1 & \text{if } x > 0 \\ 0 & \text{otherwise} \end{cases}`},
+		{"1 + (x ? y : 1)", `1 + \left(\begin{cases} y & \text{if } x \\ 1 & \text{otherwise} \end{cases}\right)`},
+		{"r := x*x; r+1", `r = x \cdot x;\quad r + 1`},
+	}
+	for _, test := range tests {
+		root, err := Parse(test.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := FormatLaTeX(root); have != test.want {
+			t.Errorf("FormatLaTeX %q:\nhave %v\nwant %v", test.expr, have, test.want)
+		}
+	}
+}
+
+func TestFormatLaTeXNames(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"x", `x`},
+		{"theta", `\theta`},
+		{"Omega", `\Omega`},
+		{"v0", `v_{0}`},
+		{"x_max", `x_{\mathit{max}}`},
+		{"phi_1", `\phi_{1}`},
+		{"rho", `\rho`},
+		{"speed", `\mathit{speed}`},
+	}
+	for _, test := range tests {
+		if have := FormatLaTeX(NewVariable(test.name)); have != test.want {
+			t.Errorf("FormatLaTeX %q: have %v, want %v", test.name, have, test.want)
+		}
+	}
+}
+
+func TestFormatMathML(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"x", `<mi>x</mi>`},
+		{"x<1", `<mrow><mi>x</mi><mo>&lt;</mo><mn>1</mn></mrow>`},
+		{"2*x", `<mrow><mn>2</mn><mo>&#x2062;</mo><mi>x</mi></mrow>`},
+		{"-x/2", `<mfrac><mrow><mo>−</mo><mi>x</mi></mrow><mn>2</mn></mfrac>`},
+		{"(x+1)^2", `<msup><mrow><mo>(</mo><mrow><mi>x</mi><mo>+</mo><mn>1</mn></mrow><mo>)</mo></mrow><mn>2</mn></msup>`},
+		{"sqrt(x)", `<msqrt><mi>x</mi></msqrt>`},
+		{"sin(x)", `<mrow><mi>sin</mi><mo>&#x2061;</mo><mrow><mo>(</mo><mi>x</mi><mo>)</mo></mrow></mrow>`},
+	}
+	for _, test := range tests {
+		root, err := Parse(test.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		want := `<math xmlns="http://www.w3.org/1998/Math/MathML">` + test.want + `</math>`
+		if have := FormatMathML(root); have != want {
+			t.Errorf("FormatMathML %q:\nhave %v\nwant %v", test.expr, have, want)
+		}
+	}
+}
+
+// FormatMathML must produce well-formed XML, for any expression.
+func TestFormatMathMLWellFormed(t *testing.T) {
+	exprs := []string{
+		"r := x*x; s := sqrt(r); s < 1 ? log10(s) : x_max > y ? -inf : nan",
+		"floor(x) >= ceil(y) || fabs(x) != 2*pi*theta0",
+		"1e-300*atan2(y, x)^-2",
+	}
+	for expr := range tests {
+		exprs = append(exprs, expr)
+	}
+	for _, expr := range exprs {
+		root, err := ParseVars(expr, "x", "y", "x_max", "theta0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ml := FormatMathML(root)
+		d := xml.NewDecoder(strings.NewReader(ml))
+		for {
+			_, err := d.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("FormatMathML %q: %v: %v", expr, err, ml)
+				break
+			}
+		}
+	}
+}
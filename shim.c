@@ -1,40 +1,96 @@
 #include <math.h>
+#include "shim.h"
+#include "_cgo_export.h"
 
-void *func_acos  = acos;
-void *func_asin  = asin;
-void *func_atan  = atan;
-void *func_cos   = cos;
-void *func_cosh  = cosh;
-void *func_sin   = sin;
-void *func_sinh  = sinh;
-void *func_tan   = tan;
-void *func_tanh  = tanh;
-void *func_exp   = exp;
-void *func_log   = log;
-void *func_log10 = log10;
-void *func_sqrt  = sqrt;
-void *func_fabs  = fabs;
+void *func_acos     = acos;
+void *func_asin     = asin;
+void *func_atan     = atan;
+void *func_cos      = cos;
+void *func_cosh     = cosh;
+void *func_sin      = sin;
+void *func_sinh     = sinh;
+void *func_tan      = tan;
+void *func_tanh     = tanh;
+void *func_exp      = exp;
+void *func_log      = log;
+void *func_log10    = log10;
+void *func_sqrt     = sqrt;
+void *func_fabs     = fabs;
+void *func_atan2    = atan2;
+void *func_hypot    = hypot;
+void *func_fmod     = fmod;
+void *func_pow      = pow;
+void *func_fmin     = fmin;
+void *func_fmax     = fmax;
+void *func_copysign = copysign;
+void *func_fma      = fma;
+void *func_floor    = floor;
+void *func_ceil     = ceil;
+void *func_round    = round;
+void *func_trunc    = trunc;
+void *func_go_call  = go_call;
 
-double eval(void *code, double x, double y) {
-	double (*func)(double, double) = code;
-	return func(x, y);
+double eval(void *code, double *args) {
+	double (*func)(double*) = code;
+	return func(args);
+}
+
+double eval_grad(void *code, double *args, double *grad) {
+	double (*func)(double*, double*) = code;
+	return func(args, grad);
 }
 
 void eval_2d(void *code, double *dst, double xmin, double xmax, int nx, double ymin, double ymax, int ny){
 	int ix, iy;
-	double x, y;
-	double (*func)(double, double) = code;
+	double args[2];
+	double (*func)(double*) = code;
 	for(iy=0; iy<ny; iy++){
-		y = ymin + ((ymax-ymin)*(iy+0.5))/ny;
+		args[1] = ymin + ((ymax-ymin)*(iy+0.5))/ny;
 		for(ix=0; ix<nx; ix++){
-			x = xmin + ((xmax-xmin)*(ix+0.5))/nx;
-			dst[iy*nx+ix] = func(x, y);
+			args[0] = xmin + ((xmax-xmin)*(ix+0.5))/nx;
+			dst[iy*nx+ix] = func(args);
 		}
 	}
 }
 
-double call_func(void* f, double x){
-	double (*func)(double) = f;
-	return func(x);
+void eval_2d_mask(void *code, uint64_t *dst, double xmin, double xmax, int nx, double ymin, double ymax, int ny){
+	int ix, iy, i;
+	double args[2];
+	double (*func)(double*) = code;
+	for(i=0; i<(nx*ny+63)/64; i++){
+		dst[i] = 0;
+	}
+	for(iy=0; iy<ny; iy++){
+		args[1] = ymin + ((ymax-ymin)*(iy+0.5))/ny;
+		for(ix=0; ix<nx; ix++){
+			args[0] = xmin + ((xmax-xmin)*(ix+0.5))/nx;
+			i = iy*nx+ix;
+			if(func(args) != 0){
+				dst[i/64] |= ((uint64_t)1) << (i%64);
+			}
+		}
+	}
 }
 
+// call_func calls the function f with n double arguments.
+double call_func(void* f, double *a, int n){
+	switch(n){
+	case 0: return ((double (*)())f)();
+	case 1: return ((double (*)(double))f)(a[0]);
+	case 2: return ((double (*)(double, double))f)(a[0], a[1]);
+	case 3: return ((double (*)(double, double, double))f)(a[0], a[1], a[2]);
+	case 4: return ((double (*)(double, double, double, double))f)(a[0], a[1], a[2], a[3]);
+	case 5: return ((double (*)(double, double, double, double, double))f)(a[0], a[1], a[2], a[3], a[4]);
+	case 6: return ((double (*)(double, double, double, double, double, double))f)(a[0], a[1], a[2], a[3], a[4], a[5]);
+	case 7: return ((double (*)(double, double, double, double, double, double, double))f)(a[0], a[1], a[2], a[3], a[4], a[5], a[6]);
+	case 8: return ((double (*)(double, double, double, double, double, double, double, double))f)(a[0], a[1], a[2], a[3], a[4], a[5], a[6], a[7]);
+	}
+	return 0.0/0.0;
+}
+
+// go_call calls the Go function with index idx, registered by RegisterGoFunc(2).
+// The generated code passes idx in rdi and the arguments in xmm0, xmm1,
+// which is how go_call receives them following the System V ABI.
+double go_call(int64_t idx, double a, double b){
+	return goCallback(idx, a, b);
+}
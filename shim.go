@@ -13,33 +13,92 @@ import (
 //#include "shim.h"
 import "C"
 
-var funcs = map[string]uintptr{
-	"acos":  uintptr(C.func_acos),
-	"asin":  uintptr(C.func_asin),
-	"atan":  uintptr(C.func_atan),
-	"cos":   uintptr(C.func_cos),
-	"cosh":  uintptr(C.func_cosh),
-	"sin":   uintptr(C.func_sin),
-	"sinh":  uintptr(C.func_sinh),
-	"tan":   uintptr(C.func_tan),
-	"tanh":  uintptr(C.func_tanh),
-	"exp":   uintptr(C.func_exp),
-	"log":   uintptr(C.func_log),
-	"log10": uintptr(C.func_log10),
-	"sqrt":  uintptr(C.func_sqrt),
-	"fabs":  uintptr(C.func_fabs),
-}
-
-// call calls the machine code, which must hold a function of two float64s,
+// maxArity is the maximum number of function arguments,
+// all passed in registers xmm0-xmm7.
+const maxArity = 8
+
+// builtin is a C function that can be called from expressions.
+type builtin struct {
+	ptr   unsafe.Pointer // C function pointer
+	arity int            // number of double arguments
+	pure  bool           // no side effects, result depends only on the arguments
+	gofn  *gofunc        // Go function called through go_call, nil for C functions
+}
+
+// libm returns the builtin for a pure C function from the math library.
+func libm(ptr unsafe.Pointer, arity int) builtin {
+	return builtin{ptr: ptr, arity: arity, pure: true}
+}
+
+// call calls the function. Used for constant folding, like sqrt(2).
+func (f builtin) call(args ...float64) float64 {
+	if f.gofn != nil {
+		return f.gofn.call(args)
+	}
+	return callCFunc(f.ptr, args...)
+}
+
+// funcs holds the functions callable from expressions, guarded by namesMu.
+var funcs = map[string]builtin{
+	"acos":     libm(C.func_acos, 1),
+	"asin":     libm(C.func_asin, 1),
+	"atan":     libm(C.func_atan, 1),
+	"cos":      libm(C.func_cos, 1),
+	"cosh":     libm(C.func_cosh, 1),
+	"sin":      libm(C.func_sin, 1),
+	"sinh":     libm(C.func_sinh, 1),
+	"tan":      libm(C.func_tan, 1),
+	"tanh":     libm(C.func_tanh, 1),
+	"exp":      libm(C.func_exp, 1),
+	"log":      libm(C.func_log, 1),
+	"log10":    libm(C.func_log10, 1),
+	"sqrt":     libm(C.func_sqrt, 1),
+	"fabs":     libm(C.func_fabs, 1),
+	"atan2":    libm(C.func_atan2, 2),
+	"hypot":    libm(C.func_hypot, 2),
+	"fmod":     libm(C.func_fmod, 2),
+	"pow":      libm(C.func_pow, 2),
+	"min":      libm(C.func_fmin, 2),
+	"max":      libm(C.func_fmax, 2),
+	"copysign": libm(C.func_copysign, 2),
+	"fma":      libm(C.func_fma, 3),
+	"floor":    libm(C.func_floor, 1),
+	"ceil":     libm(C.func_ceil, 1),
+	"round":    libm(C.func_round, 1),
+	"trunc":    libm(C.func_trunc, 1),
+}
+
+// eval calls the machine code, which must hold a function of an array of float64s,
 // and returns the result.
-func eval(code []byte, x, y float64) float64 {
-	return float64(C.eval(unsafe.Pointer(&code[0]), C.double(x), C.double(y)))
+func eval(code []byte, args []float64) float64 {
+	var argp *C.double
+	if len(args) > 0 {
+		argp = (*C.double)(&args[0])
+	}
+	return float64(C.eval(unsafe.Pointer(&code[0]), argp))
 }
 
-// callCFunc calls a C function with one double argument.
+// evalGrad calls the machine code, which must hold a function of an array of float64s,
+// storing its gradient in another array, and returns the result.
+func evalGrad(code []byte, args, grad []float64) float64 {
+	var argp, gradp *C.double
+	if len(args) > 0 {
+		argp, gradp = (*C.double)(&args[0]), (*C.double)(&grad[0])
+	}
+	return float64(C.eval_grad(unsafe.Pointer(&code[0]), argp, gradp))
+}
+
+// callCFunc calls a C function with double arguments.
 // Used for constant folding, like sqrt(2).
-func callCFunc(f uintptr, x float64) float64 {
-	return float64(C.call_func(unsafe.Pointer(f), C.double(x)))
+func callCFunc(f unsafe.Pointer, args ...float64) float64 {
+	if len(args) > maxArity {
+		panic(fmt.Sprintf("callCFunc: too many arguments: %v", len(args)))
+	}
+	var argp *C.double
+	if len(args) > 0 {
+		argp = (*C.double)(&args[0])
+	}
+	return float64(C.call_func(f, argp, C.int(len(args))))
 }
 
 // eval2D evaluates the code nx * ny times
@@ -53,3 +112,14 @@ func eval2D(code []byte, dst []float64, xmin, xmax float64, nx int, ymin, ymax f
 		C.double(xmin), C.double(xmax), C.int(nx),
 		C.double(ymin), C.double(ymax), C.int(ny))
 }
+
+// eval2DMask is like eval2D, but stores one bit per evaluation in dst:
+// set if the result is non-zero (or NaN), cleared otherwise.
+func eval2DMask(code []byte, dst []uint64, xmin, xmax float64, nx int, ymin, ymax float64, ny int) {
+	if len(dst) != (nx*ny+63)/64 {
+		panic(fmt.Sprintf("eval2DMask: nx=%v, ny=%v needs len(dst)=%v, have %v", nx, ny, (nx*ny+63)/64, len(dst)))
+	}
+	C.eval_2d_mask(unsafe.Pointer(&code[0]), (*C.uint64_t)(&dst[0]),
+		C.double(xmin), C.double(xmax), C.int(nx),
+		C.double(ymin), C.double(ymax), C.int(ny))
+}
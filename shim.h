@@ -1,3 +1,8 @@
+#ifndef SHIM_H
+#define SHIM_H
+
+#include <stdint.h>
+
 extern void *func_acos;
 extern void *func_asin;
 extern void *func_atan;
@@ -12,10 +17,55 @@ extern void *func_log;
 extern void *func_log10;
 extern void *func_sqrt;
 extern void *func_fabs;
+extern void *func_atan2;
+extern void *func_hypot;
+extern void *func_fmod;
+extern void *func_pow;
+extern void *func_fmin;
+extern void *func_fmax;
+extern void *func_copysign;
+extern void *func_fma;
+extern void *func_floor;
+extern void *func_ceil;
+extern void *func_round;
+extern void *func_trunc;
+extern void *func_go_call;
+
+double eval(void *code, double *args);
 
-double eval(void *code, double x, double y);
+double eval_grad(void *code, double *args, double *grad);
 
 void eval_2d(void *code, double *dst, double xmin, double xmax, int nx, double ymin, double ymax, int ny);
 
-double call_func(void* f, double x);
+void eval_2d_mask(void *code, uint64_t *dst, double xmin, double xmax, int nx, double ymin, double ymax, int ny);
+
+double call_func(void* f, double *args, int n);
+
+double go_call(int64_t idx, double a, double b);
+
+// interval is the set of numbers [lo, hi], and NaN if nan is set.
+// It is empty if lo > hi. See interval.c.
+typedef struct {
+	double lo, hi;
+	int32_t nan;
+} interval;
+
+// iv_instr is an instruction for eval_interval.
+typedef struct {
+	int32_t op;      // operation, IV_ADD, IV_SIN, ...
+	int32_t a, b, c; // operands: indices of earlier intervals
+	double k;        // value of IV_CONST, exponent of IV_POWI
+} iv_instr;
+
+enum {
+	IV_CONST, IV_ENTIRE, IV_POWI, IV_IF,
+	IV_ADD, IV_SUB, IV_MUL, IV_DIV, IV_POW,
+	IV_EQ, IV_NE, IV_LT, IV_LE, IV_GT, IV_GE, IV_AND, IV_OR,
+	IV_ACOS, IV_ASIN, IV_ATAN, IV_COS, IV_COSH, IV_SIN, IV_SINH, IV_TAN, IV_TANH,
+	IV_EXP, IV_LOG, IV_LOG10, IV_SQRT, IV_FABS, IV_FLOOR, IV_CEIL, IV_ROUND, IV_TRUNC,
+	IV_ATAN2, IV_HYPOT, IV_FMOD, IV_MIN, IV_MAX, IV_COPYSIGN, IV_FMA,
+};
+
+void eval_interval(const iv_instr *prog, int n, interval *v, int nvars);
 
+#endif
@@ -0,0 +1,220 @@
+package jit
+
+// this file implements user-defined functions, like f(t) = t*t - 1,
+// which are either expanded inline or compiled into separate code called by the expression.
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxInlineSize is the largest number of AST nodes in the body of
+// a user function that is expanded inline, rather than called.
+const maxInlineSize = 24
+
+// funcDef is a user-defined function, like f(t) = t*t - 1.
+// In the body, the parameters are variables.
+type funcDef struct {
+	name   string
+	params []string
+	body   Expr
+	tok    token // name in the definition, for error messages
+}
+
+// inline returns whether calls to d are expanded inline,
+// rather than calling d's separately compiled code.
+func (d *funcDef) inline() bool {
+	return useInlining && size(d.body) <= maxInlineSize
+}
+
+// size returns the number of nodes in the AST rooted at e.
+func size(e Expr) int {
+	n := 1
+	for _, c := range e.children() {
+		n += size(c)
+	}
+	return n
+}
+
+// calledFuncs returns the names of the user functions in defs called in e.
+func calledFuncs(e Expr, defs map[string]*funcDef) []string {
+	var names []string
+	seen := make(map[string]bool)
+	var walk func(e Expr)
+	walk = func(e Expr) {
+		for _, c := range e.children() {
+			walk(c)
+		}
+		if c, ok := e.(*CallExpr); ok && defs[c.fun] != nil && !seen[c.fun] {
+			seen[c.fun] = true
+			names = append(names, c.fun)
+		}
+	}
+	walk(e)
+	return names
+}
+
+// callPath returns a chain of calls from function d to the function named target,
+// like [d, g, target], or nil if d does not call target.
+func callPath(d *funcDef, target string, defs map[string]*funcDef, visited map[string]bool) []string {
+	visited[d.name] = true
+	for _, name := range calledFuncs(d.body, defs) {
+		if name == target {
+			return []string{d.name, name}
+		}
+		if visited[name] {
+			continue
+		}
+		if path := callPath(defs[name], target, defs, visited); path != nil {
+			return append([]string{d.name}, path...)
+		}
+	}
+	return nil
+}
+
+// inliner expands calls to user functions into their bodies,
+// binding the arguments to the parameters with LetExprs.
+type inliner struct {
+	defs map[string]*funcDef
+	all  bool            // expand all calls, not only to functions with inline() == true
+	used map[string]bool // names that may not be used for bindings
+	n    int             // counter for making up binding names
+}
+
+// newInliner returns an inliner for calls to defs, in expressions of vars.
+func newInliner(defs map[string]*funcDef, vars []string, all bool) *inliner {
+	in := &inliner{defs: defs, all: all, used: make(map[string]bool)}
+	for _, v := range vars {
+		in.used[v] = true
+	}
+	return in
+}
+
+// expand returns a copy of e with the calls to user functions expanded inline.
+func (in *inliner) expand(e Expr) Expr {
+	in.reserve(e)
+	return in.expandCalls(e)
+}
+
+// reserve marks the names of the bindings in e as used.
+func (in *inliner) reserve(e Expr) {
+	if l, ok := e.(LetExpr); ok {
+		in.used[l.name] = true
+	}
+	for _, c := range e.children() {
+		in.reserve(c)
+	}
+}
+
+func (in *inliner) expandCalls(e Expr) Expr {
+	e = rebuild(e, in.expandCalls)
+	c, ok := e.(*CallExpr)
+	if !ok {
+		return e
+	}
+	d, ok := in.defs[c.fun]
+	if !ok || !(in.all || d.inline()) {
+		return e
+	}
+
+	// Simple arguments are substituted for the parameters,
+	// others are evaluated once and bound to a new name.
+	args := make(map[string]Expr)
+	var binds []LetExpr
+	for i, p := range d.params {
+		switch a := c.args[i].(type) {
+		case Variable, Constant, Ref:
+			args[p] = a
+		default:
+			name := in.newName(p)
+			args[p] = Ref{name: name}
+			binds = append(binds, LetExpr{name: name, value: a})
+		}
+	}
+	body := in.expandCalls(substituteVars(in.renameLocals(d.body), args))
+	for i := len(binds) - 1; i >= 0; i-- {
+		body = LetExpr{name: binds[i].name, value: binds[i].value, body: body}
+	}
+	return body
+}
+
+// renameLocals returns a copy of the body e with new names for its local bindings,
+// so that they cannot capture the caller's names once e is expanded inline.
+func (in *inliner) renameLocals(e Expr) Expr {
+	e = rebuild(e, in.renameLocals)
+	if l, ok := e.(LetExpr); ok {
+		name := in.newName(l.name)
+		return LetExpr{name: name, value: l.value, body: substitute(l.body, l.name, Ref{name: name})}
+	}
+	return e
+}
+
+// newName returns a new name for binding parameter or local binding p,
+// which does not clash with any other name.
+func (in *inliner) newName(p string) string {
+	for {
+		in.n++
+		name := fmt.Sprintf("%v_%v", p, in.n)
+		if _, isConst := lookupConst(name); !in.used[name] && !isConst && !isFunc(name) && in.defs[name] == nil {
+			in.used[name] = true
+			return name
+		}
+	}
+}
+
+// substituteVars returns a copy of e where each variable in args has been replaced by its value.
+func substituteVars(e Expr, args map[string]Expr) Expr {
+	if v, ok := e.(Variable); ok {
+		if a, ok := args[v.name]; ok {
+			return a
+		}
+	}
+	return rebuild(e, func(c Expr) Expr { return substituteVars(c, args) })
+}
+
+// Module holds user-defined functions, which can be called from the expressions it compiles. E.g.:
+// 	m := NewModule()
+// 	err := m.Define("f(t) = t*t - 1; g(a, b) = f(a) * f(b)")
+// 	code, err := m.Compile("g(x, y) + 1")
+// Functions may call each other, in any order, but not recursively.
+// Small functions are expanded inline, others are compiled separately and called.
+// Link compiles all of them into a CompiledModule.
+type Module struct {
+	mu   sync.RWMutex
+	defs map[string]*funcDef
+	srcs []string // the definitions, for errors
+}
+
+// NewModule returns a module without functions.
+func NewModule() *Module {
+	return &Module{defs: make(map[string]*funcDef)}
+}
+
+// Define adds the function definitions in src to the module,
+// separated by semicolons. E.g.:
+// 	m.Define("sq(t) = t*t; norm(a, b) = sqrt(sq(a) + sq(b))")
+// The functions may call each other and the functions defined before.
+// Errors in src are returned as a *ParseError, in which case the module is unchanged.
+func (m *Module) Define(src string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, defs, err := parse(src, nil, m.defs, false)
+	if err != nil {
+		return err
+	}
+	m.defs = defs
+	m.srcs = append(m.srcs, src)
+	return nil
+}
+
+// Compile is like the function Compile, but the expression may call the module's functions.
+func (m *Module) Compile(ex string) (*Code, error) {
+	return m.CompileVars(ex, "x", "y")
+}
+
+// CompileVars is like the function CompileVars, but the expression may call the module's functions.
+func (m *Module) CompileVars(ex string, vars ...string) (*Code, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return compile(m.defs, ex, vars)
+}
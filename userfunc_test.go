@@ -0,0 +1,221 @@
+package jit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// a function too large to be inlined
+const bigDef = "big(a, b) = a*a*a - b*b*b + a/(1+b*b) + sqrt(a*a+b*b) + a*b"
+
+func big(a, b float64) float64 {
+	return ((a*a*a - b*b*b) + a/(1+b*b)) + math.Sqrt(a*a+b*b) + a*b
+}
+
+func TestUserFuncs(t *testing.T) {
+	tests := map[string]func(x, y float64) float64{
+		"f(t) = t*t - 1; f(x) * f(y)":                     func(x, y float64) float64 { return (x*x - 1) * (y*y - 1) },
+		"f(t) = t*t - 1; f(x+y)":                          func(x, y float64) float64 { return (x+y)*(x+y) - 1 },
+		"f(t) = t*t - 1; f(f(x))":                         func(x, y float64) float64 { return (x*x-1)*(x*x-1) - 1 },
+		"f(t) = t*t; f(3) + x":                            func(x, y float64) float64 { return 9 + x },
+		"g(a, b) = f(a) - b; f(t) = 2*t; g(y, x)":         func(x, y float64) float64 { return 2*y - x },
+		"c() = 42; c() + x":                               func(x, y float64) float64 { return 42 + x },
+		"d(a, b, c, e_) = a - b*c/e_; d(x, y, 2, x+y)":    func(x, y float64) float64 { return x - y*2/(x+y) },
+		"r := x*x; f(t) = t+1; f(r) * r":                  func(x, y float64) float64 { return (x*x + 1) * (x * x) },
+		"f(x) = x/2; x := y; f(x)":                        nil, // x redeclared
+		"f(y, x) = y - x; f(x, y)":                        func(x, y float64) float64 { return x - y },
+		"f(t) = r := t*t; r+1; f(x) * f(y)":               func(x, y float64) float64 { return (x*x + 1) * (y*y + 1) },
+		"f(t) = a := t+1; b := a*a; b-a; f(x+y)":          func(x, y float64) float64 { return ((x+y+1)*(x+y+1) - (x + y + 1)) },
+		"g(t) = r := t*2; r+t; r := x; g(r) + r":          func(x, y float64) float64 { return (x*2 + x) + x },
+		"f(t) = r := t; r := 2; r; f(x)":                  nil, // r redeclared
+		bigDef + "; big(x, y)":                            big,
+		bigDef + "; big(y, x) - big(x, y)":                func(x, y float64) float64 { return big(y, x) - big(x, y) },
+		bigDef + "; 1 + big(big(x, 1), y) * sqrt(x*x+1)":  func(x, y float64) float64 { return 1 + big(big(x, 1), y)*math.Sqrt(x*x+1) },
+		bigDef + "; f(t) = big(t, t) + 1; f(x) / f(y)":    func(x, y float64) float64 { return (big(x, x) + 1) / (big(y, y) + 1) },
+		bigDef + "; r := x+y; s := x-y; big(r, s) + r*s":  func(x, y float64) float64 { return big(x+y, x-y) + (x+y)*(x-y) },
+		bigDef + "; fma(big(x, y), big(y, x), big(x, x))": func(x, y float64) float64 { return math.FMA(big(x, y), big(y, x), big(x, x)) },
+	}
+	for expr, want := range tests {
+		for _, useInlining = range []bool{true, false} {
+			for _, useRegisters = range []bool{true, false} {
+				code, err := Compile(expr)
+				if want == nil {
+					if err == nil {
+						t.Errorf("compile %q: expected error", expr)
+						code.Free()
+					}
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				for _, x := range []float64{-2, 0, 0.5, 3} {
+					for _, y := range []float64{-1, 0.25, 7} {
+						if have, want := code.Eval(x, y), want(x, y); have != want && !(math.IsNaN(have) && math.IsNaN(want)) {
+							t.Errorf("%v (x=%v, y=%v, inline=%v): have %v, want %v", expr, x, y, useInlining, have, want)
+						}
+					}
+				}
+				code.Free()
+			}
+		}
+	}
+	useInlining = true
+	useRegisters = true
+}
+
+func TestParseUserFuncs(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"f(t) = t*t - 1; f(x) * f(y)", "(((x*x)-1)*((y*y)-1))"},
+		{"f(t) = t*t; f(x+1)", "t_1 := (x+1); (t_1*t_1)"},
+		{"t_1 := x; f(t) = t*t; f(t_1+1)", "t_1 := x; t_2 := (t_1+1); (t_2*t_2)"},
+		{"f(a, b) = a - b; f(y, x)", "(y-x)"},
+	}
+	for _, test := range tests {
+		root, err := Parse(test.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := fmt.Sprint(root); have != test.want {
+			t.Errorf("parse %q: have %v, want %v", test.expr, have, test.want)
+		}
+	}
+}
+
+func TestUserFuncErrors(t *testing.T) {
+	tests := []struct {
+		expr   string
+		kind   ErrorKind
+		offset int
+	}{
+		{"f(t) = f(t); f(x)", KindRecursion, 0},
+		{"f(t) = g(t); g(t) = 1 + f(t); f(x)", KindRecursion, 0},
+		{"h(t) = t; g(t) = f(h(t)); f(t) = g(t); 1", KindRecursion, 10},
+		{"f(t) = t; f(x, y)", KindArity, 10},
+		{"f(t) = t; f()", KindArity, 10},
+		{"f(t) = t; f(t) = 2*t; f(x)", KindRedeclared, 10},
+		{"sin(t) = t; sin(x)", KindRedeclared, 0},
+		{"pi(t) = t; pi(x)", KindRedeclared, 0},
+		{"x(t) = t; x(y)", KindRedeclared, 0},
+		{"f(t, t) = t; f(x, y)", KindRedeclared, 5},
+		{"f(pi) = pi; f(x)", KindRedeclared, 2},
+		{"f(sin) = sin; f(x)", KindRedeclared, 2},
+		{"f(t) = t; g(f) = f; g(x)", KindRedeclared, 12},
+		{"f(t) = t; f := 1; f", KindRedeclared, 10},
+		{"f(t) = t*x; f(y)", KindUnknownIdent, 9},
+		{"r := 1; f(t) = t*r; f(y)", KindUnknownIdent, 17},
+		{"f(a,b,c,d,e_,g,h,i,j) = a; 1", KindArity, 0},
+		{"f(t) = t", KindSyntax, 8},
+		{"f(t) == t", KindUnknownIdent, 2},
+	}
+	for _, test := range tests {
+		_, err := Compile(test.expr)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("compile %q: want *ParseError, have %#v", test.expr, err)
+			continue
+		}
+		if perr.Kind != test.kind || perr.Offset != test.offset {
+			t.Errorf("compile %q: have %v at %v (%v), want %v at %v", test.expr, perr.Kind, perr.Offset, perr.Msg, test.kind, test.offset)
+		}
+	}
+}
+
+func TestModule(t *testing.T) {
+	m := NewModule()
+	if err := m.Define("sq(t) = t*t; norm(a, b) = s := sq(a) + sq(b); sqrt(s)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Define(bigDef + "; h(a) = big(a, norm(a, 1))"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func(x, y float64) float64{
+		"norm(x, y)":           func(x, y float64) float64 { return math.Sqrt(x*x + y*y) },
+		"sq(x) - sq(y)":        func(x, y float64) float64 { return x*x - y*y },
+		"h(x) * h(y)":          func(x, y float64) float64 { return big(x, math.Sqrt(x*x+1)) * big(y, math.Sqrt(y*y+1)) },
+		"f(t) = sq(t)+1; f(x)": func(x, y float64) float64 { return x*x + 1 },
+	}
+	for expr, want := range tests {
+		for _, useInlining = range []bool{true, false} {
+			code, err := m.Compile(expr)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			for _, x := range []float64{-2, 0, 3} {
+				for _, y := range []float64{-1, 7} {
+					if have, want := code.Eval(x, y), want(x, y); have != want {
+						t.Errorf("%v (x=%v, y=%v, inline=%v): have %v, want %v", expr, x, y, useInlining, have, want)
+					}
+				}
+			}
+			code.Free()
+		}
+	}
+	useInlining = true
+
+	// the module's functions are not visible without the module
+	if _, err := Compile("sq(x)"); err == nil {
+		t.Errorf("compile sq(x) without module: expected error")
+	}
+}
+
+func TestModuleErrors(t *testing.T) {
+	m := NewModule()
+	if err := m.Define("sq(t) = t*t"); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []string{
+		"sq(t) = t",         // redefined
+		"f(t) = t; g(t) = ", // syntax error
+		"x + 1",             // not a definition
+		"f(t) = g(t)",       // g defined later
+		"f(t) = f(t)",       // recursive
+		"f(t) = sq(t, t)",   // arity
+	} {
+		if err := m.Define(src); err == nil {
+			t.Errorf("define %q: expected error", src)
+		}
+	}
+	if err := m.Define("f(t) = t"); err != nil {
+		t.Errorf("define after errors: %v", err)
+	}
+	if _, err := m.CompileVars("sq", "sq"); err == nil {
+		t.Errorf("variable clashing with module function: expected error")
+	}
+	if _, err := m.Compile("sq := 1; sq"); err == nil {
+		t.Errorf("binding clashing with module function: expected error")
+	}
+}
+
+func TestUserFuncInline(t *testing.T) {
+	tests := []struct {
+		expr   string
+		called int
+	}{
+		{"f(t) = t*t - 1; f(x) * f(y)", 0},
+		{bigDef + "; big(x, y)", 1},
+		{bigDef + "; big(x, y) + big(y, x)", 1},
+		{bigDef + "; f(t) = big(t, 1); f(x) + f(y)", 1},
+		{bigDef + "; f(t) = big(t, 1); 1", 0},
+	}
+	for _, test := range tests {
+		root, defs, err := parse(test.expr, []string{"x", "y"}, nil, true)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		root = newInliner(defs, []string{"x", "y"}, false).expand(root)
+		if have := len(calledFuncs(root, defs)); have != test.called {
+			t.Errorf("compile %q: have %v called functions, want %v", test.expr, have, test.called)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package jit
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// If the result visitor w is not nil, Walk visits each of the children
+// of node with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(e Expr) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order, like go/ast.Walk:
+// It starts by calling v.Visit(e); e must not be nil. If the visitor w returned by
+// v.Visit(e) is not nil, Walk is invoked recursively with visitor
+// w for each of the non-nil children of e, followed by a call of
+// w.Visit(nil).
+// The children are visited in AST order: operands from left to right,
+// the condition of an IfExpr before its branches, and the value of a LetExpr before its body.
+// This need not be the order the generated code evaluates them in,
+// which may evaluate the right operand of a binary expression first.
+func Walk(e Expr, v Visitor) {
+	if v = v.Visit(e); v == nil {
+		return
+	}
+	for _, c := range e.children() {
+		if c != nil {
+			Walk(c, v)
+		}
+	}
+	v.Visit(nil)
+}
+
+// inspector adapts a function to the Visitor interface, see Inspect.
+type inspector func(Expr) bool
+
+func (f inspector) Visit(e Expr) Visitor {
+	if f(e) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order, like go/ast.Inspect:
+// It starts by calling f(e); e must not be nil. If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of e, followed by a call of f(nil).
+// E.g., to collect the called functions:
+// 	Inspect(e, func(e Expr) bool {
+// 		if c, ok := e.(*CallExpr); ok {
+// 			called = append(called, c.Fun())
+// 		}
+// 		return true
+// 	})
+func Inspect(e Expr, f func(Expr) bool) {
+	Walk(e, inspector(f))
+}
+
+// Rewrite returns a copy of e where each node has been replaced by f(node), bottom-up:
+// f is called on a node after its children have been rewritten. E.g., to replace x by 2*t:
+// 	Rewrite(e, func(e Expr) Expr {
+// 		if v, ok := e.(Variable); ok && v.Name() == "x" {
+// 			return NewBinExpr("*", NewConstant(2), NewVariable("t"))
+// 		}
+// 		return e
+// 	})
+// e itself is not modified.
+func Rewrite(e Expr, f func(Expr) Expr) Expr {
+	return f(rebuild(e, func(c Expr) Expr { return Rewrite(c, f) }))
+}
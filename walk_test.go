@@ -0,0 +1,109 @@
+package jit
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// tracer records the nodes visited by Walk, with nil (end of children) as ")".
+type tracer struct{ trace []string }
+
+func (t *tracer) Visit(e Expr) Visitor {
+	if e == nil {
+		t.trace = append(t.trace, ")")
+		return nil
+	}
+	switch e := e.(type) {
+	case BinExpr:
+		t.trace = append(t.trace, e.Op())
+	case *CallExpr:
+		t.trace = append(t.trace, e.Fun())
+	case IfExpr:
+		t.trace = append(t.trace, "if")
+	case LetExpr:
+		t.trace = append(t.trace, e.Name()+":=")
+	default:
+		t.trace = append(t.trace, fmt.Sprint(e))
+	}
+	return t
+}
+
+func TestWalk(t *testing.T) {
+	tests := []struct {
+		expr, want string
+	}{
+		{"x", "x )"},
+		{"x+1", "+ x ) 1 ) )"},
+		{"sin(x)*y", "* sin x ) ) y ) )"},
+		{"a := x; a < y ? a : 2", "a:= x ) if < a ) y ) ) a ) 2 ) ) )"},
+	}
+	for _, test := range tests {
+		root, err := Parse(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tr tracer
+		Walk(root, &tr)
+		if have := strings.Join(tr.trace, " "); have != test.want {
+			t.Errorf("Walk %q: have %q, want %q", test.expr, have, test.want)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	root, err := Parse("sin(x) + cos(atan2(y, x)) * fabs(y)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called []string
+	Inspect(root, func(e Expr) bool {
+		if c, ok := e.(*CallExpr); ok {
+			called = append(called, c.Fun())
+			return c.Fun() != "cos" // prune
+		}
+		return true
+	})
+	if have, want := strings.Join(called, " "), "sin cos fabs"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	root, err := Parse("x*x + sin(x-y)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := Rewrite(root, func(e Expr) Expr {
+		if v, ok := e.(Variable); ok && v.Name() == "x" {
+			return NewBinExpr("*", NewConstant(2), NewVariable("y"))
+		}
+		return e
+	})
+	want, err := Parse("(2*y)*(2*y) + sin(2*y-y)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameExpr(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// bottom-up: parents see their rewritten children
+	have = Rewrite(root, func(e Expr) Expr {
+		if c, ok := e.(*CallExpr); ok && c.Fun() == "sin" {
+			return NewCallExpr("cos", c.Args()...)
+		}
+		if b, ok := e.(BinExpr); ok && b.Op() == "+" {
+			if _, ok := b.Y().(*CallExpr); !ok || b.Y().(*CallExpr).Fun() != "cos" {
+				t.Errorf("Rewrite is not bottom-up: %v", b)
+			}
+		}
+		return e
+	})
+	if want, _ := Parse("x*x + cos(x-y)"); !sameExpr(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if want, _ := Parse("x*x + sin(x-y)"); !sameExpr(root, want) {
+		t.Errorf("Rewrite modified its argument: %v", root)
+	}
+}